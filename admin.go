@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminToken guards the /admin endpoints, which are only registered when
+// it is set. It is separate from user authentication: admin calls come
+// from moderation tooling, not from a chat user.
+var adminToken = os.Getenv("ADMIN_TOKEN")
+
+// maxCloseReason is the longest reason a close frame can carry: control
+// frames hold at most 125 bytes, two of them the close code.
+const maxCloseReason = 123
+
+// adminKey is the gin context key NewAdminMiddleware sets on the requests
+// it lets through.
+const adminKey = "admin"
+
+// NewAdminMiddleware accepts requests whose X-Admin-Token header is token.
+func NewAdminMiddleware(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		given := c.GetHeader("X-Admin-Token")
+		if given == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			respondError(c, http.StatusUnauthorized, ErrCodeUnauthorized, "invalid admin token")
+			return
+		}
+		c.Set(adminKey, true)
+		c.Next()
+	}
+}
+
+// kickUser closes every live connection of {"user"} with CloseKicked and
+// an optional "reason", and clears the user's presence. Kicked sessions
+// cannot be resumed; nothing stops the user from connecting again.
+func (r *Router) kickUser(c *gin.Context) {
+	var req struct {
+		User   string `json:"user" binding:"required"`
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	user, err := normalizeUserID(req.User)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "user: "+err.Error())
+		return
+	}
+	if len(req.Reason) > maxCloseReason {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "reason is longer than 123 bytes")
+		return
+	}
+	reason := req.Reason
+	if reason == "" {
+		reason = "disconnected by an administrator"
+	}
+
+	closed := len(disconnectUser(user, reason))
+	unlock := keyLocks.lock(presenceKey(user))
+	err = r.dbclient.SetUserOffline(c, user)
+	unlock()
+	if err != nil {
+		logger.Error("clear presence failed", "event", "admin_kick", "user", user, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to clear presence")
+		return
+	}
+	logger.Info("kicked user", "event", "admin_kick", "user", user, "connections", closed, "reason", reason)
+	c.JSON(http.StatusOK, gin.H{"user": user, "closed": closed})
+}
+
+// disconnectUser has the writer of every live connection of user close it
+// with CloseKicked and reason, without resume, and returns them. It does
+// not wait for the connections to close, see awaitDisconnected.
+func disconnectUser(user, reason string) []*Client {
+	clients := connectionsFor(user)
+	for _, client := range clients {
+		client.kicked.Store(true)
+		client.requestClose(CloseKicked, ErrCodeKicked, reason)
+	}
+	return clients
+}
+
+// awaitDisconnected waits until the handlers of clients have finished with
+// them: they are unregistered, their last seen time is saved and their
+// queued frames have gone to the offline queue.
+func awaitDisconnected(ctx context.Context, clients []*Client) error {
+	for _, client := range clients {
+		if client.finished == nil {
+			continue
+		}
+		select {
+		case <-client.finished:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestKickClosesEveryConnection(t *testing.T) {
+	withAdminToken(t, "admin-secret")
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	var conns []*websocket.Conn
+	for i := 0; i < 3; i++ {
+		conn, _ := ts.dial(t, alice)
+		conns = append(conns, conn)
+	}
+	bobConn, _ := ts.dial(t, bob)
+
+	var answer struct {
+		User   string `json:"user"`
+		Closed int    `json:"closed"`
+	}
+	body := map[string]any{"user": alice, "reason": "spam"}
+	if status := ts.doWith(t, http.MethodPost, "/admin/kick", http.Header{"X-Admin-Token": {"admin-secret"}}, body, &answer); status != http.StatusOK {
+		t.Fatalf("kick: status %d", status)
+	}
+	if answer.User != alice || answer.Closed != len(conns) {
+		t.Fatalf("kick = %+v, want %s with %d connections closed", answer, alice, len(conns))
+	}
+	for i, conn := range conns {
+		if frame := readUntil(t, conn, EventError); frame["code"] != ErrCodeKicked || frame["message"] != "spam" {
+			t.Fatalf("connection %d: error = %v, want %s with the reason", i, frame, ErrCodeKicked)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := conn.ReadMessage()
+		if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != CloseKicked || closeErr.Text != "spam" {
+			t.Fatalf("connection %d: read after the error = %v, want close %d with the reason", i, err, CloseKicked)
+		}
+	}
+	waitFor(t, "alice's connections to be cleaned up", func() bool { return len(connectionsFor(alice)) == 0 })
+	if online, err := ts.db.IsUserOnline(context.Background(), alice); err != nil || online {
+		t.Fatalf("alice online = %v, %v after the kick", online, err)
+	}
+	// Other users are not affected.
+	sent := ts.send(t, alice, bob, "still connected")
+	if frame := readUntil(t, bobConn, EventMessage); frame["id"] != sent.ID {
+		t.Fatalf("bob got %v, want %s", frame["id"], sent.ID)
+	}
+}
+
+func TestKickDoesNotWaitForTheWriter(t *testing.T) {
+	user := newTestUser("stalled")
+	client, conn := newPairedClient(t, user)
+	// A write in progress holds writeMu until it finishes or times out.
+	client.writeMu.Lock()
+	kicked := make(chan []*Client)
+	go func() { kicked <- disconnectUser(user, "spam") }()
+	select {
+	case clients := <-kicked:
+		if len(clients) != 1 || clients[0] != client {
+			t.Fatalf("disconnectUser = %v, want the paired client", clients)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("disconnectUser blocked on a connection that is writing")
+	}
+	client.writeMu.Unlock()
+
+	// The writer closes the connection once it gets to it.
+	go client.writeQueued(make(chan struct{}))
+	if frame := readUntil(t, conn, EventError); frame["code"] != ErrCodeKicked {
+		t.Fatalf("error = %v, want %s", frame, ErrCodeKicked)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, CloseKicked) {
+		t.Fatalf("read after the error = %v, want close %d", err, CloseKicked)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Attachment references media stored elsewhere. The server only keeps the
+// reference; clients upload and fetch the file themselves.
+type Attachment struct {
+	URL      string `json:"url"`
+	MimeType string `json:"mimeType"`
+	Size     int64  `json:"size"`
+	Name     string `json:"name,omitempty"`
+}
+
+var (
+	maxAttachments         = envInt("MAX_ATTACHMENTS", 10)
+	maxAttachmentSize      = int64(envInt("MAX_ATTACHMENT_SIZE", 25<<20))
+	allowedAttachmentTypes = parseMimeTypes(os.Getenv("ALLOWED_ATTACHMENT_TYPES"))
+)
+
+var defaultAttachmentTypes = []string{
+	"image/png", "image/jpeg", "image/gif", "image/webp",
+	"video/mp4", "audio/mpeg", "application/pdf",
+}
+
+var (
+	errTooManyAttachments = fmt.Errorf("at most %d attachments are allowed", maxAttachments)
+	errAttachmentURL      = errors.New("attachment url must be an absolute http or https URL")
+	errAttachmentSize     = fmt.Errorf("attachment size must be between 1 and %d bytes", maxAttachmentSize)
+)
+
+// parseMimeTypes splits a comma-separated ALLOWED_ATTACHMENT_TYPES value,
+// falling back to defaultAttachmentTypes when it is empty.
+func parseMimeTypes(v string) map[string]bool {
+	types := defaultAttachmentTypes
+	if strings.TrimSpace(v) != "" {
+		types = strings.Split(v, ",")
+	}
+	allowed := make(map[string]bool, len(types))
+	for _, t := range types {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			allowed[t] = true
+		}
+	}
+	return allowed
+}
+
+func validateAttachments(attachments []Attachment) error {
+	if len(attachments) > maxAttachments {
+		return errTooManyAttachments
+	}
+	for _, a := range attachments {
+		u, err := url.Parse(a.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errAttachmentURL
+		}
+		if !allowedAttachmentTypes[strings.ToLower(a.MimeType)] {
+			return fmt.Errorf("attachment type %q is not allowed", a.MimeType)
+		}
+		if a.Size <= 0 || a.Size > maxAttachmentSize {
+			return errAttachmentSize
+		}
+	}
+	return nil
+}
+
+// validateBody checks a message's content and attachments. Content may be
+// empty when the message carries at least one attachment.
+func validateBody(content string, attachments []Attachment) error {
+	if err := validateAttachments(attachments); err != nil {
+		return err
+	}
+	if content == "" && len(attachments) > 0 {
+		return nil
+	}
+	return validateContent(content)
+}
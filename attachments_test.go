@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestSendWithAttachments(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	bobConn, _ := ts.dial(t, bob)
+	photo := Attachment{URL: "https://cdn.example.com/p.png", MimeType: "image/png", Size: 2048, Name: "p.png"}
+	many := make([]Attachment, maxAttachments+1)
+	for i := range many {
+		many[i] = photo
+	}
+
+	tests := []struct {
+		name        string
+		content     string
+		attachments []Attachment
+		status      int
+	}{
+		{"valid with content", "look", []Attachment{photo}, http.StatusOK},
+		{"valid without content", "", []Attachment{photo, {URL: "http://cdn.example.com/a.pdf", MimeType: "Application/PDF", Size: 1}}, http.StatusOK},
+		{"too many", "look", many, http.StatusBadRequest},
+		{"disallowed type", "look", []Attachment{{URL: photo.URL, MimeType: "application/x-msdownload", Size: 10}}, http.StatusBadRequest},
+		{"too large", "look", []Attachment{{URL: photo.URL, MimeType: "image/png", Size: maxAttachmentSize + 1}}, http.StatusBadRequest},
+		{"relative URL", "look", []Attachment{{URL: "/p.png", MimeType: "image/png", Size: 10}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent struct {
+				Message
+				Code string
+			}
+			status := ts.do(t, http.MethodPost, "/send", map[string]any{"sender": alice, "recipient": bob, "content": tt.content, "attachments": tt.attachments}, &sent)
+			if status != tt.status {
+				t.Fatalf("status = %d %+v, want %d", status, sent, tt.status)
+			}
+			if status != http.StatusOK {
+				if sent.Code != ErrCodeInvalidRequest {
+					t.Fatalf("code = %q, want %q", sent.Code, ErrCodeInvalidRequest)
+				}
+				return
+			}
+			history, err := ts.db.RetrieveStoredMessages(context.Background(), Message{Sender: alice, Recipient: bob})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored := history[len(history)-1]; stored.ID != sent.ID || !reflect.DeepEqual(stored.Attachments, tt.attachments) {
+				t.Fatalf("stored %+v, want the attachments", stored)
+			}
+			frame := readUntil(t, bobConn, EventMessage)
+			if got, ok := frame["attachments"].([]any); !ok || len(got) != len(tt.attachments) {
+				t.Fatalf("bob got %v, want %d attachments", frame, len(tt.attachments))
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// authUserKey is the gin context key holding the authenticated user ID.
+// authExpiresKey holds the token expiry, if it has one, which also ends
+// WebSocket connections opened with the token.
+const (
+	authUserKey    = "user"
+	authExpiresKey = "auth_expires"
+)
+
+var errMissingToken = errors.New("missing bearer token")
+
+// Authentication modes selected by AUTH_MODE.
+const (
+	AuthModeNone = "none"
+	AuthModeHMAC = "hmac"
+	AuthModeJWT  = "jwt"
+)
+
+// authMiddleware returns the middleware for AUTH_MODE, or nil in mode none.
+// When AUTH_MODE is unset the mode is jwt if JWT_SECRET is set and none
+// otherwise. A mode without its secret is an error.
+func authMiddleware(getenv func(string) string) (gin.HandlerFunc, error) {
+	mode := getenv("AUTH_MODE")
+	if mode == "" {
+		mode = AuthModeNone
+		if getenv("JWT_SECRET") != "" {
+			mode = AuthModeJWT
+		}
+	}
+	switch mode {
+	case AuthModeNone:
+		return nil, nil
+	case AuthModeJWT:
+		secret := getenv("JWT_SECRET")
+		if secret == "" {
+			return nil, errors.New("AUTH_MODE=jwt requires JWT_SECRET")
+		}
+		return NewAuthMiddleware(secret), nil
+	case AuthModeHMAC:
+		secret := getenv("HMAC_SECRET")
+		if secret == "" {
+			return nil, errors.New("AUTH_MODE=hmac requires HMAC_SECRET")
+		}
+		return NewHMACAuthMiddleware(secret), nil
+	}
+	return nil, fmt.Errorf("unknown AUTH_MODE %q, want none, hmac or jwt", mode)
+}
+
+// NewAuthMiddleware validates an HS256 JWT taken from the Authorization
+// header, or from the token query param for browser WebSocket handshakes
+// which cannot set headers. The token subject becomes the authenticated user.
+func NewAuthMiddleware(secret string) gin.HandlerFunc {
+	key := []byte(secret)
+	return func(c *gin.Context) {
+		raw := bearerToken(c)
+		if raw == "" {
+			respondError(c, http.StatusUnauthorized, ErrCodeUnauthorized, errMissingToken.Error())
+			return
+		}
+		token, err := jwt.Parse(raw, func(t *jwt.Token) (interface{}, error) {
+			return key, nil
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, ErrCodeUnauthorized, err.Error())
+			return
+		}
+		sub, err := token.Claims.GetSubject()
+		if err != nil || sub == "" {
+			respondError(c, http.StatusUnauthorized, ErrCodeUnauthorized, "token has no subject")
+			return
+		}
+		c.Set(authUserKey, sub)
+		if exp, err := token.Claims.GetExpirationTime(); err == nil && exp != nil {
+			c.Set(authExpiresKey, exp.Time)
+		}
+		c.Next()
+	}
+}
+
+// userCookie carries "<user ID>.<signature>" for hmac mode, so that browser
+// WebSocket handshakes, which cannot set headers, can authenticate too.
+const userCookie = "chat_user"
+
+var errBadSignature = errors.New("invalid user signature")
+
+// SignUserID returns the hex HMAC-SHA256 of user under secret, the value
+// hmac mode expects in X-User-Signature.
+func SignUserID(secret, user string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(user))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewHMACAuthMiddleware is a lighter alternative to JWT for deployments
+// whose gateway already knows the user: it accepts the X-User-ID header
+// signed in X-User-Signature, or the same pair in the chat_user cookie.
+// There is no expiry, so a leaked signature is valid until the secret is
+// rotated.
+func NewHMACAuthMiddleware(secret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, sig := c.GetHeader("X-User-ID"), c.GetHeader("X-User-Signature")
+		if user == "" {
+			if cookie, err := c.Cookie(userCookie); err == nil {
+				if i := strings.LastIndexByte(cookie, '.'); i > 0 {
+					user, sig = cookie[:i], cookie[i+1:]
+				}
+			}
+		}
+		if user == "" {
+			respondError(c, http.StatusUnauthorized, ErrCodeUnauthorized, "missing user signature")
+			return
+		}
+		if !hmac.Equal([]byte(sig), []byte(SignUserID(secret, user))) {
+			respondError(c, http.StatusUnauthorized, ErrCodeUnauthorized, errBadSignature.Error())
+			return
+		}
+		c.Set(authUserKey, user)
+		c.Next()
+	}
+}
+
+func bearerToken(c *gin.Context) string {
+	if h := c.GetHeader("Authorization"); h != "" {
+		if token, ok := strings.CutPrefix(h, "Bearer "); ok {
+			return token
+		}
+		return ""
+	}
+	return c.Query("token")
+}
+
+// authenticatedUser returns the user set by the auth middleware, falling back
+// to the client-supplied ID when authentication is disabled.
+func authenticatedUser(c *gin.Context, fallback string) string {
+	if user := c.GetString(authUserKey); user != "" {
+		return user
+	}
+	return fallback
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// signToken returns an HS256 token for subject under secret, expiring at
+// expires unless it is zero.
+func signToken(t *testing.T, secret, subject string, expires time.Time) string {
+	t.Helper()
+	claims := jwt.MapClaims{"sub": subject}
+	if !expires.IsZero() {
+		claims["exp"] = expires.Unix()
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJWTAuth(t *testing.T) {
+	const secret = "jwt-secret"
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	valid := signToken(t, secret, alice, time.Now().Add(time.Hour))
+	tampered := []byte(valid)
+	tampered[len(tampered)-2] ^= 1
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"sub": alice}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"valid", valid, http.StatusOK},
+		{"no expiry", signToken(t, secret, alice, time.Time{}), http.StatusOK},
+		{"expired", signToken(t, secret, alice, time.Now().Add(-time.Minute)), http.StatusUnauthorized},
+		{"tampered", string(tampered), http.StatusUnauthorized},
+		{"other secret", signToken(t, "other-secret", alice, time.Now().Add(time.Hour)), http.StatusUnauthorized},
+		{"alg none", none, http.StatusUnauthorized},
+		{"no subject", signToken(t, secret, "", time.Now().Add(time.Hour)), http.StatusUnauthorized},
+		{"missing", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServerWith(t, NewAuthMiddleware(secret))
+			header := http.Header{}
+			if tt.token != "" {
+				header.Set("Authorization", "Bearer "+tt.token)
+			}
+			var sent Message
+			// The sender comes from the token, not the body.
+			status := ts.doWith(t, http.MethodPost, "/send", header, map[string]any{"sender": "mallory", "recipient": bob, "content": "hi"}, &sent)
+			if status != tt.status {
+				t.Fatalf("/send status = %d, want %d", status, tt.status)
+			}
+			if status == http.StatusOK && sent.Sender != alice {
+				t.Fatalf("sender = %q, want %q", sent.Sender, alice)
+			}
+
+			// Browsers pass the token as a query parameter to /ws.
+			query := url.Values{"recipient": {"mallory"}}
+			if tt.token != "" {
+				query.Set("token", tt.token)
+			}
+			conn, resp, err := ts.dialQuery(t, query, subprotocolChatV1)
+			if tt.status != http.StatusOK {
+				if err == nil || resp == nil || resp.StatusCode != tt.status {
+					t.Fatalf("/ws handshake: %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("/ws handshake: %v", err)
+			}
+			defer conn.Close()
+			waitFor(t, "connection as the token subject", func() bool { return len(connectionsFor(alice)) == 1 })
+			if n := len(connectionsFor("mallory")); n != 0 {
+				t.Fatalf("%d connections as the query recipient", n)
+			}
+		})
+	}
+}
+
+func TestHMACAuth(t *testing.T) {
+	const secret = "hmac-secret"
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	valid := SignUserID(secret, alice)
+	forged := []byte(valid)
+	forged[0] ^= 1
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"valid header", http.Header{"X-User-Id": {alice}, "X-User-Signature": {valid}}, http.StatusOK},
+		{"valid cookie", http.Header{"Cookie": {userCookie + "=" + alice + "." + valid}}, http.StatusOK},
+		{"forged signature", http.Header{"X-User-Id": {alice}, "X-User-Signature": {string(forged)}}, http.StatusUnauthorized},
+		{"signature of another user", http.Header{"X-User-Id": {alice}, "X-User-Signature": {SignUserID(secret, bob)}}, http.StatusUnauthorized},
+		{"other secret", http.Header{"X-User-Id": {alice}, "X-User-Signature": {SignUserID("other-secret", alice)}}, http.StatusUnauthorized},
+		{"no signature", http.Header{"X-User-Id": {alice}}, http.StatusUnauthorized},
+		{"cookie without signature", http.Header{"Cookie": {userCookie + "=" + alice}}, http.StatusUnauthorized},
+		{"missing", http.Header{}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServerWith(t, NewHMACAuthMiddleware(secret))
+			var sent Message
+			status := ts.doWith(t, http.MethodPost, "/send", tt.header, map[string]any{"sender": "mallory", "recipient": bob, "content": "hi"}, &sent)
+			if status != tt.status {
+				t.Fatalf("/send status = %d, want %d", status, tt.status)
+			}
+			if status == http.StatusOK && sent.Sender != alice {
+				t.Fatalf("sender = %q, want %q", sent.Sender, alice)
+			}
+
+			dialer := websocket.Dialer{Subprotocols: []string{subprotocolChatV1}, HandshakeTimeout: 5 * time.Second}
+			conn, resp, err := dialer.Dial(ts.wsURL("/ws", url.Values{"recipient": {"mallory"}}), tt.header)
+			if tt.status != http.StatusOK {
+				if err == nil || resp == nil || resp.StatusCode != tt.status {
+					t.Fatalf("/ws handshake: %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("/ws handshake: %v", err)
+			}
+			defer conn.Close()
+			waitFor(t, "connection as the signed user", func() bool { return len(connectionsFor(alice)) == 1 })
+			if n := len(connectionsFor("mallory")); n != 0 {
+				t.Fatalf("%d connections as the query recipient", n)
+			}
+		})
+	}
+}
+
+func TestNoAuthTrustsTheClient(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	conn, _ := ts.dial(t, bob)
+	// Without authentication a token is not even looked at.
+	header := http.Header{"Authorization": {"Bearer garbage"}}
+	var sent Message
+	if status := ts.doWith(t, http.MethodPost, "/send", header, map[string]any{"sender": alice, "recipient": bob, "content": "hi"}, &sent); status != http.StatusOK {
+		t.Fatalf("/send status = %d", status)
+	}
+	if sent.Sender != alice {
+		t.Fatalf("sender = %q, want the one in the body, %q", sent.Sender, alice)
+	}
+	if got := readUntil(t, conn, EventMessage); got["id"] != sent.ID {
+		t.Fatalf("bob got %v, want %s", got, sent.ID)
+	}
+	if n := len(connectionsFor(bob)); n != 1 {
+		t.Fatalf("%d connections as the query recipient, want 1", n)
+	}
+}
+
+func TestAuthMiddlewareMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		enabled bool
+		wantErr bool
+	}{
+		{"unset", nil, false, false},
+		{"unset with a JWT secret", map[string]string{"JWT_SECRET": "s"}, true, false},
+		{"none", map[string]string{"AUTH_MODE": "none", "JWT_SECRET": "s"}, false, false},
+		{"jwt", map[string]string{"AUTH_MODE": "jwt", "JWT_SECRET": "s"}, true, false},
+		{"jwt without secret", map[string]string{"AUTH_MODE": "jwt"}, false, true},
+		{"hmac", map[string]string{"AUTH_MODE": "hmac", "HMAC_SECRET": "s"}, true, false},
+		{"hmac with only a JWT secret", map[string]string{"AUTH_MODE": "hmac", "JWT_SECRET": "s"}, false, true},
+		{"unknown", map[string]string{"AUTH_MODE": "basic"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := authMiddleware(func(key string) string { return tt.env[key] })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if (auth != nil) != tt.enabled {
+				t.Fatalf("enabled = %v, want %v", auth != nil, tt.enabled)
+			}
+		})
+	}
+}
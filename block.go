@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/creditdb/go-creditdb"
+	"github.com/gin-gonic/gin"
+)
+
+var errBlocked = errors.New("recipient has blocked the sender")
+
+func blocklistKey(user string) string {
+	return "blocked:" + keyPart(user)
+}
+
+// blockUser adds {"blocked"} to the blocklist of {"user"}, the caller.
+func (r *Router) blockUser(c *gin.Context) {
+	var req struct {
+		User    string `json:"user"`
+		Blocked string `json:"blocked" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	r.updateBlocklist(c, authenticatedUser(c, req.User), req.Blocked, true)
+}
+
+// unblockUser removes ?blocked= from the blocklist of ?user=, the caller.
+func (r *Router) unblockUser(c *gin.Context) {
+	r.updateBlocklist(c, authenticatedUser(c, c.Query("user")), c.Query("blocked"), false)
+}
+
+func (r *Router) updateBlocklist(c *gin.Context, user, other string, block bool) {
+	user, err := normalizeUserID(user)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "user: "+err.Error())
+		return
+	}
+	if other, err = normalizeUserID(other); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "blocked: "+err.Error())
+		return
+	}
+	if other == user {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "users cannot block themselves")
+		return
+	}
+	if block {
+		err = r.dbclient.Block(c, user, other)
+	} else {
+		err = r.dbclient.Unblock(c, user, other)
+	}
+	if err != nil {
+		logger.Error("update blocklist failed", "event", "block", "user", user, "blocked", other, "block", block, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to update blocklist")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Blocklist returns the users user has blocked.
+func (db *DBClient) Blocklist(ctx context.Context, user string) ([]string, error) {
+	line, err := db.getLine(ctx, blocklistKey(user))
+	if err == creditdb.ErrNotFound {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	blocked := []string{}
+	if err := json.Unmarshal([]byte(line.Value), &blocked); err != nil {
+		return nil, err
+	}
+	return blocked, nil
+}
+
+// Block adds other to user's blocklist. Blocking twice is a no-op.
+func (db *DBClient) Block(ctx context.Context, user, other string) error {
+	key := blocklistKey(user)
+	defer keyLocks.lock(key)()
+	blocked, err := db.Blocklist(ctx, user)
+	if err != nil || contains(blocked, other) {
+		return err
+	}
+	return db.saveIDList(ctx, key, append(blocked, other))
+}
+
+// Unblock removes other from user's blocklist.
+func (db *DBClient) Unblock(ctx context.Context, user, other string) error {
+	key := blocklistKey(user)
+	defer keyLocks.lock(key)()
+	blocked, err := db.Blocklist(ctx, user)
+	if err != nil {
+		return err
+	}
+	kept := []string{}
+	for _, b := range blocked {
+		if b != other {
+			kept = append(kept, b)
+		}
+	}
+	if len(kept) == len(blocked) {
+		return nil
+	}
+	if len(kept) == 0 {
+		if err := db.deleteLine(ctx, key); err != nil && err != creditdb.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	return db.saveIDList(ctx, key, kept)
+}
+
+// saveIDList stores a JSON list of IDs, as used by blocklists and mutes.
+func (db *DBClient) saveIDList(ctx context.Context, key string, ids []string) error {
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	return db.setLine(ctx, key, string(data))
+}
+
+// IsBlocked reports whether recipient has blocked sender.
+func (db *DBClient) IsBlocked(ctx context.Context, recipient, sender string) (bool, error) {
+	blocked, err := db.Blocklist(ctx, recipient)
+	if err != nil {
+		return false, err
+	}
+	return contains(blocked, sender), nil
+}
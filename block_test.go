@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBlockedSenderIsNotStoredOrDelivered(t *testing.T) {
+	ts := newTestServer(t)
+	bob, mallory := newTestUser("bob"), newTestUser("mallory")
+	bobConn, _ := ts.dial(t, bob)
+	if status := ts.do(t, http.MethodPost, "/block", map[string]any{"user": bob, "blocked": mallory}, nil); status != http.StatusNoContent && status != http.StatusOK {
+		t.Fatalf("block: %d", status)
+	}
+
+	var refused struct {
+		Code string `json:"code"`
+	}
+	if status := ts.do(t, http.MethodPost, "/send", map[string]any{"sender": mallory, "recipient": bob, "content": "blocked"}, &refused); status != http.StatusForbidden || refused.Code != ErrCodeBlocked {
+		t.Fatalf("send while blocked: %d %q, want 403 %q", status, refused.Code, ErrCodeBlocked)
+	}
+	if stored := storedIDs(t, ts.db, conversationKey(bob, mallory)); len(stored) != 0 {
+		t.Fatalf("blocked message was stored: %v", stored)
+	}
+
+	path := "/block?" + url.Values{"user": {bob}, "blocked": {mallory}}.Encode()
+	if status := ts.do(t, http.MethodDelete, path, nil, nil); status != http.StatusNoContent && status != http.StatusOK {
+		t.Fatalf("unblock: %d", status)
+	}
+	sent := ts.send(t, mallory, bob, "after unblock")
+	// The first message bob receives is the one sent after the unblock.
+	if frame := readUntil(t, bobConn, EventMessage); frame["id"] != sent.ID {
+		t.Fatalf("bob received %v, want %s", frame, sent.ID)
+	}
+}
+
+func TestTypingFramesAreChecked(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob, mallory := newTestUser("alice"), newTestUser("bob"), newTestUser("mallory")
+	var room roomResponse
+	ts.do(t, http.MethodPost, "/rooms", map[string]any{"creator": alice, "members": []string{bob}}, &room)
+	ts.do(t, http.MethodPost, "/block", map[string]any{"user": bob, "blocked": mallory}, nil)
+	aliceConn, _ := ts.dial(t, alice)
+	bobConn, _ := ts.dial(t, bob)
+	malloryConn, _ := ts.dial(t, mallory)
+
+	tests := []struct {
+		name  string
+		frame map[string]any
+		code  string
+	}{
+		{"blocked sender", map[string]any{"type": EventTyping, "recipient": bob}, ErrCodeBlocked},
+		{"non-member", map[string]any{"type": EventTyping, "roomId": room.ID}, ErrCodeNotRoomMember},
+		{"unknown room", map[string]any{"type": EventTyping, "roomId": "no-such-room"}, ErrCodeRoomNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := malloryConn.WriteJSON(tt.frame); err != nil {
+				t.Fatal(err)
+			}
+			if frame := readUntil(t, malloryConn, EventError); frame["code"] != tt.code {
+				t.Fatalf("error = %v, want code %q", frame, tt.code)
+			}
+			// A permitted typing frame sent afterwards is the first
+			// one bob sees, so the refused one was not delivered.
+			expectTypingFrom(t, aliceConn, bobConn, map[string]any{"type": EventTyping, "recipient": bob}, alice)
+			expectTypingFrom(t, aliceConn, bobConn, map[string]any{"type": EventTyping, "roomId": room.ID}, alice)
+		})
+	}
+}
+
+// expectTypingFrom writes frame on from and checks that the next typing
+// frame to arrives from sender.
+func expectTypingFrom(t *testing.T, from, to *websocket.Conn, frame map[string]any, sender string) {
+	t.Helper()
+	if err := from.WriteJSON(frame); err != nil {
+		t.Fatal(err)
+	}
+	if got := readUntil(t, to, EventTyping); got["sender"] != sender {
+		t.Fatalf("typing frame from %v, want %s", got["sender"], sender)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ayo-ajayi/realtime-chat-creditdb-websocket/storetest"
+	"github.com/creditdb/go-creditdb"
+)
+
+// fillBroadcast fills the broadcast buffer and empties it when the test
+// ends.
+func fillBroadcast(t *testing.T) {
+	t.Helper()
+	for !broadcastIsFull() {
+		broadcast <- Message{ID: newTestUser("filler"), Recipient: newTestUser("nobody"), Ephemeral: true}
+	}
+	t.Cleanup(func() {
+		for len(broadcast) > 0 {
+			<-broadcast
+		}
+	})
+}
+
+func TestFullBroadcastBufferRefusesMessages(t *testing.T) {
+	ts := newIdleTestServer(t, nil)
+	ts.closeOnCleanup(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	aliceConn, _ := ts.dial(t, alice)
+	fillBroadcast(t)
+
+	body := `{"sender":"` + alice + `","recipient":"` + bob + `","content":"hi"}`
+	resp, err := http.Post(ts.http.URL+"/send", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answer struct{ Code string }
+	json.NewDecoder(resp.Body).Decode(&answer)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || answer.Code != ErrCodeBusy || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("/send = %d %q, Retry-After %q, want 503 %s with Retry-After", resp.StatusCode, answer.Code, resp.Header.Get("Retry-After"), ErrCodeBusy)
+	}
+
+	if err := aliceConn.WriteJSON(map[string]any{"recipient": bob, "content": "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if frame := readUntil(t, aliceConn, EventError); frame["code"] != ErrCodeBusy {
+		t.Fatalf("error frame = %v, want code %s", frame, ErrCodeBusy)
+	}
+	if ids := storedIDs(t, ts.db, conversationKey(alice, bob)); len(ids) != 0 {
+		t.Fatalf("refused messages were stored: %v", ids)
+	}
+}
+
+// BenchmarkBroadcastBuffer pushes messages through the broadcast loop with
+// buffers of several sizes. A buffer of one stands in for the unbuffered
+// channel of old, which made every producer wait for the loop.
+func BenchmarkBroadcastBuffer(b *testing.B) {
+	db := NewDBClientFromStore(storetest.NewMemStore())
+	for _, size := range []int{1, 16, 256} {
+		b.Run("buffer="+strconv.Itoa(size), func(b *testing.B) {
+			old := broadcast
+			broadcast = make(chan Message, size)
+			defer func() { broadcast = old }()
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				broadcastMessages(ctx, db)
+			}()
+			// Ephemeral messages to offline users are dropped at once,
+			// so the loop itself is measured.
+			msg := Message{ID: "bench", Sender: "alice", Recipient: "nobody", Ephemeral: true}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				broadcast <- msg
+			}
+			cancel()
+			<-done
+		})
+	}
+}
+
+// slowStore is a MemStore whose reads and writes take delay, like a store
+// across the network.
+type slowStore struct {
+	*storetest.MemStore
+	delay time.Duration
+}
+
+func (s slowStore) GetLine(ctx context.Context, key string) (*creditdb.Line, error) {
+	time.Sleep(s.delay)
+	return s.MemStore.GetLine(ctx, key)
+}
+
+func (s slowStore) SetLine(ctx context.Context, key, value string) error {
+	time.Sleep(s.delay)
+	return s.MemStore.SetLine(ctx, key, value)
+}
+
+// BenchmarkDeliveryWorkers delivers messages to many offline recipients,
+// each of which costs store round trips for the mute check and the offline
+// queue, with one worker and with a pool.
+func BenchmarkDeliveryWorkers(b *testing.B) {
+	for _, workers := range []int{1, 8} {
+		b.Run("workers="+strconv.Itoa(workers), func(b *testing.B) {
+			old := broadcastWorkers
+			broadcastWorkers = workers
+			defer func() { broadcastWorkers = old }()
+			db := NewDBClientFromStore(slowStore{storetest.NewMemStore(), 50 * time.Microsecond})
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				broadcastMessages(ctx, db)
+			}()
+			recipients := make([]string, 64)
+			for i := range recipients {
+				recipients[i] = newTestUser("slow")
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				broadcast <- Message{ID: strconv.Itoa(i), Sender: "alice", Recipient: recipients[i%len(recipients)], Content: "hi"}
+			}
+			// The loop returns once the workers delivered everything.
+			cancel()
+			<-done
+		})
+	}
+}
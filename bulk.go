@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBulkRecipients caps the fan-out of a single /send-bulk request.
+var maxBulkRecipients = envInt("MAX_BULK_RECIPIENTS", 100)
+
+// BulkResult is the outcome of a /send-bulk message for one recipient.
+// Status is StatusSent once the message is stored and queued for delivery;
+// the sender then receives the usual acks. Error is set when Status is
+// "failed".
+type BulkResult struct {
+	Recipient string `json:"recipient"`
+	ID        string `json:"id,omitempty"`
+	Status    string `json:"status"`
+	Code      string `json:"code,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+const bulkStatusFailed = "failed"
+
+// sendBulk stores and broadcasts one message per recipient.
+func (r *Router) sendBulk(c *gin.Context) {
+	reqLog := requestLogger(c)
+	var req struct {
+		Sender     string   `json:"sender"`
+		Recipients []string `json:"recipients" binding:"required,min=1"`
+		Content    string   `json:"content" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if len(req.Recipients) > maxBulkRecipients {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "too many recipients")
+		return
+	}
+	sender, err := normalizeUserID(authenticatedUser(c, req.Sender))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "sender: "+err.Error())
+		return
+	}
+	if req.Content, err = normalizeContent(req.Content); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := validateContent(req.Content); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	// The whole request is admitted at once, like /send admits one
+	// message; each recipient then goes through the same path as /send.
+	if broadcastIsFull() || !admitMessages(len(req.Recipients)) {
+		broadcastFull(c)
+		return
+	}
+
+	results := make([]BulkResult, 0, len(req.Recipients))
+	seen := make(map[string]bool, len(req.Recipients))
+	for _, raw := range req.Recipients {
+		recipient, err := normalizeUserID(raw)
+		if err == nil && recipient == sender {
+			err = errSelfMessage
+		}
+		if err != nil {
+			results = append(results, BulkResult{Recipient: raw, Status: bulkStatusFailed, Code: ErrCodeInvalidRequest, Error: err.Error()})
+			continue
+		}
+		if seen[recipient] {
+			continue
+		}
+		seen[recipient] = true
+		message := newOutgoing(Message{Sender: sender, Recipient: recipient, Content: req.Content})
+		if err := r.sendAdmitted(c, reqLog, &message); err != nil {
+			_, code, reason := outgoingError(err)
+			results = append(results, BulkResult{Recipient: recipient, Status: bulkStatusFailed, Code: code, Error: reason})
+			continue
+		}
+		results = append(results, BulkResult{Recipient: recipient, ID: message.ID, Status: StatusSent})
+	}
+	c.JSON(http.StatusOK, results)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSendBulkPartialFailure(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob, carol, dave := newTestUser("alice"), newTestUser("bob"), newTestUser("carol"), newTestUser("dave")
+	ts.do(t, http.MethodPost, "/block", map[string]any{"user": carol, "blocked": alice}, nil)
+
+	var results []BulkResult
+	body := map[string]any{"sender": alice, "recipients": []string{bob, "not valid", alice, carol, " " + bob, dave}, "content": "hello all"}
+	if status := ts.do(t, http.MethodPost, "/send-bulk", body, &results); status != http.StatusOK {
+		t.Fatalf("status = %d", status)
+	}
+	want := []struct {
+		recipient string
+		status    string
+		code      string
+	}{
+		{bob, StatusSent, ""},
+		{"not valid", bulkStatusFailed, ErrCodeInvalidRequest},
+		{alice, bulkStatusFailed, ErrCodeInvalidRequest},
+		{carol, bulkStatusFailed, ErrCodeBlocked},
+		{dave, StatusSent, ""},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d: %+v", len(results), len(want), results)
+	}
+	for i, w := range want {
+		got := results[i]
+		if got.Recipient != w.recipient || got.Status != w.status || got.Code != w.code {
+			t.Errorf("result %d = %+v, want %s %s %q", i, got, w.recipient, w.status, w.code)
+		}
+		if w.status != StatusSent {
+			continue
+		}
+		stored := storedIDs(t, ts.db, conversationKey(alice, w.recipient))
+		if len(stored) != 1 || !stored[got.ID] {
+			t.Errorf("%s: stored %v, want only %s", w.recipient, stored, got.ID)
+		}
+	}
+	if stored := storedIDs(t, ts.db, conversationKey(alice, carol)); len(stored) != 0 {
+		t.Fatalf("message to a blocking recipient was stored: %v", stored)
+	}
+}
+
+func TestSendBulkOverLimit(t *testing.T) {
+	previous := maxBulkRecipients
+	maxBulkRecipients = 2
+	t.Cleanup(func() { maxBulkRecipients = previous })
+	ts := newTestServer(t)
+	alice := newTestUser("alice")
+
+	tests := []struct {
+		name       string
+		recipients []string
+		status     int
+	}{
+		{"at the limit", []string{newTestUser("bob"), newTestUser("carol")}, http.StatusOK},
+		{"over the limit", []string{newTestUser("bob"), newTestUser("carol"), newTestUser("dave")}, http.StatusBadRequest},
+		{"none", []string{}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := map[string]any{"sender": alice, "recipients": tt.recipients, "content": "hi"}
+			if status := ts.do(t, http.MethodPost, "/send-bulk", body, nil); status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			if tt.status == http.StatusOK {
+				return
+			}
+			for _, recipient := range tt.recipients {
+				if stored := storedIDs(t, ts.db, conversationKey(alice, recipient)); len(stored) != 0 {
+					t.Fatalf("refused request stored a message for %s", recipient)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+// Frames are JSON text by default. A client that connects with
+// ?format=msgpack gets MessagePack binary frames instead, which are smaller
+// and cheaper to parse. Each binary frame holds exactly one value, with the
+// same field names as the JSON encoding; WebSocket framing already carries
+// the length, so there is no extra prefix.
+//
+// ?format=compact, or the chat.v1.compact subprotocol, keeps JSON text but
+// gives chat messages the short field names of compactMessage, in both
+// directions. Other frames are unchanged.
+const (
+	formatJSON    = ""
+	formatMsgpack = "msgpack"
+	formatCompact = "compact"
+)
+
+// frameFormat picks the format of a connection from its ?format= and
+// negotiated subprotocol. Unknown formats fall back to JSON.
+func frameFormat(query, subprotocol string) string {
+	if subprotocol == subprotocolChatV1Compact {
+		return formatCompact
+	}
+	switch query {
+	case formatMsgpack, formatCompact:
+		return query
+	}
+	return formatJSON
+}
+
+var msgpackHandle = func() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{}
+	h.WriteExt = true // encode time.Time as the msgpack timestamp type
+	return h
+}()
+
+// compactMessage is Message on the wire in the compact format. type keeps
+// its name so that clients dispatch every frame the same way.
+type compactMessage struct {
+	Type        string       `json:"type,omitempty"`
+	ID          string       `json:"i,omitempty"`
+	Seq         int64        `json:"q,omitempty"`
+	Sender      string       `json:"s,omitempty"`
+	Recipient   string       `json:"r,omitempty"`
+	Content     string       `json:"c,omitempty"`
+	Timestamp   *time.Time   `json:"t,omitempty"`
+	Status      string       `json:"st,omitempty"`
+	ReadAt      *time.Time   `json:"ra,omitempty"`
+	EditedAt    *time.Time   `json:"ea,omitempty"`
+	RoomID      string       `json:"g,omitempty"`
+	Attachments []Attachment `json:"a,omitempty"`
+	Ephemeral   bool         `json:"e,omitempty"`
+	TTL         int64        `json:"l,omitempty"`
+	ExpiresAt   *time.Time   `json:"x,omitempty"`
+}
+
+func toCompact(m Message) compactMessage {
+	c := compactMessage{
+		Type:        m.Type,
+		ID:          m.ID,
+		Seq:         m.Seq,
+		Sender:      m.Sender,
+		Recipient:   m.Recipient,
+		Content:     m.Content,
+		Status:      m.Status,
+		ReadAt:      m.ReadAt,
+		EditedAt:    m.EditedAt,
+		RoomID:      m.RoomID,
+		Attachments: m.Attachments,
+		Ephemeral:   m.Ephemeral,
+		TTL:         m.TTL,
+		ExpiresAt:   m.ExpiresAt,
+	}
+	if !m.Timestamp.IsZero() {
+		c.Timestamp = &m.Timestamp
+	}
+	return c
+}
+
+func fromCompact(c compactMessage) Message {
+	m := Message{
+		Type:        c.Type,
+		ID:          c.ID,
+		Seq:         c.Seq,
+		Sender:      c.Sender,
+		Recipient:   c.Recipient,
+		Content:     c.Content,
+		Status:      c.Status,
+		ReadAt:      c.ReadAt,
+		EditedAt:    c.EditedAt,
+		RoomID:      c.RoomID,
+		Attachments: c.Attachments,
+		Ephemeral:   c.Ephemeral,
+		TTL:         c.TTL,
+		ExpiresAt:   c.ExpiresAt,
+	}
+	if c.Timestamp != nil {
+		m.Timestamp = *c.Timestamp
+	}
+	return m
+}
+
+// decodeFrame decodes a frame read from a WebSocket. Binary frames are
+// MessagePack whatever format the client asked for, so a client may send
+// either.
+func decodeFrame(format string, messageType int, data []byte, v interface{}) error {
+	if messageType == websocket.BinaryMessage {
+		return codec.NewDecoderBytes(data, msgpackHandle).Decode(v)
+	}
+	if m, ok := v.(*Message); ok && format == formatCompact {
+		var c compactMessage
+		if err := json.Unmarshal(data, &c); err != nil {
+			return err
+		}
+		*m = fromCompact(c)
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// encodeFrame encodes v in the given format as a binary MessagePack frame
+// or a JSON text frame.
+func encodeFrame(format string, v interface{}) (int, []byte, error) {
+	if format == formatMsgpack {
+		var data []byte
+		err := codec.NewEncoderBytes(&data, msgpackHandle).Encode(v)
+		return websocket.BinaryMessage, data, err
+	}
+	if m, ok := v.(Message); ok && format == formatCompact {
+		v = toCompact(m)
+	}
+	data, err := json.Marshal(v)
+	return websocket.TextMessage, data, err
+}
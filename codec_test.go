@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+// sampleFrames returns one of each frame type the server writes or reads,
+// with every field set.
+func sampleFrames() []interface{} {
+	at := time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.UTC)
+	readAt, editedAt, expiresAt, lastSeen := at.Add(time.Minute), at.Add(2*time.Minute), at.Add(time.Hour), at.Add(-time.Hour)
+	msg := Message{
+		Type:        EventMessage,
+		ID:          "m1",
+		Seq:         7,
+		Sender:      "alice",
+		Recipient:   "bob",
+		Content:     "héllo 👋",
+		Timestamp:   at,
+		Status:      StatusDelivered,
+		ReadAt:      &readAt,
+		EditedAt:    &editedAt,
+		RoomID:      "room",
+		Attachments: []Attachment{{URL: "https://example.com/a.png", MimeType: "image/png", Size: 1024, Name: "a.png"}},
+		Ephemeral:   true,
+		TTL:         3600,
+		ExpiresAt:   &expiresAt,
+	}
+	return []interface{}{
+		msg,
+		Ack{Type: EventAck, MessageID: "m1", Status: StatusStored},
+		ReadReceipt{Type: EventRead, Reader: "bob", MessageIDs: []string{"m1", "m2"}, ReadAt: readAt},
+		ErrorEvent{Type: EventError, Code: ErrCodeInvalidMessage, Message: "bad frame"},
+		HistoryEnd{Type: EventHistoryEnd, Count: 3, Omitted: 2},
+		PresenceEvent{Type: EventPresence, User: "bob", Status: "offline", LastSeen: &lastSeen},
+		PresenceSubscription{Type: EventSubscribe, Users: []string{"bob", "carol"}},
+		Session{Type: EventSession, ResumeToken: "token"},
+		Gap{Type: EventGap, Dropped: 5},
+		MessageChange{Type: EventEdited, MessageID: "m1", Message: &msg},
+		ConversationDeleted{Type: EventConversationDeleted, Participants: []string{"alice", "bob"}},
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	for _, frame := range sampleFrames() {
+		t.Run(reflect.TypeOf(frame).Name(), func(t *testing.T) {
+			messageType, data, err := encodeFrame(formatMsgpack, frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if messageType != websocket.BinaryMessage {
+				t.Fatalf("frame type = %d, want binary", messageType)
+			}
+			got := reflect.New(reflect.TypeOf(frame))
+			if err := decodeFrame(formatMsgpack, messageType, data, got.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Elem().Interface(), frame) {
+				t.Fatalf("round trip gave %+v, want %+v", got.Elem().Interface(), frame)
+			}
+		})
+	}
+}
+
+func TestMsgpackConnection(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	conn, _, err := ts.dialQuery(t, url.Values{"recipient": {alice}, "format": {formatMsgpack}}, subprotocolChatV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// readBinary decodes the next binary frame into a map.
+	readBinary := func() map[string]any {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != websocket.BinaryMessage {
+			t.Fatalf("frame type = %d, want binary: %s", messageType, data)
+		}
+		var frame map[string]any
+		if err := codec.NewDecoderBytes(data, msgpackHandle).Decode(&frame); err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	}
+	for readBinary()["type"] != EventHistoryEnd {
+	}
+	bobConn, _ := ts.dial(t, bob)
+
+	sent := ts.send(t, bob, alice, "binary")
+	var frame map[string]any
+	for frame = readBinary(); frame["type"] != EventMessage; frame = readBinary() {
+	}
+	if frame["id"] != sent.ID || frame["content"] != "binary" {
+		t.Fatalf("got %v, want %s", frame, sent.ID)
+	}
+	if at, ok := frame["timestamp"].(time.Time); !ok || !at.Equal(sent.Timestamp) {
+		t.Fatalf("timestamp = %#v, want %v as a msgpack timestamp", frame["timestamp"], sent.Timestamp)
+	}
+
+	// The server reads binary frames from the client too.
+	var data []byte
+	if err := codec.NewEncoderBytes(&data, msgpackHandle).Encode(Message{Type: EventMessage, Recipient: bob, Content: "from msgpack"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		t.Fatal(err)
+	}
+	// bob may first get the echo of his own message above.
+	got := readUntil(t, bobConn, EventMessage)
+	if got["id"] == sent.ID {
+		got = readUntil(t, bobConn, EventMessage)
+	}
+	if got["content"] != "from msgpack" || got["sender"] != alice {
+		t.Fatalf("bob got %v", got)
+	}
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	for _, frame := range sampleFrames() {
+		t.Run(reflect.TypeOf(frame).Name(), func(t *testing.T) {
+			messageType, data, err := encodeFrame(formatCompact, frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if messageType != websocket.TextMessage {
+				t.Fatalf("frame type = %d, want text", messageType)
+			}
+			if _, ok := frame.(Message); ok {
+				var fields map[string]any
+				if err := json.Unmarshal(data, &fields); err != nil {
+					t.Fatal(err)
+				}
+				for _, short := range []string{"type", "i", "s", "r", "c", "t"} {
+					if _, ok := fields[short]; !ok {
+						t.Fatalf("compact message %s has no %q", data, short)
+					}
+				}
+				if _, ok := fields["content"]; ok {
+					t.Fatalf("compact message %s has long field names", data)
+				}
+			}
+			got := reflect.New(reflect.TypeOf(frame))
+			if err := decodeFrame(formatCompact, messageType, data, got.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Elem().Interface(), frame) {
+				t.Fatalf("round trip gave %+v, want %+v", got.Elem().Interface(), frame)
+			}
+		})
+	}
+}
+
+func TestCompactConnection(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    url.Values
+		protocol string
+	}{
+		{"subprotocol", url.Values{}, subprotocolChatV1Compact},
+		{"query", url.Values{"format": {formatCompact}}, subprotocolChatV1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			alice, bob := newTestUser("alice"), newTestUser("bob")
+			tt.query.Set("recipient", alice)
+			conn, resp, err := ts.dialQuery(t, tt.query, tt.protocol)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != tt.protocol {
+				t.Fatalf("negotiated subprotocol %q, want %q", got, tt.protocol)
+			}
+			readUntil(t, conn, EventHistoryEnd)
+			bobConn, _ := ts.dial(t, bob)
+
+			sent := ts.send(t, bob, alice, "short names")
+			frame := readUntil(t, conn, EventMessage)
+			if frame["i"] != sent.ID || frame["s"] != bob || frame["r"] != alice || frame["c"] != "short names" || frame["t"] == nil {
+				t.Fatalf("alice got %v, want compact message %s", frame, sent.ID)
+			}
+			if _, ok := frame["id"]; ok {
+				t.Fatalf("alice got long field names: %v", frame)
+			}
+
+			// Frames from the client use the short names too.
+			if err := conn.WriteJSON(map[string]any{"type": EventMessage, "r": bob, "c": "from compact"}); err != nil {
+				t.Fatal(err)
+			}
+			// bob may first get the echo of his own message above.
+			got := readUntil(t, bobConn, EventMessage)
+			if got["id"] == sent.ID {
+				got = readUntil(t, bobConn, EventMessage)
+			}
+			if got["content"] != "from compact" || got["sender"] != alice {
+				t.Fatalf("bob got %v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withCompression sets WS_COMPRESSION for the test. The upgrader reads it
+// at startup, so it is updated too.
+func withCompression(t *testing.T, on bool) {
+	t.Helper()
+	old := wsCompression
+	wsCompression, upgrader.EnableCompression = on, on
+	t.Cleanup(func() { wsCompression, upgrader.EnableCompression = old, old })
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	tests := []struct {
+		name       string
+		enabled    bool
+		offered    bool
+		negotiated bool
+	}{
+		{"enabled and offered", true, true, true},
+		{"enabled, not offered", true, false, false},
+		{"disabled, offered", false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCompression(t, tt.enabled)
+			ts := newTestServer(t)
+			alice, bob := newTestUser("alice"), newTestUser("bob")
+			dialer := websocket.Dialer{Subprotocols: []string{subprotocolChatV1}, EnableCompression: tt.offered, HandshakeTimeout: 5 * time.Second}
+			conn, resp, err := dialer.Dial(ts.wsURL("/ws", url.Values{"recipient": {bob}}), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			extensions := resp.Header.Get("Sec-WebSocket-Extensions")
+			if got := strings.Contains(extensions, "permessage-deflate"); got != tt.negotiated {
+				t.Fatalf("Sec-WebSocket-Extensions = %q, want negotiated %v", extensions, tt.negotiated)
+			}
+			readUntil(t, conn, EventHistoryEnd)
+			content := strings.Repeat("compressible ", 100)
+			ts.send(t, alice, bob, content)
+			if frame := readUntil(t, conn, EventMessage); frame["content"] != content {
+				t.Fatalf("got %v", frame)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Heartbeat settings. PONG_WAIT must be longer than PING_INTERVAL so that a
+// healthy client always has an outstanding ping to answer; checkConfig
+// enforces it.
+var (
+	pingInterval = envDuration("PING_INTERVAL", 30*time.Second)
+	pongWait     = envDuration("PONG_WAIT", 60*time.Second)
+)
+
+// writeWait bounds every write to a WebSocket. A client that stops reading
+// fails its next write after this long and its connection is closed,
+// instead of blocking the delivery worker that writes to it.
+var writeWait = envDuration("WRITE_TIMEOUT", 10*time.Second)
+
+// configErrors collects the invalid values the env helpers below met while
+// the package was initialized. They return the default for such a value so
+// that initialization can go on; checkConfig then fails startup.
+var configErrors []error
+
+func invalidConfig(key, value, want string) {
+	configErrors = append(configErrors, fmt.Errorf("invalid %s %q: want %s", key, value, want))
+}
+
+// checkConfig reports every invalid setting, including heartbeat settings
+// that are valid on their own but not together.
+func checkConfig() error {
+	errs := append([]error(nil), configErrors...)
+	if pongWait <= pingInterval {
+		errs = append(errs, fmt.Errorf("PONG_WAIT (%s) must be longer than PING_INTERVAL (%s)", pongWait, pingInterval))
+	}
+	if presenceTTL <= pingInterval {
+		errs = append(errs, fmt.Errorf("PRESENCE_TTL (%s) must be longer than PING_INTERVAL (%s)", presenceTTL, pingInterval))
+	}
+	return errors.Join(errs...)
+}
+
+// envDuration parses key as a positive duration. Settings that are off by
+// default also accept 0, which keeps them off.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 || (d == 0 && def != 0) {
+		invalidConfig(key, v, "a positive duration")
+		return def
+	}
+	return d
+}
+
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		invalidConfig(key, v, "a positive integer")
+		return def
+	}
+	return n
+}
+
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f <= 0 {
+		invalidConfig(key, v, "a positive number")
+		return def
+	}
+	return f
+}
+
+// envChoice returns the value of key if it is one of allowed.
+func envChoice(key, def string, allowed ...string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	for _, a := range allowed {
+		if v == a {
+			return v
+		}
+	}
+	invalidConfig(key, v, "one of "+strings.Join(allowed, ", "))
+	return def
+}
+
+const defaultPort = "8000"
+
+// listenAddr builds the server address from ADDR, or from HOST and PORT
+// when ADDR is unset. The port must be a number between 1 and 65535.
+func listenAddr(getenv func(string) string) (string, error) {
+	addr := getenv("ADDR")
+	if addr == "" {
+		port := getenv("PORT")
+		if port == "" {
+			port = defaultPort
+		}
+		addr = net.JoinHostPort(getenv("HOST"), port)
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid port %q in listen address %q", port, addr)
+	}
+	return addr, nil
+}
+
+// tlsConfig loads the certificate named by TLS_CERT_FILE and TLS_KEY_FILE.
+// It returns nil when neither is set, and an error when only one is or the
+// pair does not load, so a broken setup fails at startup rather than on the
+// first handshake.
+func tlsConfig(getenv func(string) string) (*tls.Config, error) {
+	certFile, keyFile := getenv("TLS_CERT_FILE"), getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ayo-ajayi/realtime-chat-creditdb-websocket/storetest"
+	"github.com/gorilla/websocket"
+)
+
+// withoutConfigErrors runs the test with an empty configErrors.
+func withoutConfigErrors(t *testing.T) {
+	t.Helper()
+	previous := configErrors
+	configErrors = nil
+	t.Cleanup(func() { configErrors = previous })
+}
+
+func TestEnvHelpersRejectInvalidValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		parse   func() any
+		want    any
+		invalid bool
+	}{
+		{"int unset", "", func() any { return envInt("TEST_VALUE", 7) }, 7, false},
+		{"int set", "12", func() any { return envInt("TEST_VALUE", 7) }, 12, false},
+		{"int zero", "0", func() any { return envInt("TEST_VALUE", 7) }, 7, true},
+		{"int negative", "-1024", func() any { return envInt("TEST_VALUE", 7) }, 7, true},
+		{"int garbage", "big", func() any { return envInt("TEST_VALUE", 7) }, 7, true},
+		{"float set", "2.5", func() any { return envFloat("TEST_VALUE", 1) }, 2.5, false},
+		{"float negative", "-2", func() any { return envFloat("TEST_VALUE", 1) }, 1.0, true},
+		{"duration set", "5s", func() any { return envDuration("TEST_VALUE", time.Second) }, 5 * time.Second, false},
+		{"duration zero", "0s", func() any { return envDuration("TEST_VALUE", time.Second) }, time.Second, true},
+		{"duration zero when off by default", "0", func() any { return envDuration("TEST_VALUE", 0) }, time.Duration(0), false},
+		{"duration negative", "-5s", func() any { return envDuration("TEST_VALUE", time.Second) }, time.Second, true},
+		{"duration garbage", "soon", func() any { return envDuration("TEST_VALUE", time.Second) }, time.Second, true},
+		{"choice allowed", "b", func() any { return envChoice("TEST_VALUE", "a", "a", "b") }, "b", false},
+		{"choice misspelled", "B", func() any { return envChoice("TEST_VALUE", "a", "a", "b") }, "a", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withoutConfigErrors(t)
+			t.Setenv("TEST_VALUE", tt.value)
+			if got := tt.parse(); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			if got := len(configErrors) > 0; got != tt.invalid {
+				t.Fatalf("configErrors = %v, want invalid %v", configErrors, tt.invalid)
+			}
+			if tt.invalid && !strings.Contains(checkConfig().Error(), "TEST_VALUE") {
+				t.Fatalf("checkConfig does not name the variable: %v", checkConfig())
+			}
+		})
+	}
+}
+
+func TestCheckConfigHeartbeat(t *testing.T) {
+	tests := []struct {
+		name     string
+		ping     time.Duration
+		pong     time.Duration
+		presence time.Duration
+		wantErr  string
+	}{
+		{"defaults", 30 * time.Second, 60 * time.Second, 90 * time.Second, ""},
+		{"pong equals ping", 30 * time.Second, 30 * time.Second, 90 * time.Second, "PONG_WAIT"},
+		{"pong shorter", time.Minute, 30 * time.Second, 90 * time.Second, "PONG_WAIT"},
+		{"presence shorter", time.Minute, 2 * time.Minute, 30 * time.Second, "PRESENCE_TTL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withoutConfigErrors(t)
+			previousPing, previousPong, previousPresence := pingInterval, pongWait, presenceTTL
+			pingInterval, pongWait, presenceTTL = tt.ping, tt.pong, tt.presence
+			t.Cleanup(func() { pingInterval, pongWait, presenceTTL = previousPing, previousPong, previousPresence })
+			err := checkConfig()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkConfig() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkConfig() = %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    string
+		invalid bool
+	}{
+		{"default", nil, ":" + defaultPort, false},
+		{"port", map[string]string{"PORT": "9090"}, ":9090", false},
+		{"host and port", map[string]string{"HOST": "127.0.0.1", "PORT": "9090"}, "127.0.0.1:9090", false},
+		{"ipv6 host", map[string]string{"HOST": "::1"}, "[::1]:" + defaultPort, false},
+		{"addr wins", map[string]string{"ADDR": "0.0.0.0:7000", "PORT": "9090"}, "0.0.0.0:7000", false},
+		{"port not a number", map[string]string{"PORT": "http"}, "", true},
+		{"port zero", map[string]string{"PORT": "0"}, "", true},
+		{"port too large", map[string]string{"PORT": "65536"}, "", true},
+		{"addr without port", map[string]string{"ADDR": "localhost"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := listenAddr(func(key string) string { return tt.env[key] })
+			if (err != nil) != tt.invalid || addr != tt.want {
+				t.Fatalf("listenAddr = %q, %v, want %q, invalid %v", addr, err, tt.want, tt.invalid)
+			}
+		})
+	}
+}
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to
+// dir, and returns their paths with the certificate for clients to trust.
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "chat test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeSelfSignedCert(t, dir)
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		enabled bool
+		wantErr string
+	}{
+		{"unset", nil, false, ""},
+		{"both set", map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile}, true, ""},
+		{"cert only", map[string]string{"TLS_CERT_FILE": certFile}, false, "must be set together"},
+		{"key only", map[string]string{"TLS_KEY_FILE": keyFile}, false, "must be set together"},
+		{"missing file", map[string]string{"TLS_CERT_FILE": filepath.Join(dir, "missing.pem"), "TLS_KEY_FILE": keyFile}, false, "load TLS certificate"},
+		{"garbage key", map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": garbage}, false, "load TLS certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := tlsConfig(func(key string) string { return tt.env[key] })
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (conf != nil) != tt.enabled {
+				t.Fatalf("config = %v, want enabled %v", conf, tt.enabled)
+			}
+		})
+	}
+}
+
+func TestServeWSS(t *testing.T) {
+	certFile, keyFile, cert := writeSelfSignedCert(t, t.TempDir())
+	env := map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile}
+	conf, err := tlsConfig(func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewDBClientFromStore(storetest.NewMemStore())
+	server := newHTTPServer(ln.Addr().String(), newRouter(db, nil).engine, conf)
+	go server.ServeTLS(ln, "", "")
+	t.Cleanup(func() { server.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	dialer := websocket.Dialer{
+		Subprotocols:     []string{subprotocolChatV1},
+		HandshakeTimeout: 5 * time.Second,
+		TLSClientConfig:  &tls.Config{RootCAs: roots},
+	}
+	user := newTestUser("secure")
+	u := url.URL{Scheme: "wss", Host: ln.Addr().String(), Path: "/ws", RawQuery: url.Values{"recipient": {user}}.Encode()}
+	conn, _, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", u.String(), err)
+	}
+	defer func() {
+		conn.Close()
+		waitFor(t, "the connection to close", func() bool { return len(connectionsFor(user)) == 0 })
+	}()
+	if _, ok := conn.UnderlyingConn().(*tls.Conn); !ok {
+		t.Fatalf("connection is a %T, want a TLS connection", conn.UnderlyingConn())
+	}
+	if frame := readUntil(t, conn, EventHistoryEnd); frame["count"] != 0.0 {
+		t.Fatalf("history end = %v, want nothing replayed", frame)
+	}
+
+	// A plain ws:// handshake on the same port is refused.
+	plain := u
+	plain.Scheme = "ws"
+	if conn, _, err := (&websocket.Dialer{HandshakeTimeout: 5 * time.Second}).Dial(plain.String(), nil); err == nil {
+		conn.Close()
+		t.Fatal("plain ws:// handshake succeeded on the TLS port")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/creditdb/go-creditdb"
+	"github.com/gin-gonic/gin"
+)
+
+// ConversationSummary describes one direct conversation of a user.
+type ConversationSummary struct {
+	Peer        string    `json:"peer"`
+	LastMessage Message   `json:"lastMessage"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// listConversations returns the direct conversations of ?user=, most
+// recently active first.
+func (r *Router) listConversations(c *gin.Context) {
+	user, err := normalizeUserID(authenticatedUser(c, c.Query("user")))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "user: "+err.Error())
+		return
+	}
+	conversations, err := r.dbclient.ListConversations(c, user)
+	if err != nil {
+		logger.Error("list conversations failed", "event", "conversations", "user", user, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to list conversations")
+		return
+	}
+	c.JSON(http.StatusOK, conversations)
+}
+
+func conversationIndexKey(user string) string {
+	return "conversations:" + keyPart(user)
+}
+
+// ConversationPartners returns the users user has a direct conversation
+// with, in the order the conversations started.
+func (db *DBClient) ConversationPartners(ctx context.Context, user string) ([]string, error) {
+	line, err := db.getLine(ctx, conversationIndexKey(user))
+	if err == creditdb.ErrNotFound {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	partners := []string{}
+	if err := json.Unmarshal([]byte(line.Value), &partners); err != nil {
+		return nil, err
+	}
+	return partners, nil
+}
+
+// addConversationPartner adds peer to user's partner index. Like the
+// offline queue, the shared key is serialized with keyLocks so concurrent
+// first messages to the same user do not lose each other's update.
+func (db *DBClient) addConversationPartner(ctx context.Context, user, peer string) error {
+	key := conversationIndexKey(user)
+	defer keyLocks.lock(key)()
+	partners, err := db.ConversationPartners(ctx, user)
+	if err != nil || contains(partners, peer) {
+		return err
+	}
+	data, err := json.Marshal(append(partners, peer))
+	if err != nil {
+		return err
+	}
+	return db.setLine(ctx, key, string(data))
+}
+
+// removeConversationPartner drops peer from user's partner index.
+func (db *DBClient) removeConversationPartner(ctx context.Context, user, peer string) error {
+	key := conversationIndexKey(user)
+	defer keyLocks.lock(key)()
+	partners, err := db.ConversationPartners(ctx, user)
+	if err != nil || !contains(partners, peer) {
+		return err
+	}
+	kept := []string{}
+	for _, p := range partners {
+		if p != peer {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) == 0 {
+		return db.deleteQuietly(ctx, key)
+	}
+	return db.saveIDList(ctx, key, kept)
+}
+
+// ListConversations returns a summary of every non-empty direct
+// conversation in user's partner index, sorted by the time of its last
+// message, newest first.
+func (db *DBClient) ListConversations(ctx context.Context, user string) ([]ConversationSummary, error) {
+	partners, err := db.ConversationPartners(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	conversations := []ConversationSummary{}
+	for _, peer := range partners {
+		last, ok, err := db.lastMessage(ctx, conversationKey(user, peer))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		conversations = append(conversations, ConversationSummary{Peer: peer, LastMessage: last, UpdatedAt: last.Timestamp})
+	}
+	sort.Slice(conversations, func(i, j int) bool {
+		return conversations[i].UpdatedAt.After(conversations[j].UpdatedAt)
+	})
+	return conversations, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// conversations returns the peers and last message IDs of user's
+// /conversations, in order.
+func (ts *testServer) conversations(t *testing.T, user string) (peers, last []string) {
+	t.Helper()
+	var list []ConversationSummary
+	if status := ts.do(t, http.MethodGet, "/conversations?"+url.Values{"user": {user}}.Encode(), nil, &list); status != http.StatusOK {
+		t.Fatalf("/conversations for %s: status %d", user, status)
+	}
+	peers, last = []string{}, []string{}
+	for _, c := range list {
+		if !c.UpdatedAt.Equal(c.LastMessage.Timestamp) {
+			t.Fatalf("%s: updated at %v, want the last message time %v", c.Peer, c.UpdatedAt, c.LastMessage.Timestamp)
+		}
+		peers = append(peers, c.Peer)
+		last = append(last, c.LastMessage.ID)
+	}
+	return peers, last
+}
+
+func TestConversationsAreOrderedByLastMessage(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob, carol, dave := newTestUser("alice"), newTestUser("bob"), newTestUser("carol"), newTestUser("dave")
+	ts.send(t, alice, bob, "first")
+	toCarol := ts.send(t, alice, carol, "second")
+	fromDave := ts.send(t, dave, alice, "third")
+	// Replying moves the oldest conversation back to the top, whoever
+	// sends.
+	fromBob := ts.send(t, bob, alice, "fourth")
+
+	tests := []struct {
+		user  string
+		peers []string
+		last  []string
+	}{
+		{alice, []string{bob, dave, carol}, []string{fromBob.ID, fromDave.ID, toCarol.ID}},
+		{bob, []string{alice}, []string{fromBob.ID}},
+		{carol, []string{alice}, []string{toCarol.ID}},
+		{newTestUser("nobody"), []string{}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			peers, last := ts.conversations(t, tt.user)
+			if !reflect.DeepEqual(peers, tt.peers) || !reflect.DeepEqual(last, tt.last) {
+				t.Fatalf("conversations = %v with last %v, want %v with last %v", peers, last, tt.peers, tt.last)
+			}
+		})
+	}
+
+	for _, user := range []string{"", "a:b"} {
+		if status := ts.do(t, http.MethodGet, "/conversations?"+url.Values{"user": {user}}.Encode(), nil, nil); status != http.StatusBadRequest {
+			t.Fatalf("user %q: status %d, want %d", user, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestConversationPartnerIndex(t *testing.T) {
+	withAdminToken(t, "admin-secret")
+	ts := newTestServer(t)
+	ctx := context.Background()
+	alice, bob, carol := newTestUser("alice"), newTestUser("bob"), newTestUser("carol")
+	partners := func(user string) []string {
+		t.Helper()
+		got, err := ts.db.ConversationPartners(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	expect := func(step string, want map[string][]string) {
+		t.Helper()
+		for user, peers := range want {
+			if got := partners(user); !reflect.DeepEqual(got, peers) {
+				t.Fatalf("%s: partners of %s = %v, want %v", step, user, got, peers)
+			}
+		}
+	}
+
+	// Both sides are indexed on the first message, once.
+	ts.send(t, alice, bob, "one")
+	ts.send(t, alice, bob, "two")
+	ts.send(t, bob, alice, "three")
+	ts.send(t, carol, alice, "four")
+	expect("after sending", map[string][]string{alice: {bob, carol}, bob: {alice}, carol: {alice}})
+
+	// /conversations only looks at the index.
+	if err := ts.db.deleteQuietly(ctx, conversationIndexKey(bob)); err != nil {
+		t.Fatal(err)
+	}
+	if peers, _ := ts.conversations(t, bob); len(peers) != 0 {
+		t.Fatalf("bob's conversations without an index = %v", peers)
+	}
+	if peers, _ := ts.conversations(t, alice); !reflect.DeepEqual(peers, []string{carol, bob}) {
+		t.Fatalf("alice's conversations = %v", peers)
+	}
+	ts.send(t, bob, carol, "five")
+
+	// Deleting a conversation unindexes it for both, and the next
+	// message indexes it again.
+	path := "/conversations?" + url.Values{"sender": {alice}, "recipient": {bob}}.Encode()
+	if status := ts.do(t, http.MethodDelete, path, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("delete: status %d", status)
+	}
+	expect("after delete", map[string][]string{alice: {carol}, bob: {carol}})
+	ts.send(t, bob, alice, "six")
+	expect("after restarting", map[string][]string{alice: {carol, bob}, bob: {carol, alice}})
+
+	// Erasing a user unindexes them for every partner.
+	if status := ts.doWith(t, http.MethodDelete, "/admin/user/"+carol+"/data", http.Header{"X-Admin-Token": {"admin-secret"}}, nil, nil); status != http.StatusOK {
+		t.Fatalf("erase: status %d", status)
+	}
+	expect("after erasing carol", map[string][]string{alice: {bob}, bob: {alice}, carol: {}})
+}
+
+func TestConversationsFollowEditsAndDeletes(t *testing.T) {
+	// Two messages a page, so deleting the newest empties the last page.
+	withHistoryPageSize(t, 2)
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	first := ts.send(t, alice, bob, "first")
+	second := ts.send(t, alice, bob, "second")
+	third := ts.send(t, alice, bob, "third")
+
+	edit := func(id, content string) {
+		t.Helper()
+		body := map[string]any{"sender": alice, "recipient": bob, "content": content}
+		if status := ts.do(t, http.MethodPatch, "/messages/"+id, body, nil); status != http.StatusOK {
+			t.Fatalf("edit %s: status %d", id, status)
+		}
+	}
+	remove := func(id string) {
+		t.Helper()
+		path := "/messages/" + id + "?" + url.Values{"sender": {alice}, "recipient": {bob}}.Encode()
+		if status := ts.do(t, http.MethodDelete, path, nil, nil); status != http.StatusNoContent {
+			t.Fatalf("delete %s: status %d", id, status)
+		}
+	}
+	// expect checks the last message both participants see.
+	expect := func(step, id, content string) {
+		t.Helper()
+		for _, user := range []string{alice, bob} {
+			var list []ConversationSummary
+			if status := ts.do(t, http.MethodGet, "/conversations?"+url.Values{"user": {user}}.Encode(), nil, &list); status != http.StatusOK {
+				t.Fatalf("%s: /conversations for %s: status %d", step, user, status)
+			}
+			if id == "" {
+				if len(list) != 0 {
+					t.Fatalf("%s: %s has conversations %+v, want none", step, user, list)
+				}
+				continue
+			}
+			if len(list) != 1 || list[0].LastMessage.ID != id || list[0].LastMessage.Content != content {
+				t.Fatalf("%s: %s has conversations %+v, want last message %s %q", step, user, list, id, content)
+			}
+		}
+	}
+
+	edit(third.ID, "third, edited")
+	expect("after editing the last message", third.ID, "third, edited")
+	remove(third.ID)
+	expect("after deleting the last message", second.ID, "second")
+	edit(first.ID, "first, edited")
+	expect("after editing an older message", second.ID, "second")
+	remove(second.ID)
+	expect("after deleting the new last message", first.ID, "first, edited")
+	remove(first.ID)
+	expect("after deleting every message", "", "")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/creditdb/go-creditdb"
+)
+
+// DBConfig selects the creditdb server and page used for all keys.
+type DBConfig struct {
+	Addr string
+	Page uint
+}
+
+const (
+	defaultDBPage = 10
+	// defaultDBAddr is the creditdb client's default host.
+	defaultDBAddr = "http://localhost:5622"
+)
+
+// dbConfigFromEnv reads CREDITDB_ADDR and CREDITDB_PAGE. An empty Addr keeps
+// the client default.
+func dbConfigFromEnv(getenv func(string) string) (DBConfig, error) {
+	cfg := DBConfig{Addr: getenv("CREDITDB_ADDR"), Page: defaultDBPage}
+	if v := getenv("CREDITDB_PAGE"); v != "" {
+		page, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || page == 0 {
+			return DBConfig{}, fmt.Errorf("CREDITDB_PAGE must be a positive integer, got %q", v)
+		}
+		cfg.Page = uint(page)
+	}
+	return cfg, nil
+}
+
+// NewDBClientFromEnv connects to creditdb as configured by the environment.
+func NewDBClientFromEnv() (*DBClient, error) {
+	cfg, err := dbConfigFromEnv(os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	return NewDBClient(cfg)
+}
+
+// NewDBClient connects to creditdb at cfg.Addr and health-checks it.
+//
+// creditdb.NewClient cannot be pointed at a host before it first
+// health-checks its default one, http://localhost:5622, for up to five
+// seconds, and it returns nil when that check fails. A creditdb must
+// therefore answer on localhost:5622 at startup even when cfg.Addr names
+// another server; see the CREDITDB_ADDR row of the readme.
+func NewDBClient(cfg DBConfig) (*DBClient, error) {
+	client := creditdb.NewClient()
+	if client == nil {
+		return nil, fmt.Errorf("%w: the creditdb client health-checks %s before using CREDITDB_ADDR", errNoDB, defaultDBAddr)
+	}
+	client = client.WithHost(cfg.Addr).WithPage(cfg.Page)
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	if err := client.Health(ctx); err != nil {
+		return nil, fmt.Errorf("%w: health check of %s failed: %v", errNoDB, cfg.addr(), err)
+	}
+	return NewDBClientFromStore(client), nil
+}
+
+// addr returns the server cfg points at.
+func (cfg DBConfig) addr() string {
+	if cfg.Addr == "" {
+		return defaultDBAddr
+	}
+	return cfg.Addr
+}
+
+// Close releases the client's connections. It is a no-op when running
+// without a DB in degraded mode.
+func (db *DBClient) Close(ctx context.Context) error {
+	if db.Store == nil {
+		return nil
+	}
+	return db.Store.Close(ctx)
+}
+
+// dbTimeout bounds every creditdb call, retries included, so that a hung
+// DB cannot stall connects, sends or shutdown.
+var dbTimeout = envDuration("DB_TIMEOUT", 5*time.Second)
+
+// Transient creditdb failures are retried up to dbMaxRetries times with
+// exponential backoff starting at dbRetryBaseDelay.
+var (
+	dbMaxRetries     = envInt("DB_MAX_RETRIES", 3)
+	dbRetryBaseDelay = envDuration("DB_RETRY_BASE_DELAY", 50*time.Millisecond)
+)
+
+// errDBTimeout is returned, wrapped, when a creditdb call runs out of time.
+var errDBTimeout = errors.New("creditdb call timed out")
+
+// getLine, setLine and deleteLine wrap the creditdb calls with dbTimeout
+// and retries. All DBClient methods go through them rather than the
+// embedded Store.
+func (db *DBClient) getLine(ctx context.Context, key string) (*creditdb.Line, error) {
+	var line *creditdb.Line
+	err := db.do(ctx, "get", key, func(ctx context.Context) error {
+		var err error
+		line, err = db.GetLine(ctx, key)
+		return err
+	})
+	return line, err
+}
+
+func (db *DBClient) setLine(ctx context.Context, key, value string) error {
+	return db.do(ctx, "set", key, func(ctx context.Context) error {
+		return db.SetLine(ctx, key, value)
+	})
+}
+
+func (db *DBClient) deleteLine(ctx context.Context, key string) error {
+	return db.do(ctx, "delete", key, func(ctx context.Context) error {
+		return db.DeleteLine(ctx, key)
+	})
+}
+
+func (db *DBClient) getAllLines(ctx context.Context) ([]creditdb.Line, error) {
+	var lines []creditdb.Line
+	err := db.do(ctx, "getall", "", func(ctx context.Context) error {
+		var err error
+		lines, err = db.GetAllLines(ctx)
+		return err
+	})
+	return lines, err
+}
+
+func (db *DBClient) do(ctx context.Context, op, key string, call func(context.Context) error) error {
+	if db.Store == nil {
+		dbHealthy.Store(false)
+		return errNoDB
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	err := db.retry(ctx, call)
+	if err != nil && err != creditdb.ErrNotFound {
+		dbErrorsTotal.WithLabelValues(op).Inc()
+		dbHealthy.Store(false)
+	} else {
+		dbHealthy.Store(true)
+	}
+	return timeoutError(ctx, op, key, err)
+}
+
+func (db *DBClient) retry(ctx context.Context, call func(context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		err := call(ctx)
+		if err == nil || !retryable(err) || attempt >= dbMaxRetries {
+			return err
+		}
+		wait := time.NewTimer(backoffDelay(attempt))
+		select {
+		case <-ctx.Done():
+			wait.Stop()
+			return err
+		case <-wait.C:
+		}
+	}
+}
+
+// retryable reports whether err may be transient. creditdb reports network
+// failures as ErrInternalError. Not-found answers and HTTP errors, which it
+// reports as ErrBadRequest, are final.
+func retryable(err error) bool {
+	return err == creditdb.ErrInternalError || err == creditdb.ErrTimeout || err == creditdb.ErrServiceUnavailable
+}
+
+// backoffDelay doubles dbRetryBaseDelay per attempt and picks a random point
+// in the upper half of that window.
+func backoffDelay(attempt int) time.Duration {
+	d := dbRetryBaseDelay << attempt
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// timeoutError replaces err with errDBTimeout when ctx expired. creditdb
+// reports a cancelled request as a generic internal error.
+func timeoutError(ctx context.Context, op, key string, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s %q: %w", op, key, errDBTimeout)
+	}
+	return err
+}
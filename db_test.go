@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ayo-ajayi/realtime-chat-creditdb-websocket/storetest"
+	"github.com/creditdb/go-creditdb"
+)
+
+func TestDBConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    DBConfig
+		wantErr bool
+	}{
+		{"defaults", nil, DBConfig{Page: defaultDBPage}, false},
+		{"addr override", map[string]string{"CREDITDB_ADDR": "http://db:5622"}, DBConfig{Addr: "http://db:5622", Page: defaultDBPage}, false},
+		{"page override", map[string]string{"CREDITDB_PAGE": "3"}, DBConfig{Page: 3}, false},
+		{"both", map[string]string{"CREDITDB_ADDR": "http://db:5622", "CREDITDB_PAGE": "42"}, DBConfig{Addr: "http://db:5622", Page: 42}, false},
+		{"zero page", map[string]string{"CREDITDB_PAGE": "0"}, DBConfig{}, true},
+		{"negative page", map[string]string{"CREDITDB_PAGE": "-1"}, DBConfig{}, true},
+		{"garbage page", map[string]string{"CREDITDB_PAGE": "ten"}, DBConfig{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dbConfigFromEnv(func(key string) string { return tt.env[key] })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDBConfigAddr(t *testing.T) {
+	if got := (DBConfig{}).addr(); got != defaultDBAddr {
+		t.Fatalf("default addr = %q, want %q", got, defaultDBAddr)
+	}
+	if got := (DBConfig{Addr: "http://db:5622"}).addr(); got != "http://db:5622" {
+		t.Fatalf("addr = %q", got)
+	}
+}
+
+func TestStoreAndRetrieveMessages(t *testing.T) {
+	db := NewDBClientFromStore(storetest.NewMemStore())
+	ctx := context.Background()
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	var want []string
+	for i := 0; i < 3; i++ {
+		msg := Message{ID: newTestUser("msg"), Sender: alice, Recipient: bob, Content: strconv.Itoa(i)}
+		if err := db.StoreMessage(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, msg.ID)
+	}
+	// Either side of the conversation reads the same history.
+	for _, m := range []Message{{Sender: alice, Recipient: bob}, {Sender: bob, Recipient: alice}} {
+		history, err := db.RetrieveStoredMessages(ctx, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, msg := range history {
+			got = append(got, msg.ID)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("history of %s = %v, want %v", m.Sender, got, want)
+		}
+	}
+}
+
+// withRetries sets dbMaxRetries and a short backoff for the test.
+func withRetries(t *testing.T, n int) {
+	t.Helper()
+	oldRetries, oldDelay := dbMaxRetries, dbRetryBaseDelay
+	dbMaxRetries, dbRetryBaseDelay = n, time.Millisecond
+	t.Cleanup(func() { dbMaxRetries, dbRetryBaseDelay = oldRetries, oldDelay })
+}
+
+func TestStoreRetriesTransientFaults(t *testing.T) {
+	withRetries(t, 2)
+	boom := errors.New("boom")
+	tests := []struct {
+		name    string
+		faults  map[int]error
+		calls   int
+		wantErr error
+	}{
+		{"no fault", nil, 1, nil},
+		{"one transient fault", map[int]error{1: creditdb.ErrServiceUnavailable}, 2, nil},
+		{"transient faults up to the retries", map[int]error{1: creditdb.ErrInternalError, 2: creditdb.ErrTimeout}, 3, nil},
+		{"transient faults beyond the retries", map[int]error{1: creditdb.ErrTimeout, 2: creditdb.ErrTimeout, 3: creditdb.ErrTimeout}, 3, creditdb.ErrTimeout},
+		{"final fault", map[int]error{1: boom}, 1, boom},
+		{"not found is final", map[int]error{1: creditdb.ErrNotFound}, 1, creditdb.ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storetest.NewMemStore()
+			db := NewDBClientFromStore(store)
+			for n, err := range tt.faults {
+				store.FailCall(n, err)
+			}
+			if err := db.setLine(context.Background(), "k", "v"); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("setLine = %v, want %v", err, tt.wantErr)
+			}
+			if n := store.Calls(); n != tt.calls {
+				t.Fatalf("calls = %d, want %d", n, tt.calls)
+			}
+		})
+	}
+}
+
+func TestStoreMessageSurvivesTransientFault(t *testing.T) {
+	withRetries(t, 2)
+	store := func(fail int) (*storetest.MemStore, error) {
+		store := storetest.NewMemStore()
+		db := NewDBClientFromStore(store)
+		alice, bob := newTestUser("alice"), newTestUser("bob")
+		msg := Message{ID: newTestUser("msg"), Sender: alice, Recipient: bob, Content: "hi"}
+		if fail > 0 {
+			store.FailCall(fail, creditdb.ErrServiceUnavailable)
+		}
+		if err := db.StoreMessage(context.Background(), msg); err != nil {
+			return store, err
+		}
+		if ids := storedIDs(t, db, conversationKey(alice, bob)); !ids[msg.ID] {
+			t.Fatalf("stored = %v, want %s", ids, msg.ID)
+		}
+		return store, nil
+	}
+	clean, err := store(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := clean.Calls()
+	// Whichever call of StoreMessage fails, it is retried once.
+	for n := 1; n <= calls; n++ {
+		faulty, err := store(n)
+		if err != nil {
+			t.Fatalf("fault on call %d: %v", n, err)
+		}
+		if got, want := faulty.Calls(), clean.Calls()+1; got != want {
+			t.Fatalf("fault on call %d: %d calls, want %d", n, got, want)
+		}
+	}
+}
+
+func TestConversationKeyIsCanonical(t *testing.T) {
+	db := NewDBClientFromStore(storetest.NewMemStore())
+	ctx := context.Background()
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	if conversationKey(alice, bob) != conversationKey(bob, alice) {
+		t.Fatalf("keys differ: %s, %s", conversationKey(alice, bob), conversationKey(bob, alice))
+	}
+	ab := Message{ID: newTestUser("msg"), Sender: alice, Recipient: bob, Content: "hi bob"}
+	ba := Message{ID: newTestUser("msg"), Sender: bob, Recipient: alice, Content: "hi alice"}
+	for _, m := range []Message{ab, ba} {
+		if err := db.StoreMessage(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, party := range []Message{{Sender: alice, Recipient: bob}, {Sender: bob, Recipient: alice}} {
+		history, err := db.RetrieveStoredMessages(ctx, party)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 2 || history[0].ID != ab.ID || history[1].ID != ba.ID {
+			t.Fatalf("history loaded by %s = %+v, want both messages in order", party.Sender, history)
+		}
+	}
+}
+
+func TestCraftedIDsDoNotCollide(t *testing.T) {
+	tests := []struct {
+		name   string
+		a, b   [2]string
+		keyFor func(pair [2]string) string
+	}{
+		{"conversation colon moved", [2]string{"a:b", "c"}, [2]string{"a", "b:c"}, func(p [2]string) string { return conversationKey(p[0], p[1]) }},
+		{"conversation escape lookalike", [2]string{"a%3Ab", "c"}, [2]string{"a:b", "c"}, func(p [2]string) string { return conversationKey(p[0], p[1]) }},
+		{"presence", [2]string{"a:b"}, [2]string{"a%3Ab"}, func(p [2]string) string { return presenceKey(p[0]) }},
+		{"offline queue", [2]string{"a:b"}, [2]string{"a"}, func(p [2]string) string { return offlineQueueKey(p[0]) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ka, kb := tt.keyFor(tt.a), tt.keyFor(tt.b); ka == kb {
+				t.Fatalf("%q and %q share the key %s", tt.a, tt.b, ka)
+			}
+		})
+	}
+
+	// Stored through the DB layer, which does not validate IDs, the two
+	// conversations stay apart.
+	db := NewDBClientFromStore(storetest.NewMemStore())
+	ctx := context.Background()
+	first := Message{ID: "m1", Sender: "a:b", Recipient: "c", Content: "first"}
+	second := Message{ID: "m2", Sender: "a", Recipient: "b:c", Content: "second"}
+	for _, m := range []Message{first, second} {
+		if err := db.StoreMessage(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range []Message{first, second} {
+		history, err := db.RetrieveStoredMessages(ctx, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 1 || history[0].ID != m.ID {
+			t.Fatalf("history of %s and %s = %+v, want only %s", m.Sender, m.Recipient, history, m.ID)
+		}
+	}
+}
+
+// hungStore is a Store whose calls block until their context is done, and
+// then fail the way creditdb reports a cancelled request.
+type hungStore struct{}
+
+func (hungStore) GetLine(ctx context.Context, key string) (*creditdb.Line, error) {
+	<-ctx.Done()
+	return nil, creditdb.ErrInternalError
+}
+
+func (hungStore) SetLine(ctx context.Context, key, value string) error {
+	<-ctx.Done()
+	return creditdb.ErrInternalError
+}
+
+func (hungStore) DeleteLine(ctx context.Context, key string) error {
+	<-ctx.Done()
+	return creditdb.ErrInternalError
+}
+
+func (hungStore) GetAllLines(ctx context.Context) ([]creditdb.Line, error) {
+	<-ctx.Done()
+	return nil, creditdb.ErrInternalError
+}
+
+func (hungStore) Close(context.Context) error { return nil }
+
+func TestHungStoreTimesOut(t *testing.T) {
+	withRetries(t, 0)
+	oldTimeout := dbTimeout
+	dbTimeout = 20 * time.Millisecond
+	t.Cleanup(func() {
+		dbTimeout = oldTimeout
+		dbHealthy.Store(true)
+	})
+	db := NewDBClientFromStore(hungStore{})
+	msg := Message{ID: "m1", Sender: "alice", Recipient: "bob", Content: "hi"}
+	tests := []struct {
+		name string
+		call func(ctx context.Context) error
+	}{
+		{"SetUserOnline", func(ctx context.Context) error { return db.SetUserOnline(ctx, "alice") }},
+		{"SetUserOffline", func(ctx context.Context) error { return db.SetUserOffline(ctx, "alice") }},
+		{"GetUsersOnline", func(ctx context.Context) error { _, err := db.GetUsersOnline(ctx); return err }},
+		{"StoreMessage", func(ctx context.Context) error { return db.StoreMessage(ctx, msg) }},
+		{"RetrieveStoredMessages", func(ctx context.Context) error { _, err := db.RetrieveStoredMessages(ctx, msg); return err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			err := tt.call(context.Background())
+			if !errors.Is(err, errDBTimeout) {
+				t.Fatalf("err = %v, want %v", err, errDBTimeout)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("returned after %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestOperationsRetryTwoTransientFaults(t *testing.T) {
+	withRetries(t, 2)
+	msg := Message{ID: "m1", Sender: "alice", Recipient: "bob", Content: "hi"}
+	tests := []struct {
+		name  string
+		call  func(db *DBClient) error
+		check func(db *DBClient) bool
+	}{
+		{"StoreMessage", func(db *DBClient) error { return db.StoreMessage(context.Background(), msg) }, func(db *DBClient) bool {
+			history, err := db.RetrieveStoredMessages(context.Background(), msg)
+			return err == nil && len(history) == 1
+		}},
+		{"SetUserOnline", func(db *DBClient) error { return db.SetUserOnline(context.Background(), "alice") }, func(db *DBClient) bool {
+			online, err := db.IsUserOnline(context.Background(), "alice")
+			return err == nil && online
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storetest.NewMemStore()
+			db := NewDBClientFromStore(store)
+			store.FailCall(1, creditdb.ErrServiceUnavailable)
+			store.FailCall(2, creditdb.ErrInternalError)
+			if err := tt.call(db); err != nil {
+				t.Fatalf("%s = %v after two transient faults", tt.name, err)
+			}
+			if !tt.check(db) {
+				t.Fatalf("%s had no effect", tt.name)
+			}
+		})
+	}
+}
+
+func TestCancelledCallIsNotRetried(t *testing.T) {
+	withRetries(t, 2)
+	store := storetest.NewMemStore()
+	db := NewDBClientFromStore(store)
+	store.FailCall(1, creditdb.ErrTimeout)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.setLine(ctx, "k", "v"); err == nil {
+		t.Fatal("setLine succeeded on a cancelled context")
+	}
+	if n := store.Calls(); n != 1 {
+		t.Fatalf("calls = %d, want 1", n)
+	}
+}
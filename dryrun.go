@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dryRunResult is the /send response in dry-run mode: the message that
+// would have been stored, without a Seq since none was taken.
+type dryRunResult struct {
+	Message
+	DryRun bool `json:"dryRun"`
+}
+
+// isDryRun reports whether a /send request only asks for validation, via
+// ?validate=true or an X-Dry-Run: true header.
+func isDryRun(c *gin.Context) bool {
+	return c.Query("validate") == "true" || c.GetHeader("X-Dry-Run") == "true"
+}
+
+// checkOutgoing runs the checks storeOutgoing would run, without writing
+// anything: room membership for room messages, the blocklist for direct
+// ones. It returns the same errors.
+func (r *Router) checkOutgoing(ctx context.Context, msg Message) error {
+	if msg.RoomID != "" {
+		members, err := r.dbclient.RoomMembers(ctx, msg.RoomID)
+		if err != nil {
+			return err
+		}
+		if !contains(members, msg.Sender) {
+			return errNotRoomMember
+		}
+		return nil
+	}
+	blocked, err := r.dbclient.IsBlocked(ctx, msg.Recipient, msg.Sender)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return errBlocked
+	}
+	return nil
+}
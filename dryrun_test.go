@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestDryRunSendValidatesOnly(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob, carol, mallory := newTestUser("alice"), newTestUser("bob"), newTestUser("carol"), newTestUser("mallory")
+	if status := ts.do(t, http.MethodPost, "/block", map[string]any{"user": bob, "blocked": mallory}, nil); status >= 300 {
+		t.Fatalf("block: %d", status)
+	}
+	var room roomResponse
+	if status := ts.do(t, http.MethodPost, "/rooms", map[string]any{"creator": bob, "members": []string{carol}}, &room); status != http.StatusCreated {
+		t.Fatalf("create room: %d", status)
+	}
+	bobConn, _ := ts.dial(t, bob)
+
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		body   map[string]any
+		status int
+		code   string
+	}{
+		{"query", "/send?validate=true", nil, map[string]any{"sender": alice, "recipient": bob, "content": "hi"}, http.StatusOK, ""},
+		{"header", "/send", http.Header{"X-Dry-Run": {"true"}}, map[string]any{"sender": alice, "recipient": bob, "content": "hi"}, http.StatusOK, ""},
+		{"offline recipient", "/send?validate=true", nil, map[string]any{"sender": alice, "recipient": carol, "content": "hi"}, http.StatusOK, ""},
+		{"room member", "/send?validate=true", nil, map[string]any{"sender": carol, "roomId": room.ID, "content": "hi"}, http.StatusOK, ""},
+		{"blocked", "/send?validate=true", nil, map[string]any{"sender": mallory, "recipient": bob, "content": "hi"}, http.StatusForbidden, ErrCodeBlocked},
+		{"not a room member", "/send?validate=true", nil, map[string]any{"sender": alice, "roomId": room.ID, "content": "hi"}, http.StatusForbidden, ErrCodeNotRoomMember},
+		{"self-send", "/send?validate=true", nil, map[string]any{"sender": alice, "recipient": alice, "content": "hi"}, http.StatusBadRequest, ErrCodeInvalidRequest},
+		{"empty content", "/send?validate=true", nil, map[string]any{"sender": alice, "recipient": bob, "content": ""}, http.StatusBadRequest, ErrCodeInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp struct {
+				dryRunResult
+				Code string `json:"code"`
+			}
+			status := ts.doWith(t, http.MethodPost, tt.path, tt.header, tt.body, &resp)
+			if status != tt.status || resp.Code != tt.code {
+				t.Fatalf("status = %d %q, want %d %q", status, resp.Code, tt.status, tt.code)
+			}
+			if status == http.StatusOK && (!resp.DryRun || resp.ID == "" || resp.Seq != 0) {
+				t.Fatalf("response = %+v, want a dry run with an ID and no seq", resp)
+			}
+		})
+	}
+
+	// Nothing was stored, indexed or queued, and no seq was taken.
+	for _, key := range []string{conversationKey(alice, bob), conversationKey(alice, carol), offlineQueueKey(carol), conversationIndexKey(alice), conversationIndexKey(bob)} {
+		if line, err := ts.db.getLine(context.Background(), key); err == nil {
+			t.Errorf("%s = %s after dry runs", key, line.Value)
+		}
+	}
+	if history, err := ts.db.loadHistory(context.Background(), roomMessagesKey(room.ID)); err != nil || len(history) != 0 {
+		t.Errorf("room history = %v, %v after dry runs", history, err)
+	}
+	// Nothing was delivered either: the first message bob gets is the
+	// real one.
+	real := ts.send(t, alice, bob, "real")
+	if got := readUntil(t, bobConn, EventMessage); got["id"] != real.ID {
+		t.Fatalf("bob got %v first, want %s", got, real.ID)
+	}
+	if real.Seq != 1 {
+		t.Fatalf("seq = %d, want 1", real.Seq)
+	}
+}
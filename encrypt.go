@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// With ENCRYPT_AT_REST=true, message content and attachment references are
+// sealed with AES-256-GCM before they reach creditdb. ENCRYPTION_KEYS lists
+// "<id>:<base64 key>" pairs; the first key encrypts and every key decrypts,
+// so a key is rotated by putting a new one first and dropping the old one
+// once nothing sealed with it is left.
+//
+// A sealed field reads "enc:<id>:<base64 nonce and ciphertext>". Fields
+// without the prefix are plaintext written before encryption was enabled,
+// and are returned as they are.
+const sealedPrefix = "enc:"
+
+// atRest is nil when encryption at rest is off. main sets it at startup.
+var atRest *fieldCipher
+
+var errUnknownKeyID = errors.New("value is sealed with an unknown key")
+
+type fieldCipher struct {
+	currentID string
+	keys      map[string]cipher.AEAD
+}
+
+// atRestCipher builds the cipher from the environment, or returns nil when
+// ENCRYPT_AT_REST is not true.
+func atRestCipher(getenv func(string) string) (*fieldCipher, error) {
+	if getenv("ENCRYPT_AT_REST") != "true" {
+		return nil, nil
+	}
+	spec := getenv("ENCRYPTION_KEYS")
+	if spec == "" {
+		return nil, errors.New("ENCRYPT_AT_REST=true requires ENCRYPTION_KEYS")
+	}
+	fc := &fieldCipher{keys: make(map[string]cipher.AEAD)}
+	for _, pair := range strings.Split(spec, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("ENCRYPTION_KEYS entry %q is not <id>:<base64 key>", pair)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %q must be 32 bytes, base64 encoded", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if fc.currentID == "" {
+			fc.currentID = id
+		}
+		fc.keys[id] = aead
+	}
+	return fc, nil
+}
+
+func (fc *fieldCipher) seal(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	aead := fc.keys[fc.currentID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(fc.currentID))
+	return sealedPrefix + fc.currentID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (fc *fieldCipher) open(value string) (string, error) {
+	rest, ok := strings.CutPrefix(value, sealedPrefix)
+	if !ok {
+		return value, nil
+	}
+	id, encoded, ok := strings.Cut(rest, ":")
+	aead := fc.keys[id]
+	if !ok || aead == nil {
+		return "", errUnknownKeyID
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("sealed value is malformed")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(id))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// sealMessages returns a copy of messages with content and attachments
+// sealed. It returns messages unchanged when encryption is off.
+func sealMessages(messages []Message) ([]Message, error) {
+	if atRest == nil {
+		return messages, nil
+	}
+	sealed := make([]Message, len(messages))
+	for i, m := range messages {
+		var err error
+		if m.Content, err = atRest.seal(m.Content); err != nil {
+			return nil, err
+		}
+		if len(m.Attachments) > 0 {
+			attachments := make([]Attachment, len(m.Attachments))
+			for j, a := range m.Attachments {
+				if a.URL, err = atRest.seal(a.URL); err != nil {
+					return nil, err
+				}
+				if a.Name, err = atRest.seal(a.Name); err != nil {
+					return nil, err
+				}
+				attachments[j] = a
+			}
+			m.Attachments = attachments
+		}
+		sealed[i] = m
+	}
+	return sealed, nil
+}
+
+// openMessages reverses sealMessages in place.
+func openMessages(messages []Message) error {
+	if atRest == nil {
+		return nil
+	}
+	for i := range messages {
+		m := &messages[i]
+		var err error
+		if m.Content, err = atRest.open(m.Content); err != nil {
+			return err
+		}
+		for j := range m.Attachments {
+			a := &m.Attachments[j]
+			if a.URL, err = atRest.open(a.URL); err != nil {
+				return err
+			}
+			if a.Name, err = atRest.open(a.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
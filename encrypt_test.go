@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testKey returns a base64 AES-256 key made of b.
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune(b)), 32)))
+}
+
+// withAtRest enables encryption at rest with ENCRYPTION_KEYS set to keys
+// for the test.
+func withAtRest(t *testing.T, keys string) {
+	t.Helper()
+	env := map[string]string{"ENCRYPT_AT_REST": "true", "ENCRYPTION_KEYS": keys}
+	fc, err := atRestCipher(func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := atRest
+	atRest = fc
+	t.Cleanup(func() { atRest = old })
+}
+
+func TestAtRestCipherConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		enabled bool
+		wantErr bool
+	}{
+		{"off", map[string]string{"ENCRYPTION_KEYS": "k1:" + testKey('a')}, false, false},
+		{"on", map[string]string{"ENCRYPT_AT_REST": "true", "ENCRYPTION_KEYS": "k1:" + testKey('a')}, true, false},
+		{"two keys", map[string]string{"ENCRYPT_AT_REST": "true", "ENCRYPTION_KEYS": "k2:" + testKey('b') + ", k1:" + testKey('a')}, true, false},
+		{"no keys", map[string]string{"ENCRYPT_AT_REST": "true"}, false, true},
+		{"no key ID", map[string]string{"ENCRYPT_AT_REST": "true", "ENCRYPTION_KEYS": testKey('a')}, false, true},
+		{"short key", map[string]string{"ENCRYPT_AT_REST": "true", "ENCRYPTION_KEYS": "k1:" + base64.StdEncoding.EncodeToString([]byte("short"))}, false, true},
+		{"not base64", map[string]string{"ENCRYPT_AT_REST": "true", "ENCRYPTION_KEYS": "k1:???"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc, err := atRestCipher(func(key string) string { return tt.env[key] })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if (fc != nil) != tt.enabled {
+				t.Fatalf("enabled = %v, want %v", fc != nil, tt.enabled)
+			}
+		})
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	withAtRest(t, "k1:"+testKey('a'))
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	const content, link, name = "the launch code is 1234", "https://files.example.com/plan.pdf", "plan.pdf"
+	var sent Message
+	body := map[string]any{"sender": alice, "recipient": bob, "content": content, "attachments": []Attachment{{URL: link, MimeType: "application/pdf", Size: 100, Name: name}}}
+	if status := ts.do(t, http.MethodPost, "/send", body, &sent); status != http.StatusOK {
+		t.Fatalf("send: status %d", status)
+	}
+	// bob is offline, so the message is in his queue as well as in the
+	// history. Neither holds the plaintext.
+	waitFor(t, "the message to be queued", func() bool {
+		_, queued := lineValues(t, ts.db)[offlineQueueKey(bob)]
+		return queued
+	})
+	sealed := 0
+	for key, value := range lineValues(t, ts.db) {
+		for _, secret := range []string{content, link, name} {
+			if strings.Contains(value, secret) {
+				t.Errorf("%s holds %q in the clear: %s", key, secret, value)
+			}
+		}
+		if strings.Contains(value, sealedPrefix+"k1:") {
+			sealed++
+		}
+	}
+	if sealed < 2 {
+		t.Fatalf("%d lines hold sealed values, want the history and the queue", sealed)
+	}
+
+	// Reads decrypt.
+	history := ts.history(t, alice, bob)
+	if len(history) != 1 || history[0].Content != content || history[0].Attachments[0].URL != link || history[0].Attachments[0].Name != name {
+		t.Fatalf("history = %+v, want the plaintext message", history)
+	}
+	_, replayed := ts.dial(t, bob)
+	if len(replayed) == 0 {
+		t.Fatal("nothing replayed")
+	}
+	if got := replayed[len(replayed)-1]; got["id"] != sent.ID || got["content"] != content {
+		t.Fatalf("replayed %v, want the plaintext message", got)
+	}
+
+	// After a rotation the old key still decrypts, and new writes use the
+	// new one (the page holding both messages is sealed again).
+	withAtRest(t, "k2:"+testKey('b')+",k1:"+testKey('a'))
+	ts.send(t, alice, bob, "after the rotation")
+	if history := ts.history(t, alice, bob); len(history) != 2 || history[0].Content != content || history[1].Content != "after the rotation" {
+		t.Fatalf("history after the rotation = %+v", history)
+	}
+	if !strings.Contains(lineValues(t, ts.db)[historyPageKey(conversationKey(alice, bob), 0)], sealedPrefix+"k2:") {
+		t.Fatal("new message not sealed with the new key")
+	}
+
+	// A key that does not match, or a missing one, is an error.
+	for _, keys := range []string{"k2:" + testKey('c') + ",k1:" + testKey('a'), "k3:" + testKey('b')} {
+		withAtRest(t, keys)
+		_, err := ts.db.loadHistory(context.Background(), conversationKey(alice, bob))
+		if err == nil {
+			t.Fatalf("keys %s: history loaded", keys)
+		}
+		if strings.HasPrefix(keys, "k3") && !errors.Is(err, errUnknownKeyID) {
+			t.Fatalf("keys %s: err = %v, want %v", keys, err, errUnknownKeyID)
+		}
+		if status := ts.do(t, http.MethodGet, "/messages?"+url.Values{"sender": {alice}, "recipient": {bob}}.Encode(), nil, nil); status != http.StatusInternalServerError {
+			t.Fatalf("keys %s: /messages status %d, want %d", keys, status, http.StatusInternalServerError)
+		}
+	}
+}
+
+// history returns the stored conversation of sender and recipient, oldest
+// first.
+func (ts *testServer) history(t *testing.T, sender, recipient string) []Message {
+	t.Helper()
+	history, err := ts.db.loadHistory(context.Background(), conversationKey(sender, recipient))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return history
+}
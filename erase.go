@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/creditdb/go-creditdb"
+	"github.com/gin-gonic/gin"
+)
+
+// ErasureReport lists what deleting a user's data removed. Conversations
+// are deleted for both participants. Room histories lose the user's
+// messages and rooms lose the user as a member, but are otherwise kept.
+// Queued counts the user's messages removed from other users' offline
+// queues.
+// Errors lists the steps that failed; every other step still ran, and
+// repeating the request retries the failed ones.
+type ErasureReport struct {
+	User          string   `json:"user"`
+	Conversations int      `json:"conversations"`
+	Messages      int      `json:"messages"`
+	Rooms         int      `json:"rooms"`
+	Queued        int      `json:"queued"`
+	Keys          []string `json:"keys"`
+	Errors        []string `json:"errors,omitempty"`
+}
+
+func (rep *ErasureReport) fail(step string, err error) {
+	rep.Errors = append(rep.Errors, step+": "+err.Error())
+}
+
+// eraseDisconnectTimeout bounds how long eraseUserData waits for the
+// user's connections to close before giving up.
+const eraseDisconnectTimeout = 10 * time.Second
+
+// eraseUserData deletes everything stored for user :id after closing their
+// connections. The caller must be authenticated as that user, or come in
+// through /admin; with authentication disabled only the admin route
+// works. It answers 200 with the report, or 500 with it if any step
+// failed.
+func (r *Router) eraseUserData(c *gin.Context) {
+	user, err := normalizeUserID(c.Param("id"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "user: "+err.Error())
+		return
+	}
+	if !c.GetBool(adminKey) {
+		caller := c.GetString(authUserKey)
+		if caller == "" {
+			respondError(c, http.StatusUnauthorized, ErrCodeUnauthorized, "deleting user data requires authentication")
+			return
+		}
+		if caller != user {
+			respondError(c, http.StatusForbidden, ErrCodeForbidden, "users may only delete their own data")
+			return
+		}
+	}
+	// The handlers of closing connections still write the user's last
+	// seen time, presence and offline queue, so erasing starts once they
+	// are done, and once an earlier session's deferred offline transition
+	// has run.
+	ctx, cancel := context.WithTimeout(c, eraseDisconnectTimeout)
+	defer cancel()
+	if err := awaitDisconnected(ctx, disconnectUser(user, "account data deleted")); err != nil {
+		logger.Error("erase user data: connections did not close", "event", "erase", "user", user, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to close the user's connections")
+		return
+	}
+	resumeSession(user, "")
+	report := r.dbclient.EraseUser(c, user)
+	if len(report.Errors) > 0 {
+		logger.Error("erase user data incomplete", "event", "erase", "user", user, "errors", report.Errors)
+		c.JSON(http.StatusInternalServerError, report)
+		return
+	}
+	logger.Info("erased user data", "event", "erase", "user", user, "conversations", report.Conversations, "messages", report.Messages, "rooms", report.Rooms)
+	c.JSON(http.StatusOK, report)
+}
+
+// EraseUser deletes user's conversations, their messages in rooms and in
+// other users' offline queues, their room memberships, the receipts of
+// their direct messages, and every key kept per user. It is best effort: a failed step is recorded in the
+// report and the rest go ahead. Finding rooms reads every line of the
+// page, like retention.
+func (db *DBClient) EraseUser(ctx context.Context, user string) ErasureReport {
+	report := ErasureReport{User: user, Keys: []string{}}
+
+	partners, err := db.ConversationPartners(ctx, user)
+	if err != nil {
+		report.fail("conversations", err)
+	}
+	for _, peer := range partners {
+		n, err := db.eraseConversation(ctx, user, peer)
+		report.Messages += n
+		if err != nil {
+			report.fail("conversation with "+peer, err)
+			continue
+		}
+		report.Conversations++
+	}
+
+	lines, err := db.getAllLines(ctx)
+	if err != nil {
+		report.fail("rooms", err)
+	}
+	for _, line := range lines {
+		if id, ok := roomOfMembersKey(line.Key); ok {
+			left, err := db.leaveRoom(ctx, id, user)
+			if err != nil {
+				report.fail("room "+id, err)
+			} else if left {
+				report.Rooms++
+			}
+			continue
+		}
+		if strings.HasPrefix(line.Key, offlineQueueKey("")) && line.Key != offlineQueueKey(user) {
+			n, err := db.eraseQueuedMessages(ctx, line.Key, user)
+			report.Queued += n
+			if err != nil {
+				report.fail(line.Key, err)
+			}
+			continue
+		}
+		if key, ok := historyKeyOf(line.Key); ok && strings.HasPrefix(key, "room:") {
+			n, err := db.eraseRoomMessages(ctx, key, user)
+			report.Messages += n
+			if err != nil {
+				report.fail(key, err)
+			}
+		}
+	}
+
+	for _, key := range []string{
+		conversationIndexKey(user),
+		offlineQueueKey(user),
+		presenceKey(user),
+		lastSeenKey(user),
+		webhookKey(user),
+		blocklistKey(user),
+		muteKey(user),
+	} {
+		err := db.deleteLine(ctx, key)
+		switch {
+		case err == nil:
+			report.Keys = append(report.Keys, key)
+		case err != creditdb.ErrNotFound:
+			report.fail(key, err)
+		}
+	}
+	forgetMutes(user)
+	return report
+}
+
+// eraseConversation deletes the conversation between user and peer, its
+// sequence counter and receipts, and drops it from peer's index. It
+// returns the number of messages deleted.
+func (db *DBClient) eraseConversation(ctx context.Context, user, peer string) (int, error) {
+	key := conversationKey(user, peer)
+	unlock := keyLocks.lock(key)
+	messages, err := db.loadHistory(ctx, key)
+	if err == nil {
+		err = db.deleteHistory(ctx, key)
+	}
+	unlock()
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range messages {
+		if err := db.deleteQuietly(ctx, receiptKey(m.ID)); err != nil {
+			return len(messages), err
+		}
+	}
+	if err := db.deleteQuietly(ctx, seqKey(key)); err != nil {
+		return len(messages), err
+	}
+	return len(messages), db.removeConversationPartner(ctx, peer, user)
+}
+
+// roomOfMembersKey returns the escaped room ID of a room member list key.
+func roomOfMembersKey(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, "room:")
+	if !ok {
+		return "", false
+	}
+	return strings.CutSuffix(rest, ":members")
+}
+
+// leaveRoom removes user from the members of the room whose member list
+// is stored under escaped ID id, and reports whether they were one.
+func (db *DBClient) leaveRoom(ctx context.Context, id, user string) (bool, error) {
+	key := "room:" + id + ":members"
+	defer keyLocks.lock(key)()
+	line, err := db.getLine(ctx, key)
+	if err == creditdb.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	members := []string{}
+	if err := json.Unmarshal([]byte(line.Value), &members); err != nil {
+		return false, err
+	}
+	if !contains(members, user) {
+		return false, nil
+	}
+	kept := []string{}
+	for _, m := range members {
+		if m != user {
+			kept = append(kept, m)
+		}
+	}
+	return true, db.saveIDList(ctx, key, kept)
+}
+
+// eraseRoomMessages removes the messages user sent from the room history
+// under key and returns how many there were.
+func (db *DBClient) eraseRoomMessages(ctx context.Context, key, user string) (int, error) {
+	defer keyLocks.lock(key)()
+	messages, err := db.loadHistory(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	kept := []Message{}
+	for _, m := range messages {
+		if m.Sender != user {
+			kept = append(kept, m)
+		}
+	}
+	removed := len(messages) - len(kept)
+	switch {
+	case removed == 0:
+		return 0, nil
+	case len(kept) == 0:
+		err = db.deleteHistory(ctx, key)
+	default:
+		err = db.saveHistory(ctx, key, kept)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// eraseQueuedMessages removes the messages user sent from the offline
+// queue under key and returns how many there were.
+func (db *DBClient) eraseQueuedMessages(ctx context.Context, key, user string) (int, error) {
+	defer keyLocks.lock(key)()
+	queue, err := db.loadConversation(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	kept := []Message{}
+	for _, m := range queue {
+		if m.Sender != user {
+			kept = append(kept, m)
+		}
+	}
+	removed := len(queue) - len(kept)
+	switch {
+	case removed == 0:
+		return 0, nil
+	case len(kept) == 0:
+		err = db.deleteLine(ctx, key)
+	default:
+		err = db.saveConversation(ctx, key, kept)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
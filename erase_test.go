@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withAdminToken sets adminToken for the servers the test creates.
+func withAdminToken(t *testing.T, token string) {
+	t.Helper()
+	old := adminToken
+	adminToken = token
+	t.Cleanup(func() { adminToken = old })
+}
+
+func TestEraseUserDataRequiresAuth(t *testing.T) {
+	const secret = "hmac-secret"
+	withAdminToken(t, "admin-secret")
+	signedAs := func(user string) http.Header {
+		return http.Header{"X-User-Id": {user}, "X-User-Signature": {SignUserID(secret, user)}}
+	}
+	tests := []struct {
+		name   string
+		hmac   bool
+		path   string
+		header func(user string) http.Header
+		status int
+	}{
+		{"no auth", false, "/user/%s/data", func(string) http.Header { return nil }, http.StatusUnauthorized},
+		{"no auth, admin route", false, "/admin/user/%s/data", func(string) http.Header {
+			return http.Header{"X-Admin-Token": {"admin-secret"}}
+		}, http.StatusOK},
+		{"wrong admin token", false, "/admin/user/%s/data", func(string) http.Header {
+			return http.Header{"X-Admin-Token": {"guess"}}
+		}, http.StatusUnauthorized},
+		{"other user", true, "/user/%s/data", func(string) http.Header { return signedAs("mallory") }, http.StatusForbidden},
+		{"the user", true, "/user/%s/data", signedAs, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			if tt.hmac {
+				ts = newTestServerWith(t, NewHMACAuthMiddleware(secret))
+			}
+			alice, bob := newTestUser("alice"), newTestUser("bob")
+			if status := ts.doWith(t, http.MethodPost, "/send", signedAs(bob), map[string]any{"sender": bob, "recipient": alice, "content": "hello"}, nil); status != http.StatusOK {
+				t.Fatalf("send: %d", status)
+			}
+			status := ts.doWith(t, http.MethodDelete, strings.Replace(tt.path, "%s", alice, 1), tt.header(alice), nil, nil)
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			ids := storedIDs(t, ts.db, conversationKey(alice, bob))
+			if erased := len(ids) == 0; erased != (tt.status == http.StatusOK) {
+				t.Fatalf("conversation holds %v after status %d", ids, status)
+			}
+		})
+	}
+}
+
+func TestErasedKeysNoLongerResolve(t *testing.T) {
+	withAdminToken(t, "admin-secret")
+	ts := newTestServer(t)
+	alice, bob, carol := newTestUser("alice"), newTestUser("bob"), newTestUser("carol")
+
+	var room roomResponse
+	if status := ts.do(t, http.MethodPost, "/rooms", map[string]any{"creator": alice, "members": []string{carol}}, &room); status != http.StatusCreated {
+		t.Fatalf("create room: %d", status)
+	}
+	aliceConn, _ := ts.dial(t, alice)
+	// bob and carol are offline, so alice's direct and room messages wait
+	// in their offline queues.
+	ts.send(t, alice, bob, "to bob")
+	ts.send(t, bob, alice, "to alice")
+	if status := ts.do(t, http.MethodPost, "/send", map[string]any{"sender": alice, "roomId": room.ID, "content": "to the room"}, nil); status != http.StatusOK {
+		t.Fatalf("room send: %d", status)
+	}
+	if status := ts.do(t, http.MethodPost, "/block", map[string]any{"user": alice, "blocked": newTestUser("spammer")}, nil); status >= 300 {
+		t.Fatalf("block: %d", status)
+	}
+	if status := ts.do(t, http.MethodPost, "/mute", map[string]any{"user": alice, "peer": carol}, nil); status >= 300 {
+		t.Fatalf("mute: %d", status)
+	}
+	kept := ts.send(t, carol, bob, "unrelated")
+
+	var report ErasureReport
+	status := ts.doWith(t, http.MethodDelete, "/admin/user/"+alice+"/data", http.Header{"X-Admin-Token": {"admin-secret"}}, nil, &report)
+	if status != http.StatusOK {
+		t.Fatalf("erase: status %d, report %+v", status, report)
+	}
+	aliceConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := aliceConn.ReadMessage()
+		if websocket.IsCloseError(err, CloseKicked) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("alice's connection: %v, want close %d", err, CloseKicked)
+		}
+	}
+	if report.Queued != 2 {
+		t.Errorf("queued = %d, want 2", report.Queued)
+	}
+
+	lines, err := ts.db.getAllLines(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range lines {
+		if strings.Contains(line.Key, alice) || strings.Contains(line.Value, alice) {
+			t.Errorf("%s still resolves to %s", line.Key, line.Value)
+		}
+	}
+	for _, key := range []string{
+		conversationKey(alice, bob),
+		conversationIndexKey(alice),
+		offlineQueueKey(alice),
+		presenceKey(alice),
+		lastSeenKey(alice),
+		blocklistKey(alice),
+		muteKey(alice),
+	} {
+		if line, err := ts.db.getLine(context.Background(), key); err == nil {
+			t.Errorf("%s still resolves to %s", key, line.Value)
+		}
+	}
+	queue, err := ts.db.DrainOffline(context.Background(), bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 1 || queue[0].ID != kept.ID {
+		t.Errorf("bob's offline queue = %+v, want only %s", queue, kept.ID)
+	}
+}
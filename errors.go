@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/creditdb/go-creditdb"
+	"github.com/gin-gonic/gin"
+)
+
+// Error codes carried by ErrorEvent over the WebSocket and by the "code"
+// field of REST error bodies. Clients should branch on the code; the
+// message is for people and may change.
+const (
+	ErrCodeInvalidMessage = "invalid_message"
+	ErrCodeInvalidRequest = "invalid_request"
+	ErrCodeInternal       = "internal_error"
+	ErrCodeIdleTimeout    = "idle_timeout"
+	ErrCodeUnauthorized   = "unauthorized"
+	ErrCodeRateLimited    = "rate_limited"
+	ErrCodeForbidden      = "forbidden"
+	ErrCodeNotFound       = "not_found"
+	ErrCodeConflict       = "conflict"
+	ErrCodeBusy           = "server_busy"
+	ErrCodeBlocked        = "blocked"
+	ErrCodeNotRoomMember  = "not_room_member"
+	ErrCodeRoomNotFound   = "room_not_found"
+	ErrCodeKicked         = "kicked"
+)
+
+// respondError aborts the request with status and the body
+// {"code": code, "error": message}.
+func respondError(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, gin.H{"code": code, "error": message})
+}
+
+// isRefused reports whether err is checkOutgoing refusing a message, as
+// opposed to the store failing.
+func isRefused(err error) bool {
+	return err == errBlocked || err == errNotRoomMember || err == creditdb.ErrNotFound
+}
+
+// outgoingError maps an error from processOutgoing or checkOutgoing to the
+// HTTP status, code and message a client is told. Anything unexpected is
+// an internal error, whose details stay in the server log.
+func outgoingError(err error) (status int, code, message string) {
+	switch err {
+	case errBroadcastFull, errOverloaded:
+		return http.StatusServiceUnavailable, ErrCodeBusy, "server is busy, retry later"
+	case creditdb.ErrNotFound:
+		return http.StatusNotFound, ErrCodeRoomNotFound, "room not found"
+	case errNotRoomMember:
+		return http.StatusForbidden, ErrCodeNotRoomMember, err.Error()
+	case errBlocked:
+		return http.StatusForbidden, ErrCodeBlocked, err.Error()
+	}
+	return http.StatusInternalServerError, ErrCodeInternal, "failed to store message"
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestRESTErrorCodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		code   string
+		// configure, if set, runs before the server starts.
+		configure func(t *testing.T)
+		// request sets up ts and returns the request that should fail.
+		request func(t *testing.T, ts *testServer) (method, path string, body any)
+	}{
+		{"invalid request", http.StatusBadRequest, ErrCodeInvalidRequest, nil, func(t *testing.T, ts *testServer) (string, string, any) {
+			return http.MethodPost, "/send", map[string]any{"sender": newTestUser("alice"), "recipient": newTestUser("bob"), "content": ""}
+		}},
+		{"forbidden", http.StatusForbidden, ErrCodeForbidden, nil, func(t *testing.T, ts *testServer) (string, string, any) {
+			alice, bob := newTestUser("alice"), newTestUser("bob")
+			msg := ts.send(t, alice, bob, "not bob's to delete")
+			return http.MethodDelete, "/messages/" + msg.ID + "?sender=" + bob + "&recipient=" + alice, nil
+		}},
+		{"not found", http.StatusNotFound, ErrCodeNotFound, nil, func(t *testing.T, ts *testServer) (string, string, any) {
+			return http.MethodDelete, "/messages/missing?sender=" + newTestUser("alice") + "&recipient=" + newTestUser("bob"), nil
+		}},
+		{"rate limited", http.StatusTooManyRequests, ErrCodeRateLimited, func(t *testing.T) {
+			oldLimit, oldBurst := sendRateLimit, sendRateBurst
+			sendRateLimit, sendRateBurst = 0.01, 1
+			t.Cleanup(func() { sendRateLimit, sendRateBurst = oldLimit, oldBurst })
+		}, func(t *testing.T, ts *testServer) (string, string, any) {
+			alice, bob := newTestUser("alice"), newTestUser("bob")
+			ts.send(t, alice, bob, "uses the burst")
+			return http.MethodPost, "/send", map[string]any{"sender": alice, "recipient": bob, "content": "over the limit"}
+		}},
+		{"server busy", http.StatusServiceUnavailable, ErrCodeBusy, nil, func(t *testing.T, ts *testServer) (string, string, any) {
+			old := globalLimiter
+			globalLimiter = rate.NewLimiter(rate.Every(time.Hour), 0)
+			t.Cleanup(func() { globalLimiter = old })
+			return http.MethodPost, "/send", map[string]any{"sender": newTestUser("alice"), "recipient": newTestUser("bob"), "content": "shed"}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.configure != nil {
+				tt.configure(t)
+			}
+			ts := newTestServer(t)
+			method, path, body := tt.request(t, ts)
+			var answer struct {
+				Code  string `json:"code"`
+				Error string `json:"error"`
+			}
+			if status := ts.do(t, method, path, body, &answer); status != tt.status || answer.Code != tt.code || answer.Error == "" {
+				t.Fatalf("%s %s = %d %+v, want %d with code %q and a message", method, path, status, answer, tt.status, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import "time"
+
+// Event types written over the WebSocket alongside chat messages.
+const (
+	EventMessage = "message"
+	EventTyping  = "typing"
+	EventAck     = "ack"
+	EventRead    = "read"
+	EventError   = "error"
+	EventDeleted = "deleted"
+	EventEdited  = "edited"
+
+	EventConversationDeleted = "conversation_deleted"
+
+	EventHistoryEnd = "history_end"
+
+	EventPresence    = "presence"
+	EventSubscribe   = "subscribe"
+	EventUnsubscribe = "unsubscribe"
+	EventSession     = "session"
+	EventGap         = "gap"
+)
+
+// Close codes the server ends a connection with, besides the RFC 6455 ones
+// it also uses: 1001 on shutdown, 1008 for a bad handshake, 1009 for an
+// oversized frame and 1011 for internal errors. Clients should reconnect
+// after 1001 and 1011, and after 4000 once they are active again.
+const (
+	CloseIdleTimeout  = 4000
+	CloseUnauthorized = 4001
+	CloseKicked       = 4003
+	CloseRateLimited  = 4008
+)
+
+// Ack tells a sender what happened to one of their messages: delivered to
+// a live connection of the recipient, or stored for later.
+type Ack struct {
+	Type      string `json:"type"`
+	MessageID string `json:"messageId,omitempty"`
+	Status    string `json:"status"`
+}
+
+// ReadReceipt tells a sender that reader has read some of their messages.
+type ReadReceipt struct {
+	Type       string    `json:"type"`
+	Reader     string    `json:"reader"`
+	MessageIDs []string  `json:"messageIds"`
+	ReadAt     time.Time `json:"readAt"`
+}
+
+// ErrorEvent reports a recoverable problem with a frame the client sent.
+// REST endpoints answer errors with the same code, see respondError.
+type ErrorEvent struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// HistoryEnd marks the end of the replay on connect. Every frame after it
+// is live. Omitted counts undelivered messages that were over the replay
+// caps and must be fetched from history.
+type HistoryEnd struct {
+	Type    string `json:"type"`
+	Count   int    `json:"count"`
+	Omitted int    `json:"omitted,omitempty"`
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportHistory streams every direct conversation of ?user= as one JSON
+// document:
+//
+//	{"user":"alice","exportedAt":"...","conversations":[
+//	  {"peer":"bob","messages":[...]}, ...]}
+//
+// ?user= defaults to the caller. The caller must be authenticated as that
+// user, or come in through /admin; with authentication disabled only the
+// admin route works. Room histories are not included. Conversations are
+// read a history page at a time, so memory use does not grow with the
+// export. If reading fails part way the document is left unterminated,
+// which a client detects as invalid JSON.
+func (r *Router) exportHistory(c *gin.Context) {
+	caller := c.GetString(authUserKey)
+	requested := c.Query("user")
+	if requested == "" {
+		requested = caller
+	}
+	user, err := normalizeUserID(requested)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "user: "+err.Error())
+		return
+	}
+	if !c.GetBool(adminKey) {
+		if caller == "" {
+			respondError(c, http.StatusUnauthorized, ErrCodeUnauthorized, "exporting history requires authentication")
+			return
+		}
+		if caller != user {
+			respondError(c, http.StatusForbidden, ErrCodeForbidden, "users may only export their own history")
+			return
+		}
+	}
+	partners, err := r.dbclient.ConversationPartners(c, user)
+	if err != nil {
+		logger.Error("export failed", "event", "export", "user", user, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to export history")
+		return
+	}
+	c.Header("Content-Type", "application/json")
+	c.Header("Content-Disposition", `attachment; filename="`+user+`-export.json"`)
+	c.Status(http.StatusOK)
+	if err := r.dbclient.writeExport(c, c.Writer, user, partners); err != nil {
+		logger.Error("export failed", "event", "export", "user", user, "error", err)
+	}
+}
+
+// writeExport writes the export document to w. Writes go through a
+// bufio.Writer, whose first error sticks and is returned by Flush, so only
+// the encoder and the reads need checking along the way.
+func (db *DBClient) writeExport(ctx context.Context, w io.Writer, user string, partners []string) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	bw.WriteString(`{"user":`)
+	enc.Encode(user)
+	bw.WriteString(`,"exportedAt":`)
+	enc.Encode(time.Now())
+	bw.WriteString(`,"conversations":[`)
+	for i, peer := range partners {
+		if i > 0 {
+			bw.WriteString(",")
+		}
+		bw.WriteString(`{"peer":`)
+		enc.Encode(peer)
+		bw.WriteString(`,"messages":[`)
+		first := true
+		err := db.eachHistoryPage(ctx, conversationKey(user, peer), func(page []Message) error {
+			for _, m := range page {
+				if !first {
+					bw.WriteString(",")
+				}
+				first = false
+				if err := enc.Encode(m); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			bw.Flush()
+			return err
+		}
+		bw.WriteString("]}")
+	}
+	bw.WriteString("]}\n")
+	return bw.Flush()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// exportDocument is the body of /export.
+type exportDocument struct {
+	User          string `json:"user"`
+	Conversations []struct {
+		Peer     string    `json:"peer"`
+		Messages []Message `json:"messages"`
+	} `json:"conversations"`
+}
+
+func TestExportRequiresAuth(t *testing.T) {
+	const secret = "hmac-secret"
+	withAdminToken(t, "admin-secret")
+	signedAs := func(user string) http.Header {
+		return http.Header{"X-User-Id": {user}, "X-User-Signature": {SignUserID(secret, user)}}
+	}
+	tests := []struct {
+		name   string
+		hmac   bool
+		path   string
+		header func(user string) http.Header
+		status int
+	}{
+		{"no auth", false, "/export", func(string) http.Header { return nil }, http.StatusUnauthorized},
+		{"no auth, admin route", false, "/admin/export", func(string) http.Header {
+			return http.Header{"X-Admin-Token": {"admin-secret"}}
+		}, http.StatusOK},
+		{"wrong admin token", false, "/admin/export", func(string) http.Header {
+			return http.Header{"X-Admin-Token": {"guess"}}
+		}, http.StatusUnauthorized},
+		{"other user", true, "/export", func(string) http.Header { return signedAs("mallory") }, http.StatusForbidden},
+		{"the user", true, "/export", signedAs, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			if tt.hmac {
+				ts = newTestServerWith(t, NewHMACAuthMiddleware(secret))
+			}
+			alice, bob := newTestUser("alice"), newTestUser("bob")
+			if status := ts.doWith(t, http.MethodPost, "/send", signedAs(bob), map[string]any{"sender": bob, "recipient": alice, "content": "hello"}, nil); status != http.StatusOK {
+				t.Fatalf("send: %d", status)
+			}
+			var doc exportDocument
+			var out any = &doc
+			if tt.status != http.StatusOK {
+				out = nil
+			}
+			path := tt.path + "?" + url.Values{"user": {alice}}.Encode()
+			if status := ts.doWith(t, http.MethodGet, path, tt.header(alice), nil, out); status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			if tt.status == http.StatusOK && (doc.User != alice || len(doc.Conversations) != 1 || doc.Conversations[0].Peer != bob) {
+				t.Fatalf("export = %+v, want alice's conversation with bob", doc)
+			}
+		})
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	const secret = "hmac-secret"
+	// Two messages a page, so a conversation spans pages.
+	withHistoryPageSize(t, 2)
+	ts := newTestServerWith(t, NewHMACAuthMiddleware(secret))
+	signedAs := func(user string) http.Header {
+		return http.Header{"X-User-Id": {user}, "X-User-Signature": {SignUserID(secret, user)}}
+	}
+	alice, bob, carol := newTestUser("alice"), newTestUser("bob"), newTestUser("carol")
+	for _, m := range []struct{ sender, recipient, content string }{
+		{alice, bob, "one"},
+		{bob, alice, "two"},
+		{alice, bob, "three \"quoted\""},
+		{carol, alice, "four"},
+		{bob, carol, "not alice's"},
+	} {
+		body := map[string]any{"recipient": m.recipient, "content": m.content}
+		if status := ts.doWith(t, http.MethodPost, "/send", signedAs(m.sender), body, nil); status != http.StatusOK {
+			t.Fatalf("send %s -> %s: %d", m.sender, m.recipient, status)
+		}
+	}
+
+	// Without ?user= the caller's own history is exported.
+	req, err := http.NewRequest(http.MethodGet, ts.http.URL+"/export", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = signedAs(alice)
+	resp, err := ts.http.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Disposition") != `attachment; filename="`+alice+`-export.json"` {
+		t.Fatalf("export = %d with Content-Disposition %q", resp.StatusCode, resp.Header.Get("Content-Disposition"))
+	}
+	var doc exportDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.User != alice {
+		t.Fatalf("export is of %q, want %s", doc.User, alice)
+	}
+	var peers []string
+	for _, conv := range doc.Conversations {
+		peers = append(peers, conv.Peer)
+		if want := ts.history(t, alice, conv.Peer); !reflect.DeepEqual(conv.Messages, want) {
+			t.Fatalf("exported conversation with %s = %+v, want the stored %+v", conv.Peer, conv.Messages, want)
+		}
+	}
+	want := []string{bob, carol}
+	sort.Strings(peers)
+	sort.Strings(want)
+	if !reflect.DeepEqual(peers, want) {
+		t.Fatalf("exported conversations with %v, want %v", peers, want)
+	}
+	if n := len(doc.Conversations[0].Messages) + len(doc.Conversations[1].Messages); n != 4 {
+		t.Fatalf("export holds %d messages, want 4", n)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/creditdb/go-creditdb"
+	"github.com/gin-gonic/gin"
+)
+
+// readinessKey is read by Ping. It never needs to exist, a not-found answer
+// proves the DB is reachable.
+const readinessKey = "health:ready"
+
+var startTime = time.Now()
+
+var errNoDB = errors.New("creditdb client is not connected")
+
+// degradedModeEnabled keeps WebSockets and live delivery working while
+// creditdb is unavailable. Presence and persistence failures are logged and
+// skipped instead of failing the connection or the send.
+var degradedModeEnabled = os.Getenv("DEGRADED_MODE_ENABLED") == "true"
+
+// dbHealthy records whether the last creditdb call succeeded.
+var dbHealthy atomic.Bool
+
+func init() {
+	dbHealthy.Store(true)
+}
+
+// health reports that the process is alive, and whether it is running
+// without a working DB.
+func (r *Router) health(c *gin.Context) {
+	body := gin.H{
+		"status": "ok",
+		"uptime": time.Since(startTime).Round(time.Second).String(),
+	}
+	if degradedModeEnabled {
+		body["degraded"] = !dbHealthy.Load()
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// ready reports whether the server can reach creditdb.
+func (r *Router) ready(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c, 2*time.Second)
+	defer cancel()
+	if err := r.dbclient.Ping(ctx); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// Ping does a round-trip to creditdb.
+func (db *DBClient) Ping(ctx context.Context) error {
+	if _, err := db.getLine(ctx, readinessKey); err != nil && err != creditdb.ErrNotFound {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestHealthAndReady(t *testing.T) {
+	tests := []struct {
+		name   string
+		dbDown bool
+		ready  int
+	}{
+		{"healthy", false, http.StatusOK},
+		{"db down", true, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			if tt.dbDown {
+				ts.store.FailCall(ts.store.Calls()+1, errors.New("connection refused"))
+			}
+			var ready struct{ Status, Error string }
+			if status := ts.do(t, http.MethodGet, "/ready", nil, &ready); status != tt.ready {
+				t.Fatalf("/ready = %d %+v, want %d", status, ready, tt.ready)
+			}
+			if tt.dbDown && ready.Error == "" {
+				t.Fatal("/ready gives no error while the db is down")
+			}
+			// Liveness does not depend on the db.
+			var health struct{ Status string }
+			if status := ts.do(t, http.MethodGet, "/health", nil, &health); status != http.StatusOK || health.Status != "ok" {
+				t.Fatalf("/health = %d %+v, want 200 ok", status, health)
+			}
+		})
+	}
+}
+
+func TestDegradedModeKeepsLiveChat(t *testing.T) {
+	old := degradedModeEnabled
+	degradedModeEnabled = true
+	t.Cleanup(func() {
+		degradedModeEnabled = old
+		dbHealthy.Store(true)
+	})
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	ts.store.FailAll(errors.New("connection refused"))
+	t.Cleanup(func() { ts.store.FailAll(nil) })
+
+	aliceConn, _ := ts.dial(t, alice)
+	bobConn, _ := ts.dial(t, bob)
+	sent := ts.send(t, alice, bob, "over http")
+	if frame := readUntil(t, bobConn, EventMessage); frame["id"] != sent.ID {
+		t.Fatalf("bob got %v, want %s", frame["id"], sent.ID)
+	}
+	if err := bobConn.WriteJSON(map[string]any{"type": EventMessage, "recipient": alice, "content": "over ws"}); err != nil {
+		t.Fatal(err)
+	}
+	// alice's own message is echoed to her as well.
+	for {
+		if frame := readUntil(t, aliceConn, EventMessage); frame["sender"] == bob {
+			if frame["content"] != "over ws" {
+				t.Fatalf("alice got %v, want the frame bob sent", frame)
+			}
+			break
+		}
+	}
+
+	var health struct {
+		Status   string
+		Degraded bool
+	}
+	if status := ts.do(t, http.MethodGet, "/health", nil, &health); status != http.StatusOK || !health.Degraded {
+		t.Fatalf("/health = %d %+v, want 200 and degraded", status, health)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/creditdb/go-creditdb"
+)
+
+// Conversation and room histories are split into pages of historyPageSize
+// messages, so that storing a message rewrites only the newest page instead
+// of the whole history. Under a history key k:
+//
+//	k:pages    {"first":F,"last":L}, the live page numbers
+//	k:page:N   the messages of page N, oldest first
+//
+// Every page but the last is full, less the messages deleted from it since.
+// Histories written before paging are a single blob under k itself; they
+// are read as they are and converted to pages on their next write.
+//
+// Callers must hold keyLocks for k around any write.
+var historyPageSize = envInt("HISTORY_PAGE_SIZE", 100)
+
+const (
+	historyMetaSuffix = ":pages"
+	historyPageInfix  = ":page:"
+)
+
+type historyMeta struct {
+	First int `json:"first"`
+	Last  int `json:"last"`
+}
+
+func historyMetaKey(key string) string {
+	return key + historyMetaSuffix
+}
+
+func historyPageKey(key string, n int) string {
+	return key + historyPageInfix + strconv.Itoa(n)
+}
+
+// historyKeyOf returns the history key a stored line belongs to, for
+// lines that are the entry point of a history: its page index, or a
+// history not yet converted to pages.
+func historyKeyOf(line string) (string, bool) {
+	if key, ok := strings.CutSuffix(line, historyMetaSuffix); ok {
+		return key, true
+	}
+	if strings.Contains(line, historyPageInfix) {
+		return "", false
+	}
+	if strings.HasPrefix(line, conversationPrefix) || strings.HasPrefix(line, "room:") && strings.HasSuffix(line, ":messages") {
+		return line, true
+	}
+	return "", false
+}
+
+// loadHistoryMeta returns the page index of key, or ok false if the
+// history has no pages yet.
+func (db *DBClient) loadHistoryMeta(ctx context.Context, key string) (meta historyMeta, ok bool, err error) {
+	line, err := db.getLine(ctx, historyMetaKey(key))
+	if err == creditdb.ErrNotFound {
+		return historyMeta{}, false, nil
+	}
+	if err != nil {
+		return historyMeta{}, false, err
+	}
+	if err := json.Unmarshal([]byte(line.Value), &meta); err != nil {
+		return historyMeta{}, false, err
+	}
+	return meta, true, nil
+}
+
+func (db *DBClient) saveHistoryMeta(ctx context.Context, key string, meta historyMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return db.setLine(ctx, historyMetaKey(key), string(data))
+}
+
+// loadHistory returns the whole history under key, oldest first. A history
+// that was never written is empty.
+func (db *DBClient) loadHistory(ctx context.Context, key string) ([]Message, error) {
+	messages := []Message{}
+	err := db.eachHistoryPage(ctx, key, func(page []Message) error {
+		messages = append(messages, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// eachHistoryPage calls fn with the history under key a page at a time,
+// oldest first, so that long histories can be processed without holding
+// them in memory.
+func (db *DBClient) eachHistoryPage(ctx context.Context, key string, fn func([]Message) error) error {
+	meta, ok, err := db.loadHistoryMeta(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		legacy, err := db.loadConversation(ctx, key)
+		if err != nil {
+			return err
+		}
+		return fn(legacy)
+	}
+	for n := meta.First; n <= meta.Last; n++ {
+		page, err := db.loadConversation(ctx, historyPageKey(key, n))
+		if err != nil {
+			return err
+		}
+		if err := fn(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendHistory adds msg to the history under key and reports whether the
+// history was empty before. Once the history exceeds maxStoredMessages its
+// oldest page is dropped, so up to historyPageSize-1 extra messages are
+// kept.
+func (db *DBClient) appendHistory(ctx context.Context, key string, msg Message) (first bool, err error) {
+	meta, ok, err := db.loadHistoryMeta(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		legacy, err := db.loadConversation(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		return len(legacy) == 0, db.saveHistory(ctx, key, append(legacy, msg))
+	}
+
+	page, err := db.loadConversation(ctx, historyPageKey(key, meta.Last))
+	if err != nil {
+		return false, err
+	}
+	metaChanged := false
+	if len(page) >= historyPageSize {
+		meta.Last++
+		page = nil
+		metaChanged = true
+	}
+	if err := db.saveConversation(ctx, historyPageKey(key, meta.Last), append(page, msg)); err != nil {
+		return false, err
+	}
+	if err := db.cacheLastMessage(ctx, key, []Message{msg}); err != nil {
+		return false, err
+	}
+	var dropped []int
+	for meta.First < meta.Last && (meta.Last-meta.First-1)*historyPageSize+len(page)+1 >= maxStoredMessages {
+		dropped = append(dropped, meta.First)
+		meta.First++
+		metaChanged = true
+	}
+	if metaChanged {
+		if err := db.saveHistoryMeta(ctx, key, meta); err != nil {
+			return false, err
+		}
+	}
+	for _, n := range dropped {
+		if err := db.deleteQuietly(ctx, historyPageKey(key, n)); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// saveHistory replaces the history under key with messages, trimmed to
+// maxStoredMessages and paged from scratch.
+func (db *DBClient) saveHistory(ctx context.Context, key string, messages []Message) error {
+	old, hadPages, err := db.loadHistoryMeta(ctx, key)
+	if err != nil {
+		return err
+	}
+	messages = trimHistory(messages)
+	meta := historyMeta{}
+	if hadPages {
+		meta.First = old.First
+	}
+	meta.Last = meta.First
+	for start := 0; start < len(messages) || start == 0; start += historyPageSize {
+		end := min(start+historyPageSize, len(messages))
+		meta.Last = meta.First + start/historyPageSize
+		if err := db.saveConversation(ctx, historyPageKey(key, meta.Last), messages[start:end]); err != nil {
+			return err
+		}
+	}
+	if err := db.saveHistoryMeta(ctx, key, meta); err != nil {
+		return err
+	}
+	if err := db.cacheLastMessage(ctx, key, messages); err != nil {
+		return err
+	}
+	if !hadPages {
+		return db.deleteQuietly(ctx, key)
+	}
+	for n := meta.Last + 1; n <= old.Last; n++ {
+		if err := db.deleteQuietly(ctx, historyPageKey(key, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFromHistory deletes the message id from the history under key,
+// rewriting only the page that holds it, after check accepts it. It
+// returns errMessageNotFound if there is no such message.
+func (db *DBClient) removeFromHistory(ctx context.Context, key, id string, check func(Message) error) error {
+	meta, ok, err := db.loadHistoryMeta(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		legacy, err := db.loadConversation(ctx, key)
+		if err != nil {
+			return err
+		}
+		kept, err := withoutMessage(legacy, id, check)
+		if err != nil {
+			return err
+		}
+		return db.saveHistory(ctx, key, kept)
+	}
+	// Deletes mostly concern recent messages, so look from the newest page.
+	for n := meta.Last; n >= meta.First; n-- {
+		page, err := db.loadConversation(ctx, historyPageKey(key, n))
+		if err != nil {
+			return err
+		}
+		kept, err := withoutMessage(page, id, check)
+		if errors.Is(err, errMessageNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := db.saveConversation(ctx, historyPageKey(key, n), kept); err != nil {
+			return err
+		}
+		if n != meta.Last {
+			return nil
+		}
+		return db.recacheLastMessage(ctx, key, meta, kept)
+	}
+	return errMessageNotFound
+}
+
+// withoutMessage returns messages without the one with id, after check
+// accepts it, or errMessageNotFound.
+func withoutMessage(messages []Message, id string, check func(Message) error) ([]Message, error) {
+	for i := range messages {
+		if messages[i].ID != id {
+			continue
+		}
+		if err := check(messages[i]); err != nil {
+			return nil, err
+		}
+		return append(messages[:i:i], messages[i+1:]...), nil
+	}
+	return nil, errMessageNotFound
+}
+
+// recacheLastMessage updates the last-message cache of key after its last
+// page changed to last, looking back through older pages if it is empty.
+func (db *DBClient) recacheLastMessage(ctx context.Context, key string, meta historyMeta, last []Message) error {
+	if !strings.HasPrefix(key, conversationPrefix) {
+		return nil
+	}
+	for n := meta.Last - 1; len(last) == 0 && n >= meta.First; n-- {
+		page, err := db.loadConversation(ctx, historyPageKey(key, n))
+		if err != nil {
+			return err
+		}
+		last = page
+	}
+	return db.cacheLastMessage(ctx, key, last)
+}
+
+// deleteHistory removes every page of the history under key.
+func (db *DBClient) deleteHistory(ctx context.Context, key string) error {
+	meta, ok, err := db.loadHistoryMeta(ctx, key)
+	if err != nil {
+		return err
+	}
+	if ok {
+		for n := meta.First; n <= meta.Last; n++ {
+			if err := db.deleteQuietly(ctx, historyPageKey(key, n)); err != nil {
+				return err
+			}
+		}
+		if err := db.deleteQuietly(ctx, historyMetaKey(key)); err != nil {
+			return err
+		}
+	}
+	if err := db.cacheLastMessage(ctx, key, nil); err != nil {
+		return err
+	}
+	return db.deleteQuietly(ctx, key)
+}
+
+// lastMessageKey caches the newest message of the direct conversation
+// stored under key, so that listing conversations reads one small line
+// per conversation instead of its whole history.
+func lastMessageKey(key string) string {
+	return "lastmsg:" + key
+}
+
+// cacheLastMessage points the last-message cache of key at the end of
+// messages, or removes it when there are none. Only direct conversations
+// are cached. Like the pages, the cached message is encrypted at rest.
+func (db *DBClient) cacheLastMessage(ctx context.Context, key string, messages []Message) error {
+	if !strings.HasPrefix(key, conversationPrefix) {
+		return nil
+	}
+	if len(messages) == 0 {
+		return db.deleteQuietly(ctx, lastMessageKey(key))
+	}
+	return db.saveConversation(ctx, lastMessageKey(key), messages[len(messages)-1:])
+}
+
+// lastMessage returns the newest message of the direct conversation under
+// key. Conversations last written before the cache existed are read in
+// full.
+func (db *DBClient) lastMessage(ctx context.Context, key string) (Message, bool, error) {
+	cached, err := db.loadConversation(ctx, lastMessageKey(key))
+	if err != nil {
+		return Message{}, false, err
+	}
+	if len(cached) == 0 {
+		if cached, err = db.loadHistory(ctx, key); err != nil {
+			return Message{}, false, err
+		}
+	}
+	if len(cached) == 0 {
+		return Message{}, false, nil
+	}
+	return cached[len(cached)-1], true, nil
+}
+
+// deleteQuietly deletes key, treating a key that is already gone as done.
+func (db *DBClient) deleteQuietly(ctx context.Context, key string) error {
+	if err := db.deleteLine(ctx, key); err != nil && err != creditdb.ErrNotFound {
+		return err
+	}
+	return nil
+}
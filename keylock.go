@@ -0,0 +1,41 @@
+package main
+
+import "sync"
+
+// keyLocks serializes read-modify-write cycles on a creditdb key within this
+// process. creditdb has no compare-and-set, so concurrent updates of a
+// shared key such as online_users would otherwise lose writes.
+var keyLocks = &keyMutex{locks: make(map[string]*refMutex)}
+
+type refMutex struct {
+	mu   sync.Mutex
+	refs int
+}
+
+type keyMutex struct {
+	mu    sync.Mutex
+	locks map[string]*refMutex
+}
+
+// lock acquires the lock for key and returns the function releasing it.
+func (k *keyMutex) lock(key string) (unlock func()) {
+	k.mu.Lock()
+	m, ok := k.locks[key]
+	if !ok {
+		m = &refMutex{}
+		k.locks[key] = m
+	}
+	m.refs++
+	k.mu.Unlock()
+
+	m.mu.Lock()
+	return func() {
+		m.mu.Unlock()
+		k.mu.Lock()
+		m.refs--
+		if m.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
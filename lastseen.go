@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/creditdb/go-creditdb"
+)
+
+// Last seen is when a user last showed activity: a frame or ping sent, a
+// pong answered, or a presence post. Connections keep it in memory as
+// Client.seen and write it on every heartbeat and on disconnect, so the
+// stored value is at most pingInterval behind while a user is online.
+
+func lastSeenKey(user string) string {
+	return "lastseen:" + keyPart(user)
+}
+
+// markSeen records client-originated activity on the connection.
+func (c *Client) markSeen() {
+	c.seen.Store(time.Now().UnixNano())
+}
+
+func (c *Client) seenAt() time.Time {
+	return time.Unix(0, c.seen.Load())
+}
+
+// LastSeen returns when user was last seen, or ok false if never.
+func (db *DBClient) LastSeen(ctx context.Context, user string) (seen time.Time, ok bool, err error) {
+	line, err := db.getLine(ctx, lastSeenKey(user))
+	if err == creditdb.ErrNotFound {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	seen, err = time.Parse(time.RFC3339Nano, line.Value)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return seen, true, nil
+}
+
+// UpdateLastSeen moves user's last seen time forward to at. An older at,
+// such as from a second connection that has been quiet, is ignored.
+func (db *DBClient) UpdateLastSeen(ctx context.Context, user string, at time.Time) error {
+	key := lastSeenKey(user)
+	defer keyLocks.lock(key)()
+	seen, ok, err := db.LastSeen(ctx, user)
+	if err != nil {
+		return err
+	}
+	if ok && !at.After(seen) {
+		return nil
+	}
+	return db.setLine(ctx, key, at.UTC().Format(time.RFC3339Nano))
+}
+
+// lastSeenOf returns user's last seen time for a presence event, or nil if
+// it is unknown or cannot be read.
+func lastSeenOf(db *DBClient, user string) *time.Time {
+	seen, ok, err := db.LastSeen(context.Background(), user)
+	if err != nil {
+		logger.Warn("load last seen failed", "event", "presence", "user", user, "error", err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	return &seen
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ayo-ajayi/realtime-chat-creditdb-websocket/storetest"
+	"github.com/gorilla/websocket"
+)
+
+func TestLastSeenIsRecordedOnDisconnect(t *testing.T) {
+	ts := newTestServer(t)
+	watcher, bob := newTestUser("watcher"), newTestUser("bob")
+	// online returns bob's /online/:user answer.
+	online := func() (bool, *time.Time) {
+		t.Helper()
+		var answer struct {
+			Online   bool       `json:"online"`
+			LastSeen *time.Time `json:"lastSeen"`
+		}
+		if status := ts.do(t, http.MethodGet, "/online/"+bob, nil, &answer); status != http.StatusOK {
+			t.Fatalf("/online/%s: status %d", bob, status)
+		}
+		return answer.Online, answer.LastSeen
+	}
+	if on, seen := online(); on || seen != nil {
+		t.Fatalf("before connecting: online %v, last seen %v, want offline and never seen", on, seen)
+	}
+	watcherConn, _ := ts.dial(t, watcher)
+	if err := watcherConn.WriteJSON(PresenceSubscription{Type: EventSubscribe, Users: []string{bob}}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, watcherConn, EventPresence)
+
+	bobConn, _ := ts.dial(t, bob)
+	readUntil(t, watcherConn, EventPresence)
+	// A ping is activity, and no heartbeat runs before the disconnect, so
+	// only the disconnect can store a time after it.
+	active := time.Now()
+	ponged := make(chan struct{})
+	bobConn.SetPongHandler(func(string) error {
+		close(ponged)
+		return nil
+	})
+	go bobConn.ReadMessage()
+	if err := bobConn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ponged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no pong")
+	}
+	bobConn.Close()
+	closed := time.Now()
+
+	frame := readUntil(t, watcherConn, EventPresence)
+	if frame["status"] != PresenceOffline || frame["lastSeen"] == nil {
+		t.Fatalf("presence event %v, want offline with a last seen time", frame)
+	}
+	on, seen := online()
+	if on || seen == nil || seen.Before(active) || seen.After(closed) {
+		t.Fatalf("after disconnecting: online %v, last seen %v, want offline and seen between %v and %v", on, seen, active, closed)
+	}
+	if got, err := time.Parse(time.RFC3339Nano, frame["lastSeen"].(string)); err != nil || !got.Equal(*seen) {
+		t.Fatalf("presence event last seen %v, want %v", frame["lastSeen"], seen)
+	}
+}
+
+func TestUpdateLastSeenOnlyMovesForward(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		updates []time.Time
+		want    time.Time
+	}{
+		{"first", []time.Time{at}, at},
+		{"later", []time.Time{at, at.Add(time.Minute)}, at.Add(time.Minute)},
+		{"earlier is ignored", []time.Time{at, at.Add(-time.Minute)}, at},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := NewDBClientFromStore(storetest.NewMemStore())
+			ctx := context.Background()
+			for _, update := range tt.updates {
+				if err := db.UpdateLastSeen(ctx, "alice", update); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if seen, ok, err := db.LastSeen(ctx, "alice"); err != nil || !ok || !seen.Equal(tt.want) {
+				t.Fatalf("LastSeen = %v, %v, %v, want %v", seen, ok, err, tt.want)
+			}
+		})
+	}
+}
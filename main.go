@@ -2,290 +2,1607 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/creditdb/go-creditdb"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/time/rate"
 	"syscall"
 )
 
 type DBClient struct {
-	*creditdb.CreditDB
+	Store
 }
 type Message struct {
-	Sender    string    `json:"sender"`
-	Recipient string    `json:"recipient"`
-	Content   string    `json:"content"`
-	Timestamp time.Time `json:"timestamp"`
+	// Type routes the frame; empty or EventMessage is a chat message.
+	Type string `json:"type,omitempty"`
+	ID   string `json:"id"`
+	// Seq orders the messages of a conversation or room. It increases by
+	// one per stored message; clients should sort by it, not Timestamp.
+	Seq       int64      `json:"seq,omitempty"`
+	Sender    string     `json:"sender"`
+	Recipient string     `json:"recipient"`
+	Content   string     `json:"content"`
+	Timestamp time.Time  `json:"timestamp"`
+	Status    string     `json:"status,omitempty"`
+	ReadAt    *time.Time `json:"readAt,omitempty"`
+	EditedAt  *time.Time `json:"editedAt,omitempty"`
+	// RoomID, when set, routes the message to every member of the room
+	// instead of to Recipient.
+	RoomID      string       `json:"roomId,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Ephemeral messages are only delivered live: they are never stored,
+	// queued for offline recipients or replayed.
+	Ephemeral bool `json:"ephemeral,omitempty"`
+	// TTL, in seconds, is set by the sender of a disappearing message.
+	// The server derives ExpiresAt from it, see ttl.go.
+	TTL       int64      `json:"ttl,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// originConn is the ID of the connection a WebSocket message arrived
+	// on. It is never serialized.
+	originConn string
 }
 
+// Message delivery statuses.
+const (
+	StatusSent      = "sent"
+	StatusDelivered = "delivered"
+	StatusStored    = "stored"
+	// StatusDropped is an ephemeral message nobody was online to receive.
+	StatusDropped = "dropped"
+)
+
 type Router struct {
 	engine   *gin.Engine
 	dbclient *DBClient
 }
 type Client struct {
+	id   string
+	user string
 	conn *websocket.Conn
+	// format is the frame encoding the client asked for, see codec.go.
+	format string
+	// writeMu serializes writes, gorilla/websocket allows only one
+	// concurrent writer per connection.
+	writeMu sync.Mutex
+	// lastActive is when a data frame or a client ping last went either
+	// way, in Unix nanoseconds.
+	lastActive atomic.Int64
+	// seen is when the client itself last sent anything, see lastseen.go.
+	seen atomic.Int64
+	// kicked is set by /admin/kick, so that the session is not kept
+	// resumable after its connection closes.
+	kicked atomic.Bool
+	// outbox holds live frames until writeQueued writes them, and dropped
+	// counts those discarded since the last gap marker, see outbox.go.
+	outbox  outbox
+	dropped atomic.Int64
+	// written holds the direct messages the client may acknowledge, see
+	// receipt.go.
+	written writtenMessages
+	// finished is closed once handleWS is done with the connection: it is
+	// unregistered and its outbox is closed.
+	finished chan struct{}
+	// timing is read once when the connection opens, see connTiming.
+	timing connTiming
+}
+
+// idleTimeout closes connections that exchange no data frames for this
+// long. The server's own heartbeat does not count, otherwise no connection
+// with a live client would ever be idle. Zero disables it.
+var idleTimeout = envDuration("IDLE_TIMEOUT", 0)
+
+// idleClock is the clock idle time is measured with.
+var idleClock = time.Now
+
+// connTiming holds the heartbeat, write, idle and resume settings of one
+// connection. handleWS copies them from the package variables, so a
+// connection keeps the settings it was opened with.
+type connTiming struct {
+	pingInterval, pongWait, writeWait, idleTimeout, resumeGrace time.Duration
+	clock                                                       func() time.Time
+}
+
+func currentTiming() connTiming {
+	return connTiming{pingInterval: pingInterval, pongWait: pongWait, writeWait: writeWait, idleTimeout: idleTimeout, resumeGrace: resumeGrace, clock: idleClock}
+}
+
+func (c *Client) touch() {
+	c.lastActive.Store(c.timing.clock().UnixNano())
 }
 
-var broadcast = make(chan Message)
-var userConnections = make(map[string]*Client)
+// idleFor returns how long the connection has been idle at now.
+func (c *Client) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, c.lastActive.Load()))
+}
+
+// broadcast queues messages for delivery to live connections. When it is full
+// /send returns 503 without storing the message, so the client can retry, and
+// frames read from a WebSocket are dropped with a warning. A message stored
+// by /send just as the buffer fills up is kept but not delivered live.
+var broadcast = make(chan Message, envInt("BROADCAST_BUFFER", 256))
+var userConnections = make(map[string]map[*Client]bool)
 var userConnectionsMutex = &sync.Mutex{}
+
+// connSlots caps concurrent WebSocket connections so that a burst of clients
+// cannot exhaust file descriptors. A handshake takes a slot and the
+// connection returns it when it closes.
+var connSlots = make(chan struct{}, envInt("MAX_CONNECTIONS", 10000))
+
+// wsCompression negotiates permessage-deflate with clients that offer it.
+// It trades CPU for bandwidth, so it is off by default.
+var wsCompression = os.Getenv("WS_COMPRESSION") == "true"
+
+// handshakeTimeout bounds both reading the request headers and writing the
+// upgrade response, so a slow client cannot tie up a handshake.
+var handshakeTimeout = envDuration("WS_HANDSHAKE_TIMEOUT", 10*time.Second)
+
+// newHTTPServer returns the server for handler, with handshakeTimeout
+// applied to reading request headers.
+func newHTTPServer(addr string, handler http.Handler, tlsConf *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: handshakeTimeout,
+		TLSConfig:         tlsConf,
+	}
+}
+
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	ReadBufferSize:    envInt("WS_READ_BUFFER_SIZE", 1024),
+	WriteBufferSize:   envInt("WS_WRITE_BUFFER_SIZE", 1024),
+	HandshakeTimeout:  handshakeTimeout,
+	CheckOrigin:       checkOrigin,
+	EnableCompression: wsCompression,
+	Subprotocols:      []string{subprotocolChatV1, subprotocolChatV1Compact},
 }
 
-func main() {
-	r := Router{gin.Default(), &DBClient{creditdb.NewClient().WithPage(10)}}
+// subprotocolChatV1 names the current wire format. The upgrader echoes it
+// when the client offers it. Handshakes offering neither subprotocol are
+// refused, so that only clients that know the format can connect, unless
+// WS_REQUIRE_SUBPROTOCOL is false for clients written before it existed.
+// subprotocolChatV1Compact is chat.v1 with the compact message encoding
+// of codec.go.
+const (
+	subprotocolChatV1        = "chat.v1"
+	subprotocolChatV1Compact = "chat.v1.compact"
+)
 
-	router := r.engine
-	router.GET("/ws", r.handleWS)
-	router.POST("/send", r.sendMessage)
-	go broadcastMessages()
+var requireSubprotocol = envChoice("WS_REQUIRE_SUBPROTOCOL", "true", "true", "false") == "true"
 
-	server := &http.Server{
-		Addr:    ":8000",
-		Handler: router,
+// supportsSubprotocol reports whether the handshake offers a subprotocol
+// the server speaks.
+func supportsSubprotocol(r *http.Request) bool {
+	for _, offered := range websocket.Subprotocols(r) {
+		if contains(upgrader.Subprotocols, offered) {
+			return true
+		}
 	}
+	return false
+}
+
+func main() {
+	if err := checkConfig(); err != nil {
+		logger.Error("invalid configuration", "event", "startup", "error", err)
+		os.Exit(1)
+	}
+	addr, err := listenAddr(os.Getenv)
+	if err != nil {
+		logger.Error("invalid configuration", "event", "startup", "error", err)
+		os.Exit(1)
+	}
+	tlsConf, err := tlsConfig(os.Getenv)
+	if err != nil {
+		logger.Error("invalid configuration", "event", "startup", "error", err)
+		os.Exit(1)
+	}
+	if atRest, err = atRestCipher(os.Getenv); err != nil {
+		logger.Error("invalid configuration", "event", "startup", "error", err)
+		os.Exit(1)
+	}
+	if tlsConf == nil {
+		logger.Warn("TLS_CERT_FILE and TLS_KEY_FILE are not set, serving plain HTTP and ws://", "event", "startup")
+	}
+	db, err := NewDBClientFromEnv()
+	if err != nil {
+		if !degradedModeEnabled {
+			logger.Error("creditdb setup failed", "event", "startup", "error", err)
+			os.Exit(1)
+		}
+		logger.Error("creditdb setup failed, starting in degraded mode", "event", "startup", "error", err)
+		db = &DBClient{}
+		dbHealthy.Store(false)
+	}
+	auth, err := authMiddleware(os.Getenv)
+	if err != nil {
+		logger.Error("invalid configuration", "event", "startup", "error", err)
+		os.Exit(1)
+	}
+	if auth == nil {
+		logger.Warn("AUTH_MODE is none, authentication is disabled", "event", "startup")
+	}
+	if os.Getenv(gin.EnvGinMode) == "" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	r := newRouter(db, auth)
+
+	broadcastCtx, stopBroadcast := context.WithCancel(context.Background())
+	defer stopBroadcast()
+	broadcastDone := make(chan struct{})
 	go func() {
+		defer close(broadcastDone)
+		broadcastMessages(broadcastCtx, r.dbclient)
+	}()
+	jobs, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	if retentionPeriod > 0 {
+		go runRetention(jobs, r.dbclient, retentionPeriod, retentionInterval, time.Now)
+	}
+	go runExpirySweeper(jobs, r.dbclient, ttlSweepInterval, time.Now)
+
+	server := newHTTPServer(addr, r.engine, tlsConf)
+	// stopped is closed once shutdown is over, so that main does not exit
+	// as soon as ListenAndServe returns.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
 		stop := make(chan os.Signal, 1)
 		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 		<-stop
+		stopJobs()
 
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 		if err := server.Shutdown(ctx); err != nil {
-			log.Println("Server shutdown error: ", err)
+			logger.Error("server shutdown failed", "event", "shutdown", "error", err)
 			return
 		}
+		stopDelivery(ctx, r.dbclient, stopBroadcast, broadcastDone)
 		if err := r.dbclient.Close(ctx); err != nil {
-			log.Println("DB close error: ", err)
+			logger.Error("db close failed", "event", "shutdown", "error", err)
 			return
 		}
-		log.Println("Server stopped gracefully")
+		logger.Info("server stopped gracefully", "event", "shutdown")
 	}()
-	log.Println("Server is running🎉🎉. Press Ctrl+C to stop")
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
-		log.Println("Server error: ", err)
+	logger.Info("server is running🎉🎉. Press Ctrl+C to stop", "event", "startup", "addr", server.Addr)
+	if tlsConf != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		logger.Error("server failed", "event", "startup", "error", err)
 		return
 	}
+	<-stopped
 }
 
+// newRouter registers every endpoint on a new engine. auth is nil when
+// authentication is disabled.
+func newRouter(db *DBClient, auth gin.HandlerFunc) *Router {
+	r := &Router{newEngine(), db}
+	router := r.engine
+	// Probes are registered before the auth middleware so load balancers
+	// can reach them without a token.
+	router.GET("/health", r.health)
+	router.GET("/ready", r.ready)
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	router.GET("/stats", stats)
+	if adminToken != "" {
+		admin := router.Group("/admin", NewAdminMiddleware(adminToken))
+		admin.POST("/kick", r.kickUser)
+		admin.GET("/export", r.exportHistory)
+		admin.DELETE("/user/:id/data", r.eraseUserData)
+	}
+	if auth != nil {
+		router.Use(auth)
+	}
+	router.GET("/ws", r.handleWS)
+	sendLimit := NewRateLimitMiddleware(sendRateLimit, sendRateBurst)
+	router.POST("/send", sendLimit, r.sendMessage)
+	router.POST("/send-bulk", sendLimit, r.sendBulk)
+	router.GET("/messages", r.getMessages)
+	router.DELETE("/messages/:id", r.deleteMessage)
+	router.PATCH("/messages/:id", r.editMessage)
+	router.GET("/search", r.searchMessages)
+	router.GET("/conversations", r.listConversations)
+	router.DELETE("/conversations", r.deleteConversation)
+	router.POST("/read", r.markRead)
+	router.GET("/unread", r.unreadCounts)
+	router.GET("/receipt/:id", r.getReceipt)
+	router.POST("/rooms", r.createRoom)
+	router.POST("/block", r.blockUser)
+	router.DELETE("/block", r.unblockUser)
+	router.GET("/online", r.onlineUsers)
+	router.GET("/online/:user", r.userOnline)
+	router.POST("/presence", r.setPresence)
+	router.POST("/webhooks", r.registerWebhook)
+	router.GET("/export", r.exportHistory)
+	router.DELETE("/user/:id/data", r.eraseUserData)
+	router.POST("/mute", r.muteConversation)
+	router.DELETE("/mute", r.unmuteConversation)
+	router.DELETE("/webhooks", r.deleteWebhook)
+	return r
+}
+
+// newEngine returns a gin engine whose access log and panic recovery go
+// through logger, so that every line the server writes is JSON. It
+// replaces gin.Default, whose plain-text logger also printed query
+// strings, and with them the JWT of WebSocket handshakes.
+func newEngine() *gin.Engine {
+	engine := gin.New()
+	engine.Use(requestIDMiddleware, accessLog, gin.CustomRecoveryWithWriter(nil, recoverRequest))
+	return engine
+}
+
+// replayPageSize bounds the messages written to a connection before its read
+// loop starts, and replayConversations the conversations and rooms they may
+// come from, so that connecting costs the same however many conversations
+// a user has.
+var (
+	replayPageSize      = envInt("REPLAY_PAGE_SIZE", 50)
+	replayConversations = envInt("REPLAY_MAX_CONVERSATIONS", 20)
+)
+
 func (r *Router) handleWS(c *gin.Context) {
+	select {
+	case connSlots <- struct{}{}:
+		defer func() { <-connSlots }()
+	default:
+		requestLogger(c).Warn("connection limit reached", "event", "ws_upgrade", "max_connections", cap(connSlots))
+		c.Header("Retry-After", "5")
+		respondError(c, http.StatusServiceUnavailable, ErrCodeBusy, "too many connections, retry later")
+		return
+	}
+	if requireSubprotocol && !supportsSubprotocol(c.Request) {
+		requestLogger(c).Warn("no supported subprotocol offered", "event", "ws_upgrade", "offered", websocket.Subprotocols(c.Request))
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "Sec-WebSocket-Protocol must include "+subprotocolChatV1+" or "+subprotocolChatV1Compact)
+		return
+	}
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		log.Println(err)
+		logger.Warn("websocket upgrade failed", "event", "ws_upgrade", "error", err)
 		return
 	}
+	// Deferred first so that it runs last: by the time a panic is logged,
+	// the connection has been cleaned up and closed.
+	defer logPanic("ws", "request_id", c.GetString(requestIDKey))
 	defer conn.Close()
+	conn.EnableWriteCompression(wsCompression)
 	sender := c.Query("sender")
-	recipient := c.Query("recipient")
+	recipient := authenticatedUser(c, c.Query("recipient"))
+	client := &Client{id: uuid.NewString(), user: recipient, conn: conn, format: frameFormat(c.Query("format"), conn.Subprotocol()), outbox: newOutbox(), finished: make(chan struct{}), timing: currentTiming()}
+	defer close(client.finished)
+	client.touch()
+	client.markSeen()
+	connLog := requestLogger(c).With("conn_id", client.id, "sender", sender, "recipient", recipient)
 
-	if sender == "" || recipient == "" {
-		log.Println("sender or recipient is empty")
+	// fail tells the client why the connection is being dropped before the
+	// deferred conn.Close runs, instead of leaving it with a dead socket.
+	fail := func(closeCode int, errCode, reason string) {
+		client.closeWithError(closeCode, errCode, reason)
+	}
+
+	if recipient == "" {
+		connLog.Warn("recipient is empty", "event", "ws_connect")
+		fail(websocket.ClosePolicyViolation, ErrCodeInvalidRequest, "recipient is required")
 		return
 	}
 
 	db := r.dbclient
+	// Presence transitions of a user are serialized so that a deferred
+	// offline transition cannot interleave with a reconnect.
+	presenceLock := presenceKey(recipient)
+	goOffline := func() {
+		defer keyLocks.lock(presenceLock)()
+		if len(connectionsFor(recipient)) > 0 {
+			return
+		}
+		if err := db.SetUserOffline(context.Background(), recipient); err != nil {
+			connLog.Error("set user offline failed", "event", "ws_disconnect", "error", err)
+		}
+		publishPresence(db, recipient, PresenceOffline, lastSeenOf(db, recipient))
+	}
+	resumed := resumeSession(recipient, c.Query("resume"))
+	unlock := keyLocks.lock(presenceLock)
 	if err := db.SetUserOnline(c, recipient); err != nil {
-		log.Println(err)
+		connLog.Error("set user online failed", "event", "ws_connect", "error", err)
+		if !degradedModeEnabled {
+			unlock()
+			fail(websocket.CloseInternalServerErr, ErrCodeInternal, "failed to register presence")
+			return
+		}
+	}
+	if addConnection(recipient, client) && !resumed {
+		now := time.Now()
+		publishPresence(db, recipient, PresenceOnline, &now)
+	}
+	unlock()
+	connLog.Info("connected", "event", "ws_connect", "resumed", resumed)
+	resumeToken := uuid.NewString()
+	defer func() {
+		unsubscribeAll(client)
+		if err := db.UpdateLastSeen(context.Background(), recipient, client.seenAt()); err != nil {
+			connLog.Warn("update last seen failed", "event", "ws_disconnect", "error", err)
+		}
+		last := removeConnection(recipient, client)
+		// Frames still queued were never written; settling them sends
+		// their messages to the offline queue.
+		client.closeOutbox()
+		if last {
+			if client.timing.resumeGrace > 0 && !client.kicked.Load() {
+				deferOffline(recipient, resumeToken, client.timing.resumeGrace, goOffline)
+			} else {
+				goOffline()
+			}
+		}
+		connLog.Info("disconnected", "event", "ws_disconnect")
+	}()
+	if err := client.writeFrame(Session{Type: EventSession, ResumeToken: resumeToken}); err != nil {
+		connLog.Error("session write failed", "event", "ws_connect", "error", err)
 		return
 	}
-	defer db.SetUserOffline(c, recipient)
-	userConnectionsMutex.Lock()
-	userConnections[recipient] = &Client{conn}
-	userConnectionsMutex.Unlock()
 
-	m := Message{Recipient: recipient, Sender: sender}
-	messages, err := db.RetrieveStoredMessages(c,m)
+	// Only messages that missed live delivery are replayed: those of the
+	// replayConversations most recently active conversations, and at most
+	// the latest replayPageSize of them. The rest are available from
+	// /conversations and /messages.
+	messages, err := db.DrainOffline(c, recipient)
 	if err != nil {
-		log.Println(err)
-		return
+		connLog.Error("drain offline queue failed", "event", "ws_replay", "error", err)
+		if !degradedModeEnabled {
+			fail(websocket.CloseInternalServerErr, ErrCodeInternal, "failed to load undelivered messages")
+			return
+		}
+		messages = nil
+	}
+	messages = withoutExpired(messages, time.Now())
+	drained := len(messages)
+	if kept, dropped := capConversations(messages, replayConversations); dropped > 0 {
+		connLog.Info("truncating replay", "event", "ws_replay", "queued", len(messages), "conversations_dropped", dropped)
+		messages = kept
+	}
+	if len(messages) > replayPageSize {
+		connLog.Info("truncating replay", "event", "ws_replay", "queued", len(messages), "replayed", replayPageSize)
+		messages = messages[len(messages)-replayPageSize:]
 	}
+	queued := messages
 
-	for _, message := range messages {
-		jsonMessage, err := json.Marshal(message)
+	// With ?since=, the client also catches up on its conversation with
+	// ?sender= after that cursor, which covers messages it saw on another
+	// device or lost with a dropped connection.
+	if since := c.Query("since"); since != "" && sender != "" {
+		history, err := db.RetrieveStoredMessagesSince(c, Message{Sender: sender, Recipient: recipient}, since, replayPageSize)
 		if err != nil {
-			log.Println(err)
-			return
+			connLog.Error("load history since cursor failed", "event", "ws_replay", "since", since, "error", err)
+		} else {
+			messages = mergeReplay(withoutExpired(history, time.Now()), queued)
+			if len(messages) > replayPageSize {
+				messages = messages[len(messages)-replayPageSize:]
+			}
 		}
-		if err := conn.WriteMessage(websocket.TextMessage, []byte(jsonMessage)); err != nil {
-			log.Println(err)
-			return
+	}
+
+	// The replay is written directly. Live frames queued by Send in the
+	// meantime wait for the writer started after history_end.
+	written, err := client.replay(connLog, messages)
+	ackReplayed(db, fromQueue(messages[:written], queued))
+	if err != nil {
+		// The socket is unusable after a failed write, so there is no
+		// point retrying. Queued messages that were not written go back
+		// to the offline queue; history replayed for ?since= is still
+		// stored. Returning runs the deferred presence cleanup above.
+		connLog.Error("replay write failed", "event", "ws_replay", "written", written, "error", err)
+		if unwritten := fromQueue(messages[written:], queued); len(unwritten) > 0 {
+			if err := db.requeueOffline(context.Background(), recipient, unwritten); err != nil {
+				connLog.Error("requeue offline messages failed", "event", "ws_replay", "error", err)
+			}
 		}
+		return
+	}
+	omitted := drained - len(fromQueue(messages, queued))
+	if err := client.writeFrame(HistoryEnd{Type: EventHistoryEnd, Count: len(messages), Omitted: omitted}); err != nil {
+		connLog.Error("history end write failed", "event", "ws_replay", "error", err)
+		return
 	}
 
-	defer func() {
-		userConnectionsMutex.Lock()
-		delete(userConnections, recipient)
-		userConnectionsMutex.Unlock()
+	conn.SetReadLimit(int64(maxFrameSize))
+	conn.SetReadDeadline(time.Now().Add(client.timing.pongWait))
+	conn.SetPongHandler(func(string) error {
+		client.markSeen()
+		return conn.SetReadDeadline(time.Now().Add(client.timing.pongWait))
+	})
+	conn.SetPingHandler(func(data string) error {
+		client.touch()
+		client.markSeen()
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		if ne, ok := err.(net.Error); err == websocket.ErrCloseSent || ok && ne.Timeout() {
+			return nil
+		}
+		return err
+	})
+	done := make(chan struct{})
+	defer close(done)
+	refresh := func() {
+		if err := db.RefreshPresence(context.Background(), recipient); err != nil {
+			connLog.Warn("refresh presence failed", "event", "heartbeat", "error", err)
+		}
+		if err := db.UpdateLastSeen(context.Background(), recipient, client.seenAt()); err != nil {
+			connLog.Warn("update last seen failed", "event", "heartbeat", "error", err)
+		}
+	}
+	go func() {
+		// Closing the socket ends the read loop below, which cleans up
+		// after a heartbeat that stopped for any reason, panics included.
+		defer conn.Close()
+		defer logPanic("heartbeat", "conn_id", client.id)
+		client.heartbeat(done, refresh)
 	}()
+	go func() {
+		defer conn.Close()
+		defer logPanic("ws_write", "conn_id", client.id)
+		client.writeQueued(done)
+	}()
+	if expires, ok := c.Get(authExpiresKey); ok {
+		expiry := time.AfterFunc(time.Until(expires.(time.Time)), func() {
+			connLog.Info("token expired", "event", "ws_auth")
+			fail(CloseUnauthorized, ErrCodeUnauthorized, "token expired")
+			conn.Close()
+		})
+		defer expiry.Stop()
+	}
+	// Frames share the /send budget. A client that keeps sending past it
+	// is disconnected rather than answered frame by frame.
+	limiter := rate.NewLimiter(rate.Limit(sendRateLimit), sendRateBurst)
+
 	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			logReadError(connLog, err)
+			return
+		}
+		client.touch()
+		client.markSeen()
 		var message Message
-		if err := conn.ReadJSON(&message); err != nil {
-			log.Println(err)
+		// ReadMessage only fails on close and I/O errors, which end the
+		// connection above. A frame that does not decode is the client's
+		// mistake on a healthy socket, so it gets an error and the loop
+		// goes on.
+		if err := decodeFrame(client.format, messageType, data, &message); err != nil {
+			connLog.Warn("invalid frame", "event", "ws_read", "error", err)
+			client.writeFrame(ErrorEvent{Type: EventError, Code: ErrCodeInvalidMessage, Message: "frame could not be decoded"})
+			continue
+		}
+		if !limiter.Allow() {
+			connLog.Warn("frame rate limit exceeded", "event", "ws_read")
+			fail(CloseRateLimited, ErrCodeRateLimited, "too many frames")
 			return
 		}
-		broadcast <- message
+		switch message.Type {
+		case EventAck:
+			var ack Ack
+			if err := decodeFrame(client.format, messageType, data, &ack); err != nil || ack.MessageID == "" {
+				client.writeFrame(ErrorEvent{Type: EventError, Code: ErrCodeInvalidMessage, Message: "invalid ack"})
+				continue
+			}
+			if err := client.acknowledge(db, ack.MessageID); err != nil {
+				client.writeFrame(ErrorEvent{Type: EventError, Code: ErrCodeInvalidMessage, Message: err.Error()})
+			}
+			continue
+		case EventSubscribe, EventUnsubscribe:
+			var sub PresenceSubscription
+			if err := decodeFrame(client.format, messageType, data, &sub); err != nil {
+				connLog.Warn("invalid subscription", "event", "ws_read", "error", err)
+				client.writeFrame(ErrorEvent{Type: EventError, Code: ErrCodeInvalidMessage, Message: "invalid subscription"})
+				continue
+			}
+			if sub.Type == EventSubscribe {
+				subscribePresence(db, client, sub.Users)
+			} else {
+				unsubscribePresence(client, sub.Users)
+			}
+			continue
+		}
+		// Frames are client-controlled: the timestamp is always the
+		// server's, and the sender is always the connection's user (the
+		// token's subject with auth). A frame naming anyone else is
+		// rejected rather than silently rewritten.
+		if message.Sender != "" && message.Sender != recipient {
+			connLog.Warn("sender mismatch", "event", "ws_read", "claimed_sender", message.Sender)
+			client.writeFrame(ErrorEvent{Type: EventError, Code: ErrCodeInvalidMessage, Message: "sender does not match the connection"})
+			continue
+		}
+		message.Sender = recipient
+		message.Timestamp = time.Now()
+		message.originConn = client.id
+		if message.Type == EventTyping {
+			// Typing frames are checked like chat frames, so that a
+			// blocked user or a non-member cannot push them either.
+			if message.RoomID == "" {
+				if message.Recipient, err = normalizeUserID(message.Recipient); err != nil {
+					client.writeFrame(ErrorEvent{Type: EventError, Code: ErrCodeInvalidMessage, Message: "recipient: " + err.Error()})
+					continue
+				}
+			}
+			if err := r.checkOutgoing(context.Background(), message); err != nil {
+				_, code, reason := outgoingError(err)
+				client.writeFrame(ErrorEvent{Type: EventError, Code: code, Message: reason})
+				continue
+			}
+			if !enqueueBroadcast(message) {
+				connLog.Warn("broadcast buffer full, dropping typing frame", "event", "ws_read")
+			}
+			continue
+		}
+		if err := validateFrame(&message); err != nil {
+			client.writeFrame(ErrorEvent{Type: EventError, Code: ErrCodeInvalidMessage, Message: err.Error()})
+			continue
+		}
+		// Chat frames go through the same path as /send, so they are
+		// stored and reach recipients who are offline right now.
+		if _, err := r.processOutgoing(context.Background(), connLog, message); err != nil {
+			_, code, reason := outgoingError(err)
+			client.writeFrame(ErrorEvent{Type: EventError, Code: code, Message: reason})
+		}
+	}
+}
+
+// replay writes messages to the client in order and returns how many of
+// them are done with. A message that cannot be encoded is logged and
+// skipped, since it would fail the same way on every reconnect; any other
+// error means the connection is broken.
+func (c *Client) replay(log *slog.Logger, messages []Message) (int, error) {
+	for i, message := range messages {
+		messageType, data, err := encodeFrame(c.format, message)
+		if err != nil {
+			log.Error("replay encode failed, skipping message", "event", "ws_replay", "message_id", message.ID, "error", err)
+			continue
+		}
+		if err := c.writeEncoded(messageType, data); err != nil {
+			return i, err
+		}
+		c.written.remember(c.user, message)
+	}
+	return len(messages), nil
+}
+
+// fromQueue returns the messages of list that came from the drained
+// offline queue, as opposed to history replayed for ?since=.
+func fromQueue(list, queue []Message) []Message {
+	ids := make(map[string]bool, len(queue))
+	for _, m := range queue {
+		ids[m.ID] = true
+	}
+	found := []Message{}
+	for _, m := range list {
+		if ids[m.ID] {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+// ackReplayed tells the online senders of messages that were waiting in the
+// offline queue that they have now been delivered.
+func ackReplayed(db *DBClient, messages []Message) {
+	for _, m := range messages {
+		if m.Type == EventTyping || m.ID == "" {
+			continue
+		}
+		countMessage(StatusDelivered)
+		if isMuted(db, m.Sender, muteTarget(m.Recipient, m.RoomID)) {
+			continue
+		}
+		notifyUser(m.Sender, Ack{Type: EventAck, MessageID: m.ID, Status: StatusDelivered})
+	}
+}
+
+// logReadError logs why a read loop ended. Clean closes by the client, and
+// connections we closed ourselves, are routine and only logged at debug;
+// missed heartbeats at info; anything else is a real error.
+func logReadError(log *slog.Logger, err error) {
+	var netErr net.Error
+	switch {
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived):
+		log.Debug("client closed connection", "event", "ws_read", "error", err)
+	case errors.Is(err, net.ErrClosed):
+		log.Debug("connection closed by server", "event", "ws_read", "error", err)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		log.Info("heartbeat timed out", "event", "ws_read", "error", err)
+	default:
+		log.Error("read failed", "event", "ws_read", "error", err)
+	}
+}
+
+// enqueueBroadcast queues msg for delivery without blocking and reports
+// whether there was room in the buffer.
+func enqueueBroadcast(msg Message) bool {
+	select {
+	case broadcast <- msg:
+		return true
+	default:
+		return false
 	}
 }
 
+// broadcastIsFull reports whether the broadcast buffer has no free slot.
+func broadcastIsFull() bool {
+	return len(broadcast) == cap(broadcast)
+}
+
+func broadcastFull(c *gin.Context) {
+	c.Header("Retry-After", "1")
+	respondError(c, http.StatusServiceUnavailable, ErrCodeBusy, "server is busy, retry later")
+}
+
 func (r *Router) sendMessage(c *gin.Context) {
+	reqLog := requestLogger(c)
 	var req struct {
-		Sender    string `json:"sender" binding:"required"`
-		Recipient string `json:"recipient" binding:"required"`
-		Content   string `json:"content" binding:"required"`
+		Sender      string       `json:"sender"`
+		Recipient   string       `json:"recipient" binding:"required_without=RoomID"`
+		RoomID      string       `json:"roomId"`
+		Content     string       `json:"content"`
+		Attachments []Attachment `json:"attachments"`
+		Ephemeral   bool         `json:"ephemeral"`
+		TTL         int64        `json:"ttl"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
-		log.Println(err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		reqLog.Debug("invalid send request", "event", "send", "error", err)
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	sender, err := normalizeUserID(authenticatedUser(c, req.Sender))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "sender: "+err.Error())
+		return
+	}
+	if req.RoomID == "" {
+		if req.Recipient, err = normalizeUserID(req.Recipient); err != nil {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "recipient: "+err.Error())
+			return
+		}
+		if req.Recipient == sender {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, errSelfMessage.Error())
+			return
+		}
+	}
+	if req.Content, err = normalizeContent(req.Content); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := validateBody(req.Content, req.Attachments); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := validateTTL(req.TTL); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
 	}
 
-	message := Message{}
-	message.Content = req.Content
-	message.Recipient = req.Recipient
-	message.Timestamp = time.Now()
-	message.Sender = req.Sender
-	broadcast <- message
-	db := r.dbclient
-	if err := db.StoreMessage(c, message); err != nil {
-		log.Println(err)
+	message := Message{
+		Sender:      sender,
+		Recipient:   req.Recipient,
+		RoomID:      req.RoomID,
+		Content:     req.Content,
+		Attachments: req.Attachments,
+		Ephemeral:   req.Ephemeral,
+		TTL:         req.TTL,
+	}
+	dryRun := isDryRun(c)
+	if dryRun {
+		message = newOutgoing(message)
+		err = r.checkOutgoing(c, message)
+	} else {
+		message, err = r.processOutgoing(c, reqLog, message)
+	}
+	switch {
+	case err == nil && dryRun:
+		c.JSON(http.StatusOK, dryRunResult{Message: message, DryRun: true})
+	case err == nil:
+		c.JSON(http.StatusOK, message)
+	case err == errBroadcastFull, err == errOverloaded:
+		broadcastFull(c)
+	default:
+		status, code, reason := outgoingError(err)
+		respondError(c, status, code, reason)
 	}
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
-func broadcastMessages() {
-	for {
-		msg := <-broadcast
-		recipient := msg.Recipient
-		if conn, ok := userConnections[recipient]; ok {
-			err := conn.conn.WriteJSON(msg)
-			if err != nil {
-				log.Println(err)
-				conn.conn.Close()
-				delete(userConnections, recipient)
-			}
+// newOutgoing stamps msg with the fields the server owns.
+func newOutgoing(msg Message) Message {
+	msg.Type = EventMessage
+	msg.ID = uuid.NewString()
+	msg.Timestamp = time.Now()
+	msg.Status = StatusSent
+	if msg.RoomID != "" {
+		msg.Recipient = ""
+	}
+	msg.ExpiresAt = nil
+	if msg.TTL > 0 {
+		expires := msg.Timestamp.Add(time.Duration(msg.TTL) * time.Second)
+		msg.ExpiresAt = &expires
+	}
+	return msg
+}
+
+// storeOutgoing assigns msg the next sequence number of its conversation
+// or room and stores it. Blocking only applies to direct messages; room
+// members see everything posted to the room. The checks run before a
+// sequence number is allocated, so that a refused message neither creates
+// a counter for an unknown room nor leaves a gap in a real one.
+func (r *Router) storeOutgoing(ctx context.Context, msg *Message) error {
+	db := r.dbclient
+	if err := r.checkOutgoing(ctx, *msg); err != nil {
+		return err
+	}
+	if msg.RoomID != "" {
+		seq, err := db.NextSeq(ctx, roomMessagesKey(msg.RoomID))
+		if err != nil {
+			return err
+		}
+		msg.Seq = seq
+		if err := db.StoreRoomMessage(ctx, *msg); err != nil {
+			return err
 		}
+		scheduleIfExpiring(ctx, db, roomMessagesKey(msg.RoomID), *msg)
+		return nil
+	}
+	seq, err := db.NextSeq(ctx, conversationKey(msg.Sender, msg.Recipient))
+	if err != nil {
+		return err
+	}
+	msg.Seq = seq
+	if err := db.StoreMessage(ctx, *msg); err != nil {
+		return err
+	}
+	scheduleIfExpiring(ctx, db, conversationKey(msg.Sender, msg.Recipient), *msg)
+	return nil
+}
+
+var errBroadcastFull = errors.New("broadcast buffer is full")
+
+// processOutgoing turns msg, already validated by the caller, into a new
+// chat message, stores it and queues it for delivery. It backs both /send
+// and the WebSocket read loop. It returns errBroadcastFull without storing
+// anything when the broadcast buffer is full, and the store error otherwise.
+func (r *Router) processOutgoing(ctx context.Context, log *slog.Logger, msg Message) (Message, error) {
+	msg = newOutgoing(msg)
+	if broadcastIsFull() {
+		return msg, errBroadcastFull
+	}
+	if !admitMessages(1) {
+		return msg, errOverloaded
 	}
+	return msg, r.sendAdmitted(ctx, log, &msg)
 }
 
-func (db *DBClient) SetUserOnline(ctx context.Context,userid string) error {
-	onlineUsers, err := db.GetLine(ctx, "online_users")
+// sendAdmitted stores msg, a new message already counted by admitMessages,
+// and queues it for delivery. /send-bulk admits all its messages at once and
+// then sends each one through here.
+func (r *Router) sendAdmitted(ctx context.Context, log *slog.Logger, msg *Message) error {
+	if broadcastIsFull() {
+		return errBroadcastFull
+	}
+	// Store before broadcasting so that a delivered message is always
+	// persisted, and a failed store is never delivered. Ephemeral messages
+	// get the same checks but are not stored.
+	if msg.Ephemeral {
+		if err := r.checkOutgoing(ctx, *msg); err != nil {
+			return err
+		}
+		countMessage(StatusSent)
+		if !enqueueBroadcast(*msg) {
+			return errBroadcastFull
+		}
+		return nil
+	}
+	err := r.storeOutgoing(ctx, msg)
+	if isRefused(err) {
+		return err
+	}
 	if err != nil {
-		if err != creditdb.ErrNotFound {
+		log.Error("store message failed", "event", "send", "sender", msg.Sender, "recipient", msg.Recipient, "room_id", msg.RoomID, "error", err)
+		if !degradedModeEnabled || msg.RoomID != "" {
 			return err
 		}
+		// Degraded mode: deliver to live connections even though the
+		// message is not persisted.
+	}
+	countMessage(StatusSent)
+	if !enqueueBroadcast(*msg) {
+		// The buffer filled up since the check above. The message is
+		// stored, so the recipient still gets it on their next connect.
+		log.Warn("broadcast buffer full, message stored only", "event", "send", "sender", msg.Sender)
+	}
+	return nil
+}
 
+// onlineUsers lists the IDs of users with at least one live connection.
+func (r *Router) onlineUsers(c *gin.Context) {
+	users, err := r.dbclient.GetUsersOnline(c)
+	if err != nil {
+		logger.Error("get online users failed", "event", "online", "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to load online users")
+		return
 	}
-	oUsers := []string{}
-	if onlineUsers != nil {
-		if err := json.Unmarshal([]byte(onlineUsers.Value), &oUsers); err != nil {
-			return err
+	c.JSON(http.StatusOK, users)
+}
+
+// userOnline reports whether a single user is online, without listing
+// everyone.
+func (r *Router) userOnline(c *gin.Context) {
+	user, err := normalizeUserID(c.Param("user"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "user: "+err.Error())
+		return
+	}
+	online, err := r.dbclient.IsUserOnline(c, user)
+	if err != nil {
+		logger.Error("get user presence failed", "event", "online", "user", user, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to load presence")
+		return
+	}
+	seen, ok, err := r.dbclient.LastSeen(c, user)
+	if err != nil {
+		logger.Error("get last seen failed", "event", "online", "user", user, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to load presence")
+		return
+	}
+	resp := gin.H{"user": user, "online": online}
+	if ok {
+		resp["lastSeen"] = seen
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+const maxPageLimit = 200
+
+// getMessages returns stored messages newest-first. limit defaults to 50 and
+// before, an RFC 3339 timestamp, restricts the page to older messages.
+func (r *Router) getMessages(c *gin.Context) {
+	sender := c.Query("sender")
+	recipient := c.Query("recipient")
+	if sender == "" || recipient == "" {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "sender and recipient are required")
+		return
+	}
+	if user := c.GetString(authUserKey); user != "" && user != sender && user != recipient {
+		respondError(c, http.StatusForbidden, ErrCodeForbidden, "not a participant of this conversation")
+		return
+	}
+	limit := 50
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "limit must be between 1 and 200")
+			return
+		}
+		limit = n
+	}
+	var before time.Time
+	if v := c.Query("before"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "before must be an RFC 3339 timestamp")
+			return
 		}
+		before = t
+	}
+
+	messages, err := r.dbclient.RetrieveStoredMessagesPaginated(c, sender, recipient, limit, before)
+	if err != nil {
+		logger.Error("retrieve messages failed", "event", "get_messages", "sender", sender, "recipient", recipient, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, messages)
+}
 
+// markRead records that reader has read the given messages from sender and
+// pushes a read receipt to sender if they are online.
+func (r *Router) markRead(c *gin.Context) {
+	var req struct {
+		Reader string   `json:"reader"`
+		Sender string   `json:"sender" binding:"required"`
+		IDs    []string `json:"ids" binding:"required"`
 	}
-	contains := func() bool {
-		for _, user := range oUsers {
-			if user == userid {
-				return true
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	reader, err := normalizeUserID(authenticatedUser(c, req.Reader))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "reader: "+err.Error())
+		return
+	}
+	sender, err := normalizeUserID(req.Sender)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "sender: "+err.Error())
+		return
+	}
+
+	readAt := time.Now()
+	marked, err := r.dbclient.MarkMessagesRead(c, conversationKey(reader, sender), reader, req.IDs, readAt)
+	if err != nil {
+		logger.Error("mark read failed", "event", "read", "sender", sender, "recipient", reader, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	ids := make([]string, 0, len(marked))
+	for _, m := range marked {
+		ids = append(ids, m.ID)
+		// Reading a message acknowledges it.
+		recordReceipt(r.dbclient, m, readAt)
+	}
+	if len(ids) > 0 && !isMuted(r.dbclient, sender, reader) {
+		notifyUser(sender, ReadReceipt{Type: EventRead, Reader: reader, MessageIDs: ids, ReadAt: readAt})
+	}
+	c.JSON(http.StatusOK, gin.H{"read": ids})
+}
+
+// broadcastWorkers is the number of goroutines delivering messages, so that
+// one slow recipient socket does not stall delivery to everyone else.
+var broadcastWorkers = envInt("BROADCAST_WORKERS", 8)
+
+// broadcastMessages dispatches queued messages to a pool of delivery
+// workers. Messages are routed by recipient (or room), so everything bound
+// for the same destination is handled by one worker and stays in order.
+// Once ctx is done it dispatches what is left in the buffer, waits for
+// the workers to finish and returns.
+func broadcastMessages(ctx context.Context, db *DBClient) {
+	workers := make([]chan Message, broadcastWorkers)
+	var wg sync.WaitGroup
+	for i := range workers {
+		workers[i] = make(chan Message, 64)
+		wg.Add(1)
+		go func(queue <-chan Message) {
+			defer wg.Done()
+			deliveryWorker(db, queue)
+		}(workers[i])
+	}
+	defer func() {
+		for _, w := range workers {
+			close(w)
+		}
+		wg.Wait()
+	}()
+	for {
+		select {
+		case msg := <-broadcast:
+			workers[workerFor(msg, len(workers))] <- msg
+		case <-ctx.Done():
+			drained := 0
+			for {
+				select {
+				case msg := <-broadcast:
+					workers[workerFor(msg, len(workers))] <- msg
+					drained++
+				default:
+					logger.Info("broadcast stopped", "event", "shutdown", "drained", drained)
+					return
+				}
 			}
 		}
-		return false
 	}
-	if !contains() {
-		oUsers = append(oUsers, userid)
+}
+
+func workerFor(msg Message, n int) int {
+	key := msg.Recipient
+	if msg.RoomID != "" {
+		key = "room:" + msg.RoomID
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+func deliveryWorker(db *DBClient, queue <-chan Message) {
+	for msg := range queue {
+		func() {
+			defer logPanic("deliver", "message_id", msg.ID, "recipient", msg.Recipient, "room_id", msg.RoomID)
+			deliver(db, msg)
+		}()
 	}
-	data, err := json.Marshal(oUsers)
+}
+
+// deliver hands msg to the connections of its recipients. The sender is
+// acknowledged once the outcome is known: delivered when a connection's
+// writer wrote the frame, stored (dropped for ephemeral messages) when none
+// did, in which case the message goes to the recipient's offline queue.
+func deliver(db *DBClient, msg Message) {
+	if msg.Type == EventTyping {
+		// Typing indicators are only relevant while both users are
+		// connected, so they are neither stored nor acknowledged.
+		if msg.RoomID != "" {
+			deliverToRoom(db, msg, nil)
+		} else if !isMuted(db, msg.Recipient, msg.Sender) {
+			deliverToUser(msg.Recipient, msg)
+		}
+		return
+	}
+	if msg.RoomID != "" {
+		deliverToRoom(db, msg, func(written bool) { finishDelivery(db, msg, written) })
+	} else {
+		deliverTracked(msg.Recipient, msg, func(written bool) {
+			if !written && !msg.Ephemeral {
+				queueForOffline(db, msg.Recipient, msg)
+			}
+			finishDelivery(db, msg, written)
+		})
+	}
+	echoToSender(msg)
+}
+
+// finishDelivery acknowledges msg to its sender once it is known whether
+// it was written to a connection of any recipient.
+func finishDelivery(db *DBClient, msg Message, written bool) {
+	status := StatusStored
+	if msg.Ephemeral {
+		status = StatusDropped
+	}
+	if written {
+		status = StatusDelivered
+	}
+	countMessage(status)
+	if !isMuted(db, msg.Sender, muteTarget(msg.Recipient, msg.RoomID)) {
+		notifyUser(msg.Sender, Ack{Type: EventAck, MessageID: msg.ID, Status: status})
+	}
+}
+
+// heartbeat pings the client every ping interval until done is closed, and
+// calls refresh after each successful ping. A client that stops answering
+// misses its read deadline and is reaped by the read loop in handleWS.
+func (c *Client) heartbeat(done <-chan struct{}, refresh func()) {
+	timing := c.timing
+	ticker := time.NewTicker(timing.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if timing.idleTimeout > 0 && c.idleFor(timing.clock()) > timing.idleTimeout {
+				logger.Info("closing idle connection", "event", "heartbeat", "conn_id", c.id, "idle_timeout", timing.idleTimeout.String())
+				c.closeWithError(CloseIdleTimeout, ErrCodeIdleTimeout, "connection was idle for too long")
+				c.conn.Close()
+				return
+			}
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timing.writeWait)); err != nil {
+				logger.Warn("ping failed", "event", "heartbeat", "conn_id", c.id, "error", err)
+				c.conn.Close()
+				return
+			}
+			refresh()
+		}
+	}
+}
+
+// closeWithError sends an error event followed by a close frame. The caller
+// still owns closing the underlying connection.
+func (c *Client) closeWithError(closeCode int, errCode, reason string) {
+	c.writeFrame(ErrorEvent{Type: EventError, Code: errCode, Message: reason})
+	msg := websocket.FormatCloseMessage(closeCode, reason)
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
+
+func (c *Client) writeFrame(v interface{}) error {
+	messageType, data, err := encodeFrame(c.format, v)
 	if err != nil {
+		return err
+	}
+	return c.writeEncoded(messageType, data)
+}
 
+// writeEncoded writes a frame already encoded by encodeFrame.
+func (c *Client) writeEncoded(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.touch()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.timing.writeWait)); err != nil {
 		return err
 	}
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// addConnection registers client as one of user's live connections and
+// reports whether it is the first one.
+func addConnection(user string, client *Client) bool {
+	userConnectionsMutex.Lock()
+	defer userConnectionsMutex.Unlock()
+	first := len(userConnections[user]) == 0
+	if userConnections[user] == nil {
+		userConnections[user] = make(map[*Client]bool)
+	}
+	userConnections[user][client] = true
+	activeConnections.Inc()
+	return first
+}
 
-	if err := db.SetLine(ctx, "online_users", string(data)); err != nil {
+// removeConnection unregisters client and reports whether it was the last
+// live connection of user.
+func removeConnection(user string, client *Client) bool {
+	userConnectionsMutex.Lock()
+	defer userConnectionsMutex.Unlock()
+	clients, ok := userConnections[user]
+	if !ok {
+		return false
+	}
+	if !clients[client] {
+		return false
+	}
+	delete(clients, client)
+	activeConnections.Dec()
+	if len(clients) == 0 {
+		delete(userConnections, user)
+		return true
+	}
+	return false
+}
 
+// connectionsFor returns a snapshot of user's live connections.
+func connectionsFor(user string) []*Client {
+	userConnectionsMutex.Lock()
+	defer userConnectionsMutex.Unlock()
+	clients := make([]*Client, 0, len(userConnections[user]))
+	for client := range userConnections[user] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// stopDelivery closes every connection, then stops the broadcast loop
+// started with stopBroadcast and waits for it to have drained. With no
+// connection left, messages still waiting for delivery go to the offline
+// queues of their recipients.
+func stopDelivery(ctx context.Context, db *DBClient, stopBroadcast context.CancelFunc, broadcastDone <-chan struct{}) {
+	closeAllConnections(ctx, db)
+	stopBroadcast()
+	select {
+	case <-broadcastDone:
+	case <-ctx.Done():
+		logger.Error("broadcast drain timed out", "event", "shutdown", "queued", len(broadcast))
+	}
+}
+
+// closeAllConnections sends a close frame to every live connection, closes
+// it and marks its user offline. http.Server.Shutdown does not track hijacked
+// connections, so without this clients only notice at TCP timeout. It
+// returns once their handlers have unregistered them and settled the frames
+// left in their outboxes, or when ctx is done.
+func closeAllConnections(ctx context.Context, db *DBClient) {
+	userConnectionsMutex.Lock()
+	conns := make(map[string][]*Client, len(userConnections))
+	for user, clients := range userConnections {
+		for client := range clients {
+			conns[user] = append(conns[user], client)
+		}
+	}
+	userConnectionsMutex.Unlock()
+
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for _, clients := range conns {
+		for _, client := range clients {
+			client.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+			client.conn.Close()
+		}
+	}
+	for user, clients := range conns {
+		for _, client := range clients {
+			if client.finished != nil {
+				select {
+				case <-client.finished:
+				case <-ctx.Done():
+					logger.Error("connection did not close", "event", "shutdown", "conn_id", client.id, "recipient", user)
+				}
+			}
+			// A handler that did not finish in time must not receive
+			// the drained messages either.
+			removeConnection(user, client)
+			client.closeOutbox()
+		}
+		if err := db.SetUserOffline(ctx, user); err != nil {
+			logger.Error("set user offline failed", "event", "shutdown", "recipient", user, "error", err)
+		}
+	}
+}
+
+// deliverToUser queues msg on every live connection of recipient and
+// reports whether there was any. The lock is only held while reading
+// userConnections, and Send never blocks on the network. A connection whose
+// write fails is closed by its writer, which ends its read loop in handleWS
+// and unregisters it there.
+func deliverToUser(recipient string, msg Message) bool {
+	clients := connectionsFor(recipient)
+	for _, client := range clients {
+		client.Send(msg)
+	}
+	return len(clients) > 0
+}
+
+// deliverTracked queues msg on every live connection of recipient, like
+// deliverToUser, and calls done once with whether any of their writers
+// wrote it. done runs at once with false when recipient has no connection.
+func deliverTracked(recipient string, msg Message, done func(written bool)) {
+	clients := connectionsFor(recipient)
+	if len(clients) == 0 {
+		done(false)
+		return
+	}
+	d := newDelivery(len(clients), done)
+	for _, client := range clients {
+		client.sendTracked(msg, d)
+	}
+}
+
+// echoToSender copies msg to the sender's devices, except the connection it
+// was sent from, so that all of them show the conversation in real time.
+func echoToSender(msg Message) {
+	for _, client := range connectionsFor(msg.Sender) {
+		if client.id != msg.originConn {
+			client.Send(msg)
+		}
+	}
+}
+
+// notifyUser queues a control event on every live connection of user.
+func notifyUser(user string, event interface{}) {
+	for _, client := range connectionsFor(user) {
+		client.Send(event)
+	}
+}
+
+// presenceTTL is how long an online marker lives without being refreshed
+// by the heartbeat, so users of a crashed server drop offline by themselves.
+var presenceTTL = envDuration("PRESENCE_TTL", 90*time.Second)
+
+// presenceClock is the clock online markers are stamped and checked with.
+var presenceClock = time.Now
+
+const presencePrefix = "online:"
+
+func presenceKey(userid string) string {
+	return presencePrefix + keyPart(userid)
+}
+
+// SetUserOnline marks userid online until presenceTTL elapses.
+func (db *DBClient) SetUserOnline(ctx context.Context, userid string) error {
+	expires := presenceClock().Add(presenceTTL).UTC().Format(time.RFC3339Nano)
+	return db.setLine(ctx, presenceKey(userid), expires)
+}
+
+// RefreshPresence extends the online marker of userid. It is the same write
+// as SetUserOnline and exists to make heartbeat call sites read clearly.
+func (db *DBClient) RefreshPresence(ctx context.Context, userid string) error {
+	return db.SetUserOnline(ctx, userid)
+}
+
+func (db *DBClient) SetUserOffline(ctx context.Context, userid string) error {
+	if err := db.deleteLine(ctx, presenceKey(userid)); err != nil && err != creditdb.ErrNotFound {
 		return err
 	}
 	return nil
 }
 
-func (db *DBClient) SetUserOffline(ctx context.Context,userid string) error {
-	onlineUsers, err := db.GetLine(ctx, "online_users")
+// IsUserOnline reports whether userid has an unexpired online marker. A
+// user who was never online is offline.
+func (db *DBClient) IsUserOnline(ctx context.Context, userid string) (bool, error) {
+	line, err := db.getLine(ctx, presenceKey(userid))
+	if err == creditdb.ErrNotFound {
+		return false, nil
+	}
 	if err != nil {
-		return err
+		return false, err
 	}
-	oUsers := []string{}
+	expires, err := time.Parse(time.RFC3339Nano, line.Value)
+	return err == nil && expires.After(presenceClock()), nil
+}
 
-	if onlineUsers != nil {
-		if err := json.Unmarshal([]byte(onlineUsers.Value), &oUsers); err != nil {
-			return err
+// GetUsersOnline enumerates the unexpired online markers. creditdb has no
+// prefix scan, so this reads every line of the page. A page that was
+// never written is reported as ErrNotFound, which means nobody is online.
+func (db *DBClient) GetUsersOnline(ctx context.Context) ([]string, error) {
+	lines, err := db.getAllLines(ctx)
+	if err == creditdb.ErrNotFound {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	users := []string{}
+	now := presenceClock()
+	for _, line := range lines {
+		escaped, ok := strings.CutPrefix(line.Key, presencePrefix)
+		if !ok {
+			continue
 		}
+		expires, err := time.Parse(time.RFC3339Nano, line.Value)
+		if err != nil || !expires.After(now) {
+			continue
+		}
+		user, err := url.QueryUnescape(escaped)
+		if err != nil {
+			continue
+		}
+		users = append(users, user)
 	}
+	return users, nil
+}
 
-	for i, user := range oUsers {
-		if user == userid {
-			oUsers = append(oUsers[:i], oUsers[i+1:]...)
-			break
-		}
+// conversationKey returns the DB key holding the conversation between a and
+// b. The IDs are ordered so that both directions share a single key.
+func conversationKey(a, b string) string {
+	if b < a {
+		a, b = b, a
 	}
-	data, err := json.Marshal(oUsers)
+	return conversationPrefix + keyPart(a) + ":" + keyPart(b)
+}
+
+// keyPart escapes an ID for use as one ':'-separated component of a DB key,
+// so that IDs containing ':' cannot collide with other keys.
+func keyPart(id string) string {
+	return url.QueryEscape(id)
+}
+
+func (db *DBClient) StoreMessage(ctx context.Context, message Message) error {
+	key := conversationKey(message.Sender, message.Recipient)
+	defer keyLocks.lock(key)()
+	first, err := db.appendHistory(ctx, key, message)
 	if err != nil {
 		return err
 	}
-	if err := db.SetLine(ctx, "online_users", string(data)); err != nil {
-		return err
+	// The partner index only changes when a conversation starts. Adding a
+	// partner twice is a no-op, so a conversation emptied and restarted
+	// is fine.
+	if first {
+		if err := db.addConversationPartner(ctx, message.Sender, message.Recipient); err != nil {
+			return err
+		}
+		return db.addConversationPartner(ctx, message.Recipient, message.Sender)
 	}
 	return nil
 }
 
-func (db *DBClient) GetUsersOnline(ctx context.Context,) ([]string, error) {
-	onlineUsers, err := db.GetLine(ctx, "online_users")
+// maxStoredMessages caps each conversation. Older messages are dropped on
+// the next store and are not recoverable. History is trimmed a whole page
+// at a time, so a conversation holds between maxStoredMessages and
+// maxStoredMessages+historyPageSize-1 messages.
+var maxStoredMessages = envInt("MAX_STORED_MESSAGES", 1000)
+
+// trimHistory keeps the most recent maxStoredMessages messages.
+func trimHistory(messages []Message) []Message {
+	if len(messages) <= maxStoredMessages {
+		return messages
+	}
+	return messages[len(messages)-maxStoredMessages:]
+}
+
+func (db *DBClient) RetrieveStoredMessages(ctx context.Context, m Message) ([]Message, error) {
+	return db.loadHistory(ctx, conversationKey(m.Sender, m.Recipient))
+}
+
+// RetrieveStoredMessagesSince returns, oldest first, up to limit messages of
+// m's conversation stored after cursor, which is a message ID or an RFC 3339
+// timestamp. An unknown or malformed cursor yields the latest limit
+// messages, so a client with a stale cursor still gets recent history.
+func (db *DBClient) RetrieveStoredMessagesSince(ctx context.Context, m Message, cursor string, limit int) ([]Message, error) {
+	messages, err := db.RetrieveStoredMessages(ctx, m)
 	if err != nil {
 		return nil, err
 	}
-	oUsers := []string{}
-	if err := json.Unmarshal([]byte(onlineUsers.Value), &oUsers); err != nil {
-		return nil, err
+	if after, ok := messagesAfter(messages, cursor); ok {
+		messages = after
+	}
+	if len(messages) > limit {
+		messages = messages[len(messages)-limit:]
 	}
-	return oUsers, nil
+	return messages, nil
 }
 
-func (db *DBClient) StoreMessage(ctx context.Context,message Message) error {
-	messages, err := db.GetLine(ctx, "user:messages:"+message.Sender+":"+message.Recipient)
+// messagesAfter slices messages after cursor and reports whether the cursor
+// was understood.
+func messagesAfter(messages []Message, cursor string) ([]Message, bool) {
+	for i, m := range messages {
+		if m.ID == cursor {
+			return messages[i+1:], true
+		}
+	}
+	t, err := time.Parse(time.RFC3339Nano, cursor)
 	if err != nil {
-		if err != creditdb.ErrNotFound {
-			return err
+		return nil, false
+	}
+	for i, m := range messages {
+		if m.Timestamp.After(t) {
+			return messages[i:], true
 		}
 	}
-	mess := []Message{}
-	if messages != nil {
-		if err := json.Unmarshal([]byte(messages.Value), &mess); err != nil {
-			return err
+	return []Message{}, true
+}
+
+// replayConversation names the conversation or room a queued message
+// belongs to, from the point of view of its recipient.
+func replayConversation(m Message) string {
+	if m.RoomID != "" {
+		return "room:" + m.RoomID
+	}
+	return m.Sender
+}
+
+// capConversations keeps the messages of the n conversations whose latest
+// queued message is newest, in their original order, and returns how many
+// conversations were dropped.
+func capConversations(messages []Message, n int) ([]Message, int) {
+	latest := make(map[string]time.Time)
+	for _, m := range messages {
+		conv := replayConversation(m)
+		if t, ok := latest[conv]; !ok || m.Timestamp.After(t) {
+			latest[conv] = m.Timestamp
 		}
 	}
-	mess = append(mess, message)
-	data, err := json.Marshal(mess)
-	if err != nil {
-		return err
+	if len(latest) <= n {
+		return messages, 0
 	}
-	if err := db.SetLine(ctx, "user:messages:"+message.Sender+":"+message.Recipient, string(data)); err != nil {
-		return err
+	convs := make([]string, 0, len(latest))
+	for conv := range latest {
+		convs = append(convs, conv)
 	}
-	return nil
+	sort.Slice(convs, func(i, j int) bool {
+		return latest[convs[i]].After(latest[convs[j]])
+	})
+	keep := make(map[string]bool, n)
+	for _, conv := range convs[:n] {
+		keep[conv] = true
+	}
+	kept := []Message{}
+	for _, m := range messages {
+		if keep[replayConversation(m)] {
+			kept = append(kept, m)
+		}
+	}
+	return kept, len(convs) - n
 }
 
-func (db *DBClient) RetrieveStoredMessages(ctx context.Context,m Message) ([]Message, error) {
-	mess, err := db.GetLine(ctx, "user:messages:"+m.Sender+":"+m.Recipient)
+// mergeReplay combines conversation history with the drained offline queue,
+// dropping queued messages already in history, in timestamp order.
+func mergeReplay(history, queued []Message) []Message {
+	seen := make(map[string]bool, len(history))
+	merged := append([]Message{}, history...)
+	for _, m := range history {
+		seen[m.ID] = true
+	}
+	for _, m := range queued {
+		if m.ID == "" || !seen[m.ID] {
+			merged = append(merged, m)
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Timestamp.Before(merged[j].Timestamp)
+	})
+	return merged
+}
+
+// loadConversation decodes the messages stored under key. A conversation
+// that was never written is empty, not an error.
+func (db *DBClient) loadConversation(ctx context.Context, key string) ([]Message, error) {
+	mess, err := db.getLine(ctx, key)
 	if err != nil {
 		if err != creditdb.ErrNotFound {
 			return nil, err
@@ -297,6 +1614,68 @@ func (db *DBClient) RetrieveStoredMessages(ctx context.Context,m Message) ([]Mes
 			return nil, err
 		}
 	}
-
+	if err := openMessages(messages); err != nil {
+		return nil, fmt.Errorf("decrypt %s: %w", key, err)
+	}
 	return messages, nil
 }
+
+func (db *DBClient) saveConversation(ctx context.Context, key string, messages []Message) error {
+	messages, err := sealMessages(messages)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return err
+	}
+	return db.setLine(ctx, key, string(data))
+}
+
+// RetrieveStoredMessagesPaginated returns up to limit stored messages,
+// newest first. A non-zero before only returns messages sent earlier.
+func (db *DBClient) RetrieveStoredMessagesPaginated(ctx context.Context, sender, recipient string, limit int, before time.Time) ([]Message, error) {
+	messages, err := db.RetrieveStoredMessages(ctx, Message{Sender: sender, Recipient: recipient})
+	if err != nil {
+		return nil, err
+	}
+	page := []Message{}
+	for i := len(messages) - 1; i >= 0 && len(page) < limit; i-- {
+		if !before.IsZero() && !messages[i].Timestamp.Before(before) {
+			continue
+		}
+		page = append(page, messages[i])
+	}
+	return page, nil
+}
+
+// MarkMessagesRead sets ReadAt on the unread messages in ids that were sent
+// to reader and returns the messages it changed. IDs that are unknown,
+// already read or of reader's own messages are skipped: only the recipient
+// of a message can read it.
+func (db *DBClient) MarkMessagesRead(ctx context.Context, conversationKey, reader string, ids []string, readAt time.Time) ([]Message, error) {
+	defer keyLocks.lock(conversationKey)()
+	messages, err := db.loadHistory(ctx, conversationKey)
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	marked := []Message{}
+	for i := range messages {
+		if !wanted[messages[i].ID] || messages[i].Recipient != reader || messages[i].ReadAt != nil {
+			continue
+		}
+		messages[i].ReadAt = &readAt
+		marked = append(marked, messages[i])
+	}
+	if len(marked) == 0 {
+		return marked, nil
+	}
+	if err := db.saveHistory(ctx, conversationKey, messages); err != nil {
+		return nil, err
+	}
+	return marked, nil
+}
@@ -0,0 +1,1606 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ayo-ajayi/realtime-chat-creditdb-websocket/storetest"
+	"github.com/creditdb/go-creditdb"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	logger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+	// Disconnects go offline at once instead of after the resume grace,
+	// so tests do not leak timers into each other.
+	resumeGrace = 0
+	os.Exit(m.Run())
+}
+
+// logRecorder is a slog.Handler that keeps every record it is given.
+type logRecorder struct {
+	mu      *sync.Mutex
+	records *[]slog.Record
+}
+
+func newLogRecorder() logRecorder {
+	return logRecorder{mu: &sync.Mutex{}, records: &[]slog.Record{}}
+}
+
+func (l logRecorder) Enabled(context.Context, slog.Level) bool { return true }
+
+func (l logRecorder) Handle(_ context.Context, r slog.Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	*l.records = append(*l.records, r.Clone())
+	return nil
+}
+
+func (l logRecorder) WithAttrs([]slog.Attr) slog.Handler { return l }
+func (l logRecorder) WithGroup(string) slog.Handler      { return l }
+
+// atLeast returns the messages of the records logged at level or above.
+func (l logRecorder) atLeast(level slog.Level) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var found []string
+	for _, r := range *l.records {
+		if r.Level >= level {
+			found = append(found, r.Message)
+		}
+	}
+	return found
+}
+
+// recordLogs sends everything the server logs to a recorder until the test
+// ends.
+func recordLogs(t *testing.T) logRecorder {
+	t.Helper()
+	rec := newLogRecorder()
+	previous := logger
+	logger = slog.New(rec)
+	t.Cleanup(func() { logger = previous })
+	return rec
+}
+
+type testServer struct {
+	store *storetest.MemStore
+	db    *DBClient
+	http  *httptest.Server
+}
+
+var testUsers atomic.Int64
+
+// newTestUser returns a user ID no other test uses, since connections and
+// presence are process-wide.
+func newTestUser(name string) string {
+	return name + "-" + strconv.FormatInt(testUsers.Add(1), 10)
+}
+
+// newTestServer serves a router over an in-memory store, with the
+// broadcast loop running and authentication disabled. Everything it starts
+// is stopped when the test ends.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	return newTestServerWith(t, nil)
+}
+
+func newTestServerWith(t *testing.T, auth gin.HandlerFunc) *testServer {
+	t.Helper()
+	return newTestServerOver(t, auth, nil)
+}
+
+// newTestServerOver is newTestServerWith with the DB client over
+// wrap(store) instead of the in-memory store itself, so that a test can
+// intercept store calls. ts.store is still the in-memory store.
+func newTestServerOver(t *testing.T, auth gin.HandlerFunc, wrap func(*storetest.MemStore) Store) *testServer {
+	t.Helper()
+	ts := newIdleTestServerOver(t, auth, wrap)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		broadcastMessages(ctx, ts.db)
+	}()
+	// Cleanups run last in, first out: the loop stops after the
+	// connections closed.
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	ts.closeOnCleanup(t)
+	return ts
+}
+
+// newIdleTestServer is newTestServerWith without a broadcast loop, so that
+// queued messages stay in the broadcast buffer.
+func newIdleTestServer(t *testing.T, auth gin.HandlerFunc) *testServer {
+	t.Helper()
+	return newIdleTestServerOver(t, auth, nil)
+}
+
+func newIdleTestServerOver(t *testing.T, auth gin.HandlerFunc, wrap func(*storetest.MemStore) Store) *testServer {
+	t.Helper()
+	store := storetest.NewMemStore()
+	var db *DBClient
+	if wrap != nil {
+		db = NewDBClientFromStore(wrap(store))
+	} else {
+		db = NewDBClientFromStore(store)
+	}
+	return &testServer{store: store, db: db, http: httptest.NewServer(newRouter(db, auth).engine)}
+}
+
+// closeOnCleanup closes the server when the test ends and waits for its
+// connections to be gone.
+func (ts *testServer) closeOnCleanup(t *testing.T) {
+	t.Cleanup(func() {
+		ts.http.Close()
+		waitFor(t, "connections to close", func() bool {
+			userConnectionsMutex.Lock()
+			defer userConnectionsMutex.Unlock()
+			return len(userConnections) == 0
+		})
+	})
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// wsURL returns the WebSocket URL of path on the test server.
+func (ts *testServer) wsURL(path string, query url.Values) string {
+	return "ws" + strings.TrimPrefix(ts.http.URL, "http") + path + "?" + query.Encode()
+}
+
+// dial connects user with the chat.v1 subprotocol and reads the replay up
+// to history_end, returning the frames before it.
+func (ts *testServer) dial(t *testing.T, user string) (*websocket.Conn, []map[string]any) {
+	t.Helper()
+	conn, _, err := ts.dialQuery(t, url.Values{"recipient": {user}}, subprotocolChatV1)
+	if err != nil {
+		t.Fatalf("dial %s: %v", user, err)
+	}
+	var replayed []map[string]any
+	for {
+		frame := readFrame(t, conn)
+		if frame["type"] == EventHistoryEnd {
+			return conn, replayed
+		}
+		replayed = append(replayed, frame)
+	}
+}
+
+// dialQuery opens a connection offering protocols, closed when the test
+// ends.
+func (ts *testServer) dialQuery(t *testing.T, query url.Values, protocols ...string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: protocols, HandshakeTimeout: 5 * time.Second}
+	conn, resp, err := dialer.Dial(ts.wsURL("/ws", query), nil)
+	if err == nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+// readFrame reads one JSON frame, failing the test if none arrives soon.
+func readFrame(t *testing.T, conn *websocket.Conn) map[string]any {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame map[string]any
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	return frame
+}
+
+// readUntil reads frames until one of type kind arrives and returns it.
+func readUntil(t *testing.T, conn *websocket.Conn, kind string) map[string]any {
+	t.Helper()
+	for {
+		if frame := readFrame(t, conn); frame["type"] == kind {
+			return frame
+		}
+	}
+}
+
+// do sends a JSON request to the test server and decodes the JSON answer
+// into out, unless out is nil.
+func (ts *testServer) do(t *testing.T, method, path string, body any, out any) int {
+	t.Helper()
+	return ts.doWith(t, method, path, nil, body, out)
+}
+
+// doWith is do with extra request headers.
+func (ts *testServer) doWith(t *testing.T, method, path string, header http.Header, body any, out any) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = strings.NewReader(string(data))
+	}
+	req, err := http.NewRequest(method, ts.http.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ts.http.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decode: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestCloseInducedDisconnectDoesNotLogErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(conn *websocket.Conn)
+	}{
+		{"normal closure", func(conn *websocket.Conn) {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"))
+		}},
+		{"going away", func(conn *websocket.Conn) {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+		}},
+		{"no status", func(conn *websocket.Conn) {
+			conn.WriteMessage(websocket.CloseMessage, []byte{})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			rec := recordLogs(t)
+			user := newTestUser("closer")
+			conn, _ := ts.dial(t, user)
+			tt.close(conn)
+			waitFor(t, "disconnect", func() bool { return len(connectionsFor(user)) == 0 })
+			if errs := rec.atLeast(slog.LevelError); len(errs) > 0 {
+				t.Fatalf("error-level logs on close: %v", errs)
+			}
+		})
+	}
+}
+
+func TestAbruptDisconnectLogsError(t *testing.T) {
+	ts := newTestServer(t)
+	rec := recordLogs(t)
+	user := newTestUser("dropper")
+	conn, _ := ts.dial(t, user)
+	// Dropping the socket without a close frame is an abnormal closure,
+	// which unlike a clean close is still worth an error.
+	conn.UnderlyingConn().Close()
+	waitFor(t, "disconnect", func() bool { return len(connectionsFor(user)) == 0 })
+	waitFor(t, "error log", func() bool { return len(rec.atLeast(slog.LevelError)) > 0 })
+}
+
+func TestLogReadErrorLevels(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		level slog.Level
+	}{
+		{"normal closure", &websocket.CloseError{Code: websocket.CloseNormalClosure}, slog.LevelDebug},
+		{"going away", &websocket.CloseError{Code: websocket.CloseGoingAway}, slog.LevelDebug},
+		{"no status", &websocket.CloseError{Code: websocket.CloseNoStatusReceived}, slog.LevelDebug},
+		{"closed by server", net.ErrClosed, slog.LevelDebug},
+		{"timeout", &net.OpError{Op: "read", Err: netTimeout{}}, slog.LevelInfo},
+		{"abnormal closure", &websocket.CloseError{Code: websocket.CloseAbnormalClosure}, slog.LevelError},
+		{"other", errors.New("boom"), slog.LevelError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := newLogRecorder()
+			logReadError(slog.New(rec), tt.err)
+			if len(*rec.records) != 1 {
+				t.Fatalf("got %d records, want 1", len(*rec.records))
+			}
+			if got := (*rec.records)[0].Level; got != tt.level {
+				t.Fatalf("level = %v, want %v", got, tt.level)
+			}
+		})
+	}
+}
+
+type netTimeout struct{}
+
+func (netTimeout) Error() string   { return "i/o timeout" }
+func (netTimeout) Timeout() bool   { return true }
+func (netTimeout) Temporary() bool { return true }
+
+func TestAccessLogOmitsQuery(t *testing.T) {
+	ts := newTestServer(t)
+	var buf strings.Builder
+	var mu sync.Mutex
+	previous := logger
+	logger = slog.New(slog.NewJSONHandler(&lockedWriter{mu: &mu, w: &buf}, nil))
+	t.Cleanup(func() { logger = previous })
+
+	resp, err := ts.http.Client().Get(ts.http.URL + "/health?token=secret-jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	out := buf.String()
+	if !strings.Contains(out, `"path":"/health"`) {
+		t.Fatalf("no access log line for /health: %s", out)
+	}
+	if strings.Contains(out, "secret-jwt") {
+		t.Fatalf("access log leaks the query string: %s", out)
+	}
+}
+
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+func TestHandshakeSubprotocol(t *testing.T) {
+	tests := []struct {
+		name      string
+		require   bool
+		offered   []string
+		status    int
+		protocol  string
+		connected bool
+	}{
+		{"chat.v1", true, []string{subprotocolChatV1}, http.StatusSwitchingProtocols, subprotocolChatV1, true},
+		{"compact", true, []string{"other", subprotocolChatV1Compact}, http.StatusSwitchingProtocols, subprotocolChatV1Compact, true},
+		{"nothing offered", true, nil, http.StatusBadRequest, "", false},
+		{"unknown only", true, []string{"chat.v2"}, http.StatusBadRequest, "", false},
+		{"nothing offered, not required", false, nil, http.StatusSwitchingProtocols, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := requireSubprotocol
+			requireSubprotocol = tt.require
+			t.Cleanup(func() { requireSubprotocol = previous })
+			ts := newTestServer(t)
+			conn, resp, err := ts.dialQuery(t, url.Values{"recipient": {newTestUser("proto")}}, tt.offered...)
+			if resp == nil {
+				t.Fatalf("dial: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if (err == nil) != tt.connected {
+				t.Fatalf("dial error = %v, want connected %v", err, tt.connected)
+			}
+			if err == nil {
+				if got := conn.Subprotocol(); got != tt.protocol {
+					t.Fatalf("subprotocol = %q, want %q", got, tt.protocol)
+				}
+				readUntil(t, conn, EventHistoryEnd)
+			}
+		})
+	}
+}
+
+func TestHandshakeTimeoutAbortsSlowClients(t *testing.T) {
+	previous := handshakeTimeout
+	handshakeTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { handshakeTimeout = previous })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newHTTPServer(ln.Addr().String(), newRouter(NewDBClientFromStore(storetest.NewMemStore()), nil).engine, nil)
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The request line arrives, the rest of the headers never do.
+	if _, err := conn.Write([]byte("GET /ws?recipient=slow HTTP/1.1\r\nHost: test\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.Copy(io.Discard, conn)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("handshake still open after %s", elapsed)
+	}
+}
+
+// send posts a message from sender to recipient over /send and returns it.
+func (ts *testServer) send(t *testing.T, sender, recipient, content string) Message {
+	t.Helper()
+	var sent Message
+	if status := ts.do(t, http.MethodPost, "/send", map[string]any{"sender": sender, "recipient": recipient, "content": content}, &sent); status != http.StatusOK {
+		t.Fatalf("send %s -> %s: status %d", sender, recipient, status)
+	}
+	return sent
+}
+
+func TestMarkReadSubset(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	m1 := ts.send(t, alice, bob, "one")
+	m2 := ts.send(t, alice, bob, "two")
+	m3 := ts.send(t, alice, bob, "three")
+	own := ts.send(t, bob, alice, "bob's own")
+
+	tests := []struct {
+		name string
+		ids  []string
+		want []string
+	}{
+		{"subset with unknown and own IDs", []string{m1.ID, m3.ID, own.ID, "unknown"}, []string{m1.ID, m3.ID}},
+		{"already read", []string{m1.ID, m3.ID}, []string{}},
+		{"the rest", []string{m1.ID, m2.ID}, []string{m2.ID}},
+		{"nothing known", []string{"unknown"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got struct {
+				Read []string `json:"read"`
+			}
+			if status := ts.do(t, http.MethodPost, "/read", map[string]any{"reader": bob, "sender": alice, "ids": tt.ids}, &got); status != http.StatusOK {
+				t.Fatalf("status = %d", status)
+			}
+			if !reflect.DeepEqual(got.Read, tt.want) {
+				t.Fatalf("read = %q, want %q", got.Read, tt.want)
+			}
+		})
+	}
+
+	history, err := ts.db.loadHistory(context.Background(), conversationKey(alice, bob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range history {
+		if read := m.ReadAt != nil; read != (m.ID != own.ID) {
+			t.Fatalf("message %q: read = %v", m.Content, read)
+		}
+	}
+}
+
+func TestMarkReadNotifiesSender(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	m1 := ts.send(t, alice, bob, "one")
+	ts.send(t, alice, bob, "two")
+	own := ts.send(t, bob, alice, "bob's own")
+	aliceConn, _ := ts.dial(t, alice)
+	bobConn, _ := ts.dial(t, bob)
+
+	if status := ts.do(t, http.MethodPost, "/read", map[string]any{"reader": bob, "sender": alice, "ids": []string{m1.ID, own.ID}}, nil); status != http.StatusOK {
+		t.Fatalf("status = %d", status)
+	}
+	frame := readUntil(t, aliceConn, EventRead)
+	if frame["reader"] != bob || !reflect.DeepEqual(frame["messageIds"], []any{m1.ID}) {
+		t.Fatalf("read event = %v, want %s reading %s", frame, bob, m1.ID)
+	}
+
+	// Alice marking Bob's message notifies Bob, and once is enough.
+	ts.do(t, http.MethodPost, "/read", map[string]any{"reader": alice, "sender": bob, "ids": []string{own.ID}}, nil)
+	ts.do(t, http.MethodPost, "/read", map[string]any{"reader": alice, "sender": bob, "ids": []string{own.ID}}, nil)
+	frame = readUntil(t, bobConn, EventRead)
+	if !reflect.DeepEqual(frame["messageIds"], []any{own.ID}) {
+		t.Fatalf("read event = %v, want %s", frame, own.ID)
+	}
+	bobConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	var extra map[string]any
+	if err := bobConn.ReadJSON(&extra); err == nil && extra["type"] == EventRead {
+		t.Fatalf("second read event for an already read message: %v", extra)
+	}
+}
+
+// newRouter returns a Router over the test server's store, for calling
+// handlers' helpers directly.
+func (ts *testServer) newRouter() *Router {
+	return &Router{dbclient: ts.db}
+}
+
+// wsPair returns the two ends of a WebSocket connection: server as
+// handleWS would see it, and client as a browser would.
+func wsPair(t *testing.T) (server, client *websocket.Conn) {
+	t.Helper()
+	accepted := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		up := websocket.Upgrader{}
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(srv.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server, client
+}
+
+// newPairedClient returns a Client for user on the server end of a wsPair,
+// with no writer running, and the client end. It is registered in
+// userConnections until the test ends.
+func newPairedClient(t *testing.T, user string) (*Client, *websocket.Conn) {
+	t.Helper()
+	server, conn := wsPair(t)
+	client := &Client{id: newTestUser("conn"), user: user, conn: server, format: formatJSON, outbox: newOutbox(), timing: currentTiming()}
+	addConnection(user, client)
+	t.Cleanup(func() {
+		removeConnection(user, client)
+		client.closeOutbox()
+	})
+	return client, conn
+}
+
+// queuedFrames returns the frames waiting in client's outbox without
+// removing them for good.
+func queuedFrames(client *Client) []interface{} {
+	client.outbox.mu.Lock()
+	defer client.outbox.mu.Unlock()
+	var frames []interface{}
+	for n := len(client.outbox.frames); n > 0; n-- {
+		queued := <-client.outbox.frames
+		frames = append(frames, queued.frame)
+		client.outbox.frames <- queued
+	}
+	return frames
+}
+
+func TestShutdownPersistsBufferedMessages(t *testing.T) {
+	tests := []struct {
+		name  string
+		conns int
+		// stuck registers connections no handler serves, whose outboxes
+		// only settle once they are unregistered.
+		stuck int
+	}{
+		{"recipient offline", 0, 0},
+		{"recipient connected", 1, 0},
+		{"recipient connected twice", 2, 0},
+		{"handler not running", 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newIdleTestServer(t, nil)
+			ts.closeOnCleanup(t)
+			db := ts.db
+			sender, recipient := newTestUser("alice"), newTestUser("bob")
+			for i := 0; i < tt.conns; i++ {
+				ts.dial(t, recipient)
+			}
+			for i := 0; i < tt.stuck; i++ {
+				newPairedClient(t, recipient)
+			}
+			waitFor(t, "connections", func() bool { return len(connectionsFor(recipient)) == tt.conns+tt.stuck })
+
+			var want []string
+			for i := 0; i < 5; i++ {
+				msg := Message{ID: newTestUser("msg"), Sender: sender, Recipient: recipient, Content: strconv.Itoa(i)}
+				broadcast <- msg
+				want = append(want, msg.ID)
+			}
+			// The loop only starts once asked to stop, so every message is
+			// still buffered when the connections close.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			done := make(chan struct{})
+			stop := func() {
+				stopped, stopLoop := context.WithCancel(context.Background())
+				stopLoop()
+				go func() {
+					defer close(done)
+					broadcastMessages(stopped, db)
+				}()
+			}
+			stopDelivery(ctx, db, stop, done)
+
+			select {
+			case <-done:
+			default:
+				t.Fatal("broadcast loop still running after shutdown")
+			}
+			if n := len(connectionsFor(recipient)); n != 0 {
+				t.Fatalf("%d connections still registered", n)
+			}
+			queued, err := db.DrainOffline(context.Background(), recipient)
+			if err != nil {
+				t.Fatalf("drain offline: %v", err)
+			}
+			var got []string
+			for _, msg := range queued {
+				got = append(got, msg.ID)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("offline queue = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestConcurrentConnectAndSend(t *testing.T) {
+	ts := newTestServer(t)
+	const n = 20
+	users := make([]string, n)
+	for i := range users {
+		users[i] = newTestUser("user")
+	}
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocolChatV1}, HandshakeTimeout: 5 * time.Second}
+	var wg sync.WaitGroup
+	for i, user := range users {
+		wg.Add(1)
+		// Each user connects, sends to the next one and waits for the
+		// message of the previous one, live or replayed.
+		go func(user, next, prev string) {
+			defer wg.Done()
+			conn, _, err := dialer.Dial(ts.wsURL("/ws", url.Values{"recipient": {user}}), nil)
+			if err != nil {
+				t.Errorf("dial %s: %v", user, err)
+				return
+			}
+			defer conn.Close()
+			body := `{"sender":"` + user + `","recipient":"` + next + `","content":"hi"}`
+			resp, err := http.Post(ts.http.URL+"/send", "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Errorf("send %s: %v", user, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("send %s: status %d", user, resp.StatusCode)
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				var frame map[string]any
+				if err := conn.ReadJSON(&frame); err != nil {
+					t.Errorf("%s waiting for %s: %v", user, prev, err)
+					return
+				}
+				if frame["type"] == EventMessage && frame["sender"] == prev {
+					return
+				}
+			}
+		}(user, users[(i+1)%n], users[(i+n-1)%n])
+	}
+	wg.Wait()
+}
+
+func TestEveryConnectionOfARecipientReceives(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	phone, _ := ts.dial(t, bob)
+	laptop, _ := ts.dial(t, bob)
+	sent := ts.send(t, alice, bob, "to every device")
+	for name, conn := range map[string]*websocket.Conn{"phone": phone, "laptop": laptop} {
+		if frame := readUntil(t, conn, EventMessage); frame["id"] != sent.ID {
+			t.Fatalf("%s got %v, want %s", name, frame["id"], sent.ID)
+		}
+	}
+}
+
+func TestReplayAndLiveFramesDoNotInterleave(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	want := map[string]bool{}
+	// Both loops together stay within the burst of the /send rate limit.
+	for i := 0; i < 10; i++ {
+		want[ts.send(t, alice, bob, "queued "+strconv.Itoa(i)).ID] = true
+	}
+
+	conn, _, err := ts.dialQuery(t, url.Values{"recipient": {bob}}, subprotocolChatV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Live messages race the replay onto the same connection.
+	for i := 0; i < 10; i++ {
+		want[ts.send(t, alice, bob, "live "+strconv.Itoa(i)).ID] = true
+	}
+
+	// Interleaved writes would corrupt a frame, which readFrame reports.
+	for len(want) > 0 {
+		frame := readFrame(t, conn)
+		if frame["type"] == EventMessage {
+			delete(want, frame["id"].(string))
+		}
+	}
+}
+
+// withHeartbeat sets pingInterval and pongWait for the test.
+func withHeartbeat(t *testing.T, ping, pong time.Duration) {
+	t.Helper()
+	oldPing, oldPong := pingInterval, pongWait
+	pingInterval, pongWait = ping, pong
+	t.Cleanup(func() { pingInterval, pongWait = oldPing, oldPong })
+}
+
+func TestHeartbeatReapsSilentConnections(t *testing.T) {
+	withHeartbeat(t, 20*time.Millisecond, 100*time.Millisecond)
+	tests := []struct {
+		name string
+		// pongs is whether the client reads, which answers pings.
+		pongs  bool
+		reaped bool
+	}{
+		{"answers pings", true, false},
+		{"never pongs", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			user := newTestUser("user")
+			conn, _ := ts.dial(t, user)
+			if tt.pongs {
+				go func() {
+					for {
+						if _, _, err := conn.ReadMessage(); err != nil {
+							return
+						}
+					}
+				}()
+			}
+			if tt.reaped {
+				waitFor(t, "silent connection to be reaped", func() bool { return len(connectionsFor(user)) == 0 })
+				return
+			}
+			time.Sleep(5 * pongWait)
+			if len(connectionsFor(user)) != 1 {
+				t.Fatal("connection answering pings was closed")
+			}
+		})
+	}
+}
+
+func TestDeliveryAcks(t *testing.T) {
+	tests := []struct {
+		name   string
+		online bool
+		status string
+	}{
+		{"online recipient", true, StatusDelivered},
+		{"offline recipient", false, StatusStored},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			alice, bob := newTestUser("alice"), newTestUser("bob")
+			aliceConn, _ := ts.dial(t, alice)
+			if tt.online {
+				ts.dial(t, bob)
+			}
+			sent := ts.send(t, alice, bob, "hi")
+			ack := readUntil(t, aliceConn, EventAck)
+			if ack["messageId"] != sent.ID || ack["status"] != tt.status {
+				t.Fatalf("ack = %v, want %s for %s", ack, tt.status, sent.ID)
+			}
+		})
+	}
+}
+
+func TestMessagesGetUniqueIDs(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		sent := ts.send(t, alice, bob, "same content")
+		if sent.ID == "" || seen[sent.ID] {
+			t.Fatalf("send %d got ID %q, seen before: %v", i, sent.ID, seen[sent.ID])
+		}
+		seen[sent.ID] = true
+	}
+	stored := storedIDs(t, ts.db, conversationKey(alice, bob))
+	if !reflect.DeepEqual(stored, seen) {
+		t.Fatalf("stored IDs = %v, want %v", stored, seen)
+	}
+}
+
+func TestTypingIsDeliveredButNotStored(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob, carol := newTestUser("alice"), newTestUser("bob"), newTestUser("carol")
+	aliceConn, _ := ts.dial(t, alice)
+	bobConn, _ := ts.dial(t, bob)
+	expectTypingFrom(t, aliceConn, bobConn, map[string]any{"type": EventTyping, "recipient": bob}, alice)
+	if ids := storedIDs(t, ts.db, conversationKey(alice, bob)); len(ids) != 0 {
+		t.Fatalf("history holds %v", ids)
+	}
+	// carol is offline: her typing frame is dropped, not queued. The chat
+	// message after it goes through the same delivery worker, so once it
+	// is queued the typing frame was handled.
+	for _, frame := range []map[string]any{
+		{"type": EventTyping, "recipient": carol},
+		{"recipient": carol, "content": "after typing"},
+	} {
+		if err := aliceConn.WriteJSON(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "chat message to be queued", func() bool {
+		queue, err := ts.db.loadConversation(context.Background(), offlineQueueKey(carol))
+		return err == nil && len(queue) > 0
+	})
+	queue, err := ts.db.DrainOffline(context.Background(), carol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 1 || queue[0].Type == EventTyping {
+		t.Fatalf("carol's offline queue = %+v, want only the chat message", queue)
+	}
+}
+
+func TestShutdownClosesConnections(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	aliceConn, _ := ts.dial(t, alice)
+	bobConn, _ := ts.dial(t, bob)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	closeAllConnections(ctx, ts.db)
+
+	for user, conn := range map[string]*websocket.Conn{alice: aliceConn, bob: bobConn} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var err error
+		for err == nil {
+			_, _, err = conn.ReadMessage()
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway || closeErr.Text != "server shutting down" {
+			t.Fatalf("%s: %v, want close %d", user, err, websocket.CloseGoingAway)
+		}
+		if online, err := ts.db.IsUserOnline(context.Background(), user); err != nil || online {
+			t.Fatalf("%s still online after shutdown: %v", user, err)
+		}
+	}
+}
+
+func TestSendStoresBeforeBroadcasting(t *testing.T) {
+	tests := []struct {
+		name   string
+		down   bool
+		status int
+	}{
+		{"stored", false, http.StatusOK},
+		{"store fails", true, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			alice, bob := newTestUser("alice"), newTestUser("bob")
+			bobConn, _ := ts.dial(t, bob)
+			if tt.down {
+				ts.store.FailAll(errors.New("connection refused"))
+			}
+			var resp struct {
+				Message
+				Code string
+			}
+			if status := ts.do(t, http.MethodPost, "/send", map[string]any{"sender": alice, "recipient": bob, "content": "hi"}, &resp); status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			ts.store.FailAll(nil)
+			ids := storedIDs(t, ts.db, conversationKey(alice, bob))
+			if tt.down {
+				if resp.Code != ErrCodeInternal || len(ids) != 0 {
+					t.Fatalf("code %q, stored %v, want %s and nothing stored", resp.Code, ids, ErrCodeInternal)
+				}
+				// The failed message was not broadcast, so the next one is
+				// the first bob sees.
+				next := ts.send(t, alice, bob, "next")
+				if frame := readUntil(t, bobConn, EventMessage); frame["id"] != next.ID {
+					t.Fatalf("bob got %v, want %s", frame["id"], next.ID)
+				}
+				return
+			}
+			if resp.ID == "" || resp.Timestamp.IsZero() || !ids[resp.ID] {
+				t.Fatalf("response %+v, stored %v, want the stored message", resp.Message, ids)
+			}
+			if frame := readUntil(t, bobConn, EventMessage); frame["id"] != resp.ID {
+				t.Fatalf("bob got %v, want %s", frame["id"], resp.ID)
+			}
+		})
+	}
+}
+
+func TestConnectFailureSendsErrorAndClose(t *testing.T) {
+	tests := []struct {
+		name      string
+		recipient string
+		down      bool
+		code      string
+		closeCode int
+	}{
+		{"presence store fails", newTestUser("bob"), true, ErrCodeInternal, websocket.CloseInternalServerErr},
+		{"no recipient", "", false, ErrCodeInvalidRequest, websocket.ClosePolicyViolation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			if tt.down {
+				ts.store.FailAll(errors.New("connection refused"))
+				t.Cleanup(func() { ts.store.FailAll(nil) })
+			}
+			conn, _, err := ts.dialQuery(t, url.Values{"recipient": {tt.recipient}}, subprotocolChatV1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame := readFrame(t, conn); frame["type"] != EventError || frame["code"] != tt.code {
+				t.Fatalf("first frame = %v, want an %s error", frame, tt.code)
+			}
+			_, _, err = conn.ReadMessage()
+			if !websocket.IsCloseError(err, tt.closeCode) {
+				t.Fatalf("read after error: %v, want close %d", err, tt.closeCode)
+			}
+			if tt.recipient != "" && len(connectionsFor(tt.recipient)) != 0 {
+				t.Fatal("failed connection is still registered")
+			}
+		})
+	}
+}
+
+func TestConnectReplaysOnlyTheLatestPage(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	ctx := context.Background()
+	const stored = 500
+	var ids []string
+	for i := 0; i < stored; i++ {
+		msg := newOutgoing(Message{Sender: alice, Recipient: bob, Content: "msg " + strconv.Itoa(i)})
+		if err := ts.db.StoreMessage(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.db.EnqueueOffline(ctx, bob, msg); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+
+	conn, _, err := ts.dialQuery(t, url.Values{"recipient": {bob}}, subprotocolChatV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replayed []string
+	for {
+		frame := readFrame(t, conn)
+		if frame["type"] == EventHistoryEnd {
+			if frame["count"] != float64(replayPageSize) || frame["omitted"] != float64(stored-replayPageSize) {
+				t.Fatalf("history_end = %v, want count %d, omitted %d", frame, replayPageSize, stored-replayPageSize)
+			}
+			break
+		}
+		if frame["type"] == EventMessage {
+			replayed = append(replayed, frame["id"].(string))
+		}
+	}
+	if want := ids[stored-replayPageSize:]; !reflect.DeepEqual(replayed, want) {
+		t.Fatalf("replayed %d messages, want the latest %d in order", len(replayed), len(want))
+	}
+	if n := len(storedIDs(t, ts.db, conversationKey(alice, bob))); n != stored {
+		t.Fatalf("%d messages stored after the replay, want %d", n, stored)
+	}
+}
+
+func TestHistoryEndArrivesOnceAfterReplay(t *testing.T) {
+	tests := []struct {
+		name   string
+		queued int
+	}{
+		{"nothing queued", 0},
+		{"three queued", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			alice, bob := newTestUser("alice"), newTestUser("bob")
+			for i := 0; i < tt.queued; i++ {
+				ts.send(t, alice, bob, "queued")
+			}
+			conn, _, err := ts.dialQuery(t, url.Values{"recipient": {bob}}, subprotocolChatV1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var replayed int
+			for {
+				frame := readFrame(t, conn)
+				if frame["type"] == EventHistoryEnd {
+					if frame["count"] != float64(tt.queued) || replayed != tt.queued {
+						t.Fatalf("history_end = %v after %d messages, want count %d after all of them", frame, replayed, tt.queued)
+					}
+					break
+				}
+				if frame["type"] == EventMessage {
+					replayed++
+				}
+			}
+			live := ts.send(t, alice, bob, "live")
+			for {
+				frame := readFrame(t, conn)
+				if frame["type"] == EventHistoryEnd {
+					t.Fatalf("second history_end: %v", frame)
+				}
+				if frame["type"] == EventMessage && frame["id"] == live.ID {
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestOfflineDeliveryAcksTheSender(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	aliceConn, _ := ts.dial(t, alice)
+	first := ts.send(t, alice, bob, "one")
+	second := ts.send(t, alice, bob, "two")
+	for _, sent := range []Message{first, second} {
+		if ack := readUntil(t, aliceConn, EventAck); ack["messageId"] != sent.ID || ack["status"] != StatusStored {
+			t.Fatalf("ack = %v, want %s for %s", ack, StatusStored, sent.ID)
+		}
+	}
+
+	ts.dial(t, bob)
+	for _, sent := range []Message{first, second} {
+		if ack := readUntil(t, aliceConn, EventAck); ack["messageId"] != sent.ID || ack["status"] != StatusDelivered {
+			t.Fatalf("ack = %v, want %s for %s", ack, StatusDelivered, sent.ID)
+		}
+	}
+}
+
+func TestServerOwnsTimestampAndSender(t *testing.T) {
+	const secret = "jwt-secret"
+	forged := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		send func(t *testing.T, ts *testServer, token, bob string)
+	}{
+		{"/send", func(t *testing.T, ts *testServer, token, bob string) {
+			header := http.Header{"Authorization": {"Bearer " + token}}
+			body := map[string]any{"sender": "mallory", "recipient": bob, "content": "forged", "timestamp": forged}
+			if status := ts.doWith(t, http.MethodPost, "/send", header, body, nil); status != http.StatusOK {
+				t.Fatalf("send: %d", status)
+			}
+		}},
+		{"websocket frame", func(t *testing.T, ts *testServer, token, bob string) {
+			conn, _, err := ts.dialQuery(t, url.Values{"token": {token}}, subprotocolChatV1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			readUntil(t, conn, EventHistoryEnd)
+			if err := conn.WriteJSON(map[string]any{"type": EventMessage, "recipient": bob, "content": "forged", "timestamp": forged}); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServerWith(t, NewAuthMiddleware(secret))
+			alice, bob := newTestUser("alice"), newTestUser("bob")
+			bobConn, _, err := ts.dialQuery(t, url.Values{"token": {signToken(t, secret, bob, time.Time{})}}, subprotocolChatV1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			readUntil(t, bobConn, EventHistoryEnd)
+			before := time.Now()
+			tt.send(t, ts, signToken(t, secret, alice, time.Time{}), bob)
+
+			frame := readUntil(t, bobConn, EventMessage)
+			history, err := ts.db.loadHistory(context.Background(), conversationKey(alice, bob))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != 1 {
+				t.Fatalf("stored %d messages, want 1", len(history))
+			}
+			stored := history[0]
+			delivered, err := time.Parse(time.RFC3339Nano, frame["timestamp"].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, got := range []struct {
+				sender string
+				at     time.Time
+			}{{frame["sender"].(string), delivered}, {stored.Sender, stored.Timestamp}} {
+				if got.sender != alice || got.at.Before(before) {
+					t.Fatalf("sender %q at %v, want %q at the server's time", got.sender, got.at, alice)
+				}
+			}
+		})
+	}
+}
+
+func TestFrameSenderMustMatchConnection(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	aliceConn, _ := ts.dial(t, alice)
+	bobConn, _ := ts.dial(t, bob)
+
+	tests := []struct {
+		name   string
+		sender string
+		ok     bool
+	}{
+		{"other sender", bob, false},
+		{"unknown sender", "mallory", false},
+		{"own sender", alice, true},
+		{"no sender", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := map[string]any{"type": EventMessage, "recipient": bob, "content": tt.name}
+			if tt.sender != "" {
+				frame["sender"] = tt.sender
+			}
+			if err := aliceConn.WriteJSON(frame); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.ok {
+				if frame := readUntil(t, aliceConn, EventError); frame["code"] != ErrCodeInvalidMessage {
+					t.Fatalf("error = %v, want code %q", frame, ErrCodeInvalidMessage)
+				}
+				return
+			}
+			// Rejected frames were not delivered, so this is the
+			// next message bob sees.
+			if got := readUntil(t, bobConn, EventMessage); got["content"] != tt.name || got["sender"] != alice {
+				t.Fatalf("bob got %v, want %q from %s", got, tt.name, alice)
+			}
+		})
+	}
+	if n := len(storedIDs(t, ts.db, conversationKey(alice, bob))); n != 2 {
+		t.Fatalf("stored %d messages, want the 2 accepted ones", n)
+	}
+}
+
+func TestUndecodableFrameKeepsConnectionOpen(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	aliceConn, _ := ts.dial(t, alice)
+	bobConn, _ := ts.dial(t, bob)
+
+	tests := []struct {
+		name  string
+		frame string
+	}{
+		{"not JSON", "hello?"},
+		{"truncated", `{"type":"message","recipient":"`},
+		{"array", `[1,2,3]`},
+		{"wrong field type", `{"type":"message","content":42}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := aliceConn.WriteMessage(websocket.TextMessage, []byte(tt.frame)); err != nil {
+				t.Fatal(err)
+			}
+			if frame := readUntil(t, aliceConn, EventError); frame["code"] != ErrCodeInvalidMessage {
+				t.Fatalf("error = %v, want code %q", frame, ErrCodeInvalidMessage)
+			}
+			if err := aliceConn.WriteJSON(map[string]any{"type": EventMessage, "recipient": bob, "content": tt.name}); err != nil {
+				t.Fatal(err)
+			}
+			if got := readUntil(t, bobConn, EventMessage); got["content"] != tt.name {
+				t.Fatalf("bob got %v, want %q", got, tt.name)
+			}
+		})
+	}
+	if n := len(connectionsFor(alice)); n != 1 {
+		t.Fatalf("alice has %d connections, want 1", n)
+	}
+}
+
+func TestSentMessageIsEchoedToOtherDevices(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	phone, _ := ts.dial(t, alice)
+	laptop, _ := ts.dial(t, alice)
+	bobConn, _ := ts.dial(t, bob)
+
+	if err := phone.WriteJSON(map[string]any{"type": EventMessage, "recipient": bob, "content": "from the phone"}); err != nil {
+		t.Fatal(err)
+	}
+	sent := readUntil(t, bobConn, EventMessage)
+	if echo := readUntil(t, laptop, EventMessage); echo["id"] != sent["id"] || echo["sender"] != alice {
+		t.Fatalf("laptop got %v, want the echo of %v", echo, sent["id"])
+	}
+	// The phone already shows its own message. Everything it reads up to
+	// bob's reply must not be another copy of it.
+	reply := ts.send(t, bob, alice, "reply")
+	for {
+		frame := readFrame(t, phone)
+		if frame["type"] != EventMessage {
+			continue
+		}
+		if frame["id"] == sent["id"] {
+			t.Fatal("the sending connection got its own message back")
+		}
+		if frame["id"] == reply.ID {
+			break
+		}
+	}
+
+	// A message sent over REST has no sending connection, so every device
+	// gets it.
+	viaREST := ts.send(t, alice, bob, "from the browser")
+	for _, conn := range []*websocket.Conn{phone, laptop} {
+		for readUntil(t, conn, EventMessage)["id"] != viaREST.ID {
+		}
+	}
+}
+
+func TestFrameMessagesArePersisted(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	aliceConn, _ := ts.dial(t, alice)
+	if err := aliceConn.WriteJSON(map[string]any{"type": EventMessage, "recipient": bob, "content": "sent over ws"}); err != nil {
+		t.Fatal(err)
+	}
+	// bob is offline, so alice is told the message was stored.
+	ack := readUntil(t, aliceConn, EventAck)
+	if ack["status"] != StatusStored {
+		t.Fatalf("ack = %v, want %s", ack, StatusStored)
+	}
+
+	var page []Message
+	if status := ts.do(t, http.MethodGet, "/messages?sender="+bob+"&recipient="+alice, nil, &page); status != http.StatusOK {
+		t.Fatalf("history: %d", status)
+	}
+	if len(page) != 1 || page[0].ID != ack["messageId"] || page[0].Content != "sent over ws" || page[0].Timestamp.IsZero() {
+		t.Fatalf("history = %+v, want the frame with an ID and timestamp", page)
+	}
+	_, replayed := ts.dial(t, bob)
+	if len(replayed) == 0 || replayed[len(replayed)-1]["id"] != page[0].ID {
+		t.Fatalf("bob's replay = %v, want %s", replayed, page[0].ID)
+	}
+}
+
+// fillConnSlots takes every free connection slot until the test ends and
+// returns how many it took.
+func fillConnSlots(t *testing.T) int {
+	t.Helper()
+	taken := 0
+	for {
+		select {
+		case connSlots <- struct{}{}:
+			taken++
+			continue
+		default:
+		}
+		break
+	}
+	t.Cleanup(func() {
+		for i := 0; i < taken; i++ {
+			<-connSlots
+		}
+	})
+	return taken
+}
+
+func TestConnectionLimitRejectsHandshake(t *testing.T) {
+	ts := newTestServer(t)
+	expectRejected := func() {
+		t.Helper()
+		_, resp, err := ts.dialQuery(t, url.Values{"recipient": {newTestUser("late")}}, subprotocolChatV1)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("dial with no free slot: %v, want status %d", err, http.StatusServiceUnavailable)
+		}
+		if resp.Header.Get("Retry-After") == "" {
+			t.Fatal("no Retry-After on a rejected handshake")
+		}
+	}
+
+	if fillConnSlots(t) == 0 {
+		t.Fatal("no free connection slot")
+	}
+	expectRejected()
+
+	// A freed slot admits one connection, which holds it until it closes.
+	<-connSlots
+	conn, _ := ts.dial(t, newTestUser("admitted"))
+	fillConnSlots(t)
+	expectRejected()
+	conn.Close()
+	waitFor(t, "the slot to be released", func() bool { return len(connSlots) < cap(connSlots) })
+	// Give back the slot freed above, which the first cleanup releases.
+	connSlots <- struct{}{}
+}
+
+func TestIdleConnectionIsClosed(t *testing.T) {
+	withHeartbeat(t, 10*time.Millisecond, time.Second)
+	var skew atomic.Int64
+	oldClock, oldTimeout := idleClock, idleTimeout
+	idleClock = func() time.Time { return time.Now().Add(time.Duration(skew.Load())) }
+	idleTimeout = time.Minute
+	t.Cleanup(func() { idleClock, idleTimeout = oldClock, oldTimeout })
+
+	ts := newTestServer(t)
+	user := newTestUser("idle")
+	conn, _ := ts.dial(t, user)
+	// Pings alone keep nothing alive, but before the clock moves the
+	// connection is not idle yet.
+	time.Sleep(50 * time.Millisecond)
+	if len(connectionsFor(user)) != 1 {
+		t.Fatal("connection closed before the idle timeout")
+	}
+
+	skew.Store(int64(2 * time.Minute))
+	if frame := readUntil(t, conn, EventError); frame["code"] != ErrCodeIdleTimeout {
+		t.Fatalf("error = %v, want %s", frame, ErrCodeIdleTimeout)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, CloseIdleTimeout) {
+		t.Fatalf("read after idle error: %v, want close %d", err, CloseIdleTimeout)
+	}
+	waitFor(t, "presence to be cleared", func() bool {
+		online, err := ts.db.IsUserOnline(context.Background(), user)
+		return err == nil && !online && len(connectionsFor(user)) == 0
+	})
+}
+
+func TestSendReturnsTheCreatedMessage(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	before := time.Now()
+	var first, second Message
+	for _, out := range []*Message{&first, &second} {
+		if status := ts.do(t, http.MethodPost, "/send", map[string]any{"sender": alice, "recipient": bob, "content": "hi"}, out); status != http.StatusOK {
+			t.Fatalf("send: %d", status)
+		}
+	}
+	for _, m := range []Message{first, second} {
+		if m.ID == "" || m.Timestamp.Before(before) || m.Status != StatusSent || m.Sender != alice || m.Content != "hi" {
+			t.Fatalf("response = %+v, want the created message with an ID, server timestamp and status", m)
+		}
+	}
+	if first.ID == second.ID || second.Seq != first.Seq+1 {
+		t.Fatalf("seq %d then %d with IDs %s and %s, want consecutive seqs and distinct IDs", first.Seq, second.Seq, first.ID, second.ID)
+	}
+}
+
+// trapStore panics on any call for key while armed.
+type trapStore struct {
+	*storetest.MemStore
+	key   string
+	armed *atomic.Bool
+}
+
+func (s trapStore) GetLine(ctx context.Context, key string) (*creditdb.Line, error) {
+	if key == s.key && s.armed.Load() {
+		panic("trapped read of " + key)
+	}
+	return s.MemStore.GetLine(ctx, key)
+}
+
+func (s trapStore) SetLine(ctx context.Context, key, value string) error {
+	if key == s.key && s.armed.Load() {
+		panic("trapped write of " + key)
+	}
+	return s.MemStore.SetLine(ctx, key, value)
+}
+
+func TestDeliveryPanicIsRecovered(t *testing.T) {
+	alice, bob, trapped := newTestUser("alice"), newTestUser("bob"), newTestUser("trapped")
+	armed := &atomic.Bool{}
+	armed.Store(true)
+	// Delivering to trapped while they are offline queues the message,
+	// which panics inside the delivery worker.
+	ts := newTestServerOver(t, nil, func(mem *storetest.MemStore) Store {
+		return trapStore{MemStore: mem, key: offlineQueueKey(trapped), armed: armed}
+	})
+	rec := recordLogs(t)
+	aliceConn, _ := ts.dial(t, alice)
+	bobConn, _ := ts.dial(t, bob)
+
+	lost := ts.send(t, alice, trapped, "boom")
+	waitFor(t, "the panic to be logged", func() bool {
+		return slices.Contains(rec.atLeast(slog.LevelError), "recovered from panic")
+	})
+
+	// Other clients are still served, and so is the worker that panicked,
+	// since messages for one recipient always go to the same worker.
+	sent := ts.send(t, alice, bob, "still there")
+	if frame := readUntil(t, bobConn, EventMessage); frame["id"] != sent.ID {
+		t.Fatalf("bob got %v, want %s", frame["id"], sent.ID)
+	}
+	armed.Store(false)
+	queued := ts.send(t, alice, trapped, "queued")
+	for {
+		ack := readUntil(t, aliceConn, EventAck)
+		if ack["messageId"] == lost.ID {
+			t.Fatalf("ack for the message whose delivery panicked: %v", ack)
+		}
+		if ack["messageId"] == queued.ID {
+			if ack["status"] != StatusStored {
+				t.Fatalf("ack = %v, want %s", ack, StatusStored)
+			}
+			break
+		}
+	}
+}
+
+func TestCloseCodes(t *testing.T) {
+	const secret = "jwt-secret"
+	tests := []struct {
+		name string
+		// open connects a user and makes the server close the connection.
+		open    func(t *testing.T) *websocket.Conn
+		code    int
+		errCode string
+	}{
+		{"kicked", func(t *testing.T) *websocket.Conn {
+			withAdminToken(t, "admin-secret")
+			ts := newTestServer(t)
+			user := newTestUser("kicked")
+			conn, _ := ts.dial(t, user)
+			if status := ts.doWith(t, http.MethodPost, "/admin/kick", http.Header{"X-Admin-Token": {"admin-secret"}}, map[string]any{"user": user}, nil); status != http.StatusOK {
+				t.Fatalf("kick: status %d", status)
+			}
+			return conn
+		}, CloseKicked, ErrCodeKicked},
+		{"token expired", func(t *testing.T) *websocket.Conn {
+			ts := newTestServerWith(t, NewAuthMiddleware(secret))
+			token := signToken(t, secret, newTestUser("expiring"), time.Now().Add(time.Second))
+			conn, _, err := ts.dialQuery(t, url.Values{"token": {token}}, subprotocolChatV1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return conn
+		}, CloseUnauthorized, ErrCodeUnauthorized},
+		{"rate limited", func(t *testing.T) *websocket.Conn {
+			oldLimit, oldBurst := sendRateLimit, sendRateBurst
+			sendRateLimit, sendRateBurst = 0.01, 1
+			t.Cleanup(func() { sendRateLimit, sendRateBurst = oldLimit, oldBurst })
+			ts := newTestServer(t)
+			conn, _ := ts.dial(t, newTestUser("flooder"))
+			bob := newTestUser("bob")
+			for i := 0; i < 2; i++ {
+				if err := conn.WriteJSON(map[string]any{"type": EventMessage, "recipient": bob, "content": "flood"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return conn
+		}, CloseRateLimited, ErrCodeRateLimited},
+		{"idle", func(t *testing.T) *websocket.Conn {
+			withHeartbeat(t, 10*time.Millisecond, time.Second)
+			old := idleTimeout
+			idleTimeout = 20 * time.Millisecond
+			t.Cleanup(func() { idleTimeout = old })
+			ts := newTestServer(t)
+			conn, _ := ts.dial(t, newTestUser("idle"))
+			return conn
+		}, CloseIdleTimeout, ErrCodeIdleTimeout},
+		{"shutdown", func(t *testing.T) *websocket.Conn {
+			ts := newTestServer(t)
+			conn, _ := ts.dial(t, newTestUser("shutdown"))
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			closeAllConnections(ctx, ts.db)
+			return conn
+		}, websocket.CloseGoingAway, ""},
+		{"protocol error", func(t *testing.T) *websocket.Conn {
+			ts := newTestServer(t)
+			conn, _ := ts.dial(t, newTestUser("oversized"))
+			if err := conn.WriteMessage(websocket.TextMessage, make([]byte, maxFrameSize+1)); err != nil {
+				t.Fatal(err)
+			}
+			return conn
+		}, websocket.CloseMessageTooBig, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := tt.open(t)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var errCode string
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					var closeErr *websocket.CloseError
+					if !errors.As(err, &closeErr) || closeErr.Code != tt.code {
+						t.Fatalf("read: %v, want close %d", err, tt.code)
+					}
+					break
+				}
+				var frame map[string]any
+				if json.Unmarshal(data, &frame) == nil && frame["type"] == EventError {
+					errCode, _ = frame["code"].(string)
+				}
+			}
+			if errCode != tt.errCode {
+				t.Fatalf("error event before the close = %q, want %q", errCode, tt.errCode)
+			}
+		})
+	}
+}
+
+func TestEphemeralMessagesAreNeverStored(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob, carol := newTestUser("alice"), newTestUser("bob"), newTestUser("carol")
+	aliceConn, _ := ts.dial(t, alice)
+	bobConn, _ := ts.dial(t, bob)
+	tests := []struct {
+		name      string
+		recipient string
+		frame     bool
+		status    string
+	}{
+		{"online over REST", bob, false, StatusDelivered},
+		{"online as a frame", bob, true, StatusDelivered},
+		{"offline over REST", carol, false, StatusDropped},
+		{"offline as a frame", carol, true, StatusDropped},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := map[string]any{"type": EventMessage, "sender": alice, "recipient": tt.recipient, "content": tt.name, "ephemeral": true}
+			if tt.frame {
+				if err := aliceConn.WriteJSON(body); err != nil {
+					t.Fatal(err)
+				}
+			} else if status := ts.do(t, http.MethodPost, "/send", body, nil); status != http.StatusOK {
+				t.Fatalf("send: status %d", status)
+			}
+			if ack := readUntil(t, aliceConn, EventAck); ack["status"] != tt.status {
+				t.Fatalf("ack = %v, want %s", ack, tt.status)
+			}
+			if tt.recipient == bob {
+				if got := readUntil(t, bobConn, EventMessage); got["content"] != tt.name || got["ephemeral"] != true {
+					t.Fatalf("bob got %v, want the ephemeral %q", got, tt.name)
+				}
+			}
+		})
+	}
+
+	for _, key := range []string{conversationKey(alice, bob), conversationKey(alice, carol), offlineQueueKey(carol), conversationIndexKey(alice)} {
+		if line, err := ts.db.getLine(context.Background(), key); err == nil {
+			t.Errorf("%s = %s after ephemeral messages", key, line.Value)
+		}
+	}
+	// carol connecting later gets nothing.
+	if _, replayed := ts.dial(t, carol); len(replayed) != 1 || replayed[0]["type"] != EventSession {
+		t.Fatalf("carol got %v on connect, want only the session", replayed)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errMessageNotFound  = errors.New("message not found")
+	errNotMessageSender = errors.New("only the sender may edit or delete a message")
+)
+
+// MessageChange tells participants that a stored message was deleted or
+// edited. Message holds the updated message for edits.
+type MessageChange struct {
+	Type      string   `json:"type"`
+	MessageID string   `json:"messageId"`
+	Message   *Message `json:"message,omitempty"`
+}
+
+// deleteMessage removes a message from the conversation between sender (the
+// caller) and recipient. Deleting an unknown ID answers 404, and deleting
+// the other participant's message 403.
+func (r *Router) deleteMessage(c *gin.Context) {
+	sender, err := normalizeUserID(authenticatedUser(c, c.Query("sender")))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "sender: "+err.Error())
+		return
+	}
+	recipient, err := normalizeUserID(c.Query("recipient"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "recipient: "+err.Error())
+		return
+	}
+	id := c.Param("id")
+	if err := r.dbclient.DeleteMessage(c, conversationKey(sender, recipient), id, sender); err != nil {
+		switch err {
+		case errMessageNotFound:
+			respondError(c, http.StatusNotFound, ErrCodeNotFound, err.Error())
+		case errNotMessageSender:
+			respondError(c, http.StatusForbidden, ErrCodeForbidden, err.Error())
+		default:
+			logger.Error("delete message failed", "event", "delete_message", "sender", sender, "recipient", recipient, "error", err)
+			respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to delete message")
+		}
+		return
+	}
+	event := MessageChange{Type: EventDeleted, MessageID: id}
+	notifyUser(sender, event)
+	notifyUser(recipient, event)
+	c.Status(http.StatusNoContent)
+}
+
+// editMessage replaces the content of a message. Only its sender may edit it.
+func (r *Router) editMessage(c *gin.Context) {
+	var req struct {
+		Sender    string `json:"sender"`
+		Recipient string `json:"recipient" binding:"required"`
+		Content   string `json:"content" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	sender, err := normalizeUserID(authenticatedUser(c, req.Sender))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "sender: "+err.Error())
+		return
+	}
+	recipient, err := normalizeUserID(req.Recipient)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "recipient: "+err.Error())
+		return
+	}
+	if req.Content, err = normalizeContent(req.Content); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := validateContent(req.Content); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	id := c.Param("id")
+	edited, err := r.dbclient.EditMessage(c, conversationKey(sender, recipient), id, sender, req.Content)
+	if err != nil {
+		switch err {
+		case errMessageNotFound:
+			respondError(c, http.StatusNotFound, ErrCodeNotFound, err.Error())
+		case errNotMessageSender:
+			respondError(c, http.StatusForbidden, ErrCodeForbidden, err.Error())
+		default:
+			logger.Error("edit message failed", "event", "edit_message", "sender", sender, "recipient", recipient, "error", err)
+			respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to edit message")
+		}
+		return
+	}
+	event := MessageChange{Type: EventEdited, MessageID: id, Message: &edited}
+	notifyUser(sender, event)
+	notifyUser(recipient, event)
+	c.JSON(http.StatusOK, edited)
+}
+
+// EditMessage sets the content of message id to newContent and stamps
+// EditedAt. editor must be the message's sender.
+func (db *DBClient) EditMessage(ctx context.Context, conversationKey, id, editor, newContent string) (Message, error) {
+	defer keyLocks.lock(conversationKey)()
+	messages, err := db.loadHistory(ctx, conversationKey)
+	if err != nil {
+		return Message{}, err
+	}
+	for i := range messages {
+		if messages[i].ID != id {
+			continue
+		}
+		if messages[i].Sender != editor {
+			return Message{}, errNotMessageSender
+		}
+		editedAt := time.Now()
+		messages[i].Content = newContent
+		messages[i].EditedAt = &editedAt
+		if err := db.saveHistory(ctx, conversationKey, messages); err != nil {
+			return Message{}, err
+		}
+		return messages[i], nil
+	}
+	return Message{}, errMessageNotFound
+}
+
+// DeleteMessage removes the message with the given id from the conversation
+// stored under conversationKey. It returns errMessageNotFound if there is no
+// such message. deleter must be the message's sender, unless it is empty
+// for deletes made by the server itself, such as expiry.
+func (db *DBClient) DeleteMessage(ctx context.Context, conversationKey, id, deleter string) error {
+	defer keyLocks.lock(conversationKey)()
+	return db.removeFromHistory(ctx, conversationKey, id, func(m Message) error {
+		if deleter != "" && m.Sender != deleter {
+			return errNotMessageSender
+		}
+		return nil
+	})
+}
+
+// ConversationDeleted tells participants that a conversation was cleared.
+type ConversationDeleted struct {
+	Type         string   `json:"type"`
+	Participants []string `json:"participants"`
+}
+
+// deleteConversation removes the whole history between sender (the caller)
+// and recipient. It answers 204 whether or not anything was stored.
+func (r *Router) deleteConversation(c *gin.Context) {
+	sender, err := normalizeUserID(authenticatedUser(c, c.Query("sender")))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "sender: "+err.Error())
+		return
+	}
+	recipient, err := normalizeUserID(c.Query("recipient"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "recipient: "+err.Error())
+		return
+	}
+	if err := r.dbclient.DeleteConversation(c, sender, recipient); err != nil {
+		logger.Error("delete conversation failed", "event", "delete_conversation", "sender", sender, "recipient", recipient, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to delete conversation")
+		return
+	}
+	event := ConversationDeleted{Type: EventConversationDeleted, Participants: []string{sender, recipient}}
+	notifyUser(sender, event)
+	notifyUser(recipient, event)
+	c.Status(http.StatusNoContent)
+}
+
+// DeleteConversation removes the conversation between user and peer, and
+// each of them from the other's partner index. A conversation that does not
+// exist is not an error. The index is updated under the conversation lock,
+// as in StoreMessage, so a message stored right after the delete adds the
+// partners back.
+func (db *DBClient) DeleteConversation(ctx context.Context, user, peer string) error {
+	key := conversationKey(user, peer)
+	defer keyLocks.lock(key)()
+	if err := db.deleteHistory(ctx, key); err != nil {
+		return err
+	}
+	if err := db.removeConversationPartner(ctx, user, peer); err != nil {
+		return err
+	}
+	return db.removeConversationPartner(ctx, peer, user)
+}
+
+// searchMessages returns messages of the conversation between sender (the
+// caller) and recipient whose content contains q, ignoring case.
+func (r *Router) searchMessages(c *gin.Context) {
+	sender, err := normalizeUserID(authenticatedUser(c, c.Query("sender")))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "sender: "+err.Error())
+		return
+	}
+	recipient, err := normalizeUserID(c.Query("recipient"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "recipient: "+err.Error())
+		return
+	}
+	query := normalizeText(strings.TrimSpace(c.Query("q")))
+	if query == "" {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "q is required")
+		return
+	}
+	limit := 50
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "limit must be between 1 and 200")
+			return
+		}
+		limit = n
+	}
+
+	messages, err := r.dbclient.SearchMessages(c, conversationKey(sender, recipient), query, limit)
+	if err != nil {
+		logger.Error("search messages failed", "event", "search", "sender", sender, "recipient", recipient, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to search messages")
+		return
+	}
+	c.JSON(http.StatusOK, messages)
+}
+
+// SearchMessages returns up to limit messages, newest first, whose content
+// contains query case-insensitively. There is no index: the whole stored
+// conversation is decoded and scanned on every call, which is bounded by
+// maxStoredMessages.
+func (db *DBClient) SearchMessages(ctx context.Context, conversationKey, query string, limit int) ([]Message, error) {
+	messages, err := db.loadHistory(ctx, conversationKey)
+	if err != nil {
+		return nil, err
+	}
+	query = strings.ToLower(query)
+	found := []Message{}
+	for i := len(messages) - 1; i >= 0 && len(found) < limit; i-- {
+		if strings.Contains(strings.ToLower(messages[i].Content), query) {
+			found = append(found, messages[i])
+		}
+	}
+	return found, nil
+}
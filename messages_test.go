@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ayo-ajayi/realtime-chat-creditdb-websocket/storetest"
+	"github.com/gorilla/websocket"
+)
+
+func TestDeleteMessage(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	fromAlice := ts.send(t, alice, bob, "from alice")
+	fromBob := ts.send(t, bob, alice, "from bob")
+	kept := ts.send(t, alice, bob, "kept")
+
+	tests := []struct {
+		name    string
+		caller  string
+		peer    string
+		id      string
+		status  int
+		deleted bool
+	}{
+		{"peer's message", bob, alice, fromAlice.ID, http.StatusForbidden, false},
+		{"own message", alice, bob, fromAlice.ID, http.StatusNoContent, true},
+		{"already deleted", alice, bob, fromAlice.ID, http.StatusNotFound, true},
+		{"unknown ID", alice, bob, "unknown", http.StatusNotFound, false},
+		{"other side's own message", bob, alice, fromBob.ID, http.StatusNoContent, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "/messages/" + tt.id + "?" + url.Values{"sender": {tt.caller}, "recipient": {tt.peer}}.Encode()
+			if status := ts.do(t, http.MethodDelete, path, nil, nil); status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			if tt.id == "unknown" {
+				return
+			}
+			if stored := storedIDs(t, ts.db, conversationKey(alice, bob)); stored[tt.id] == tt.deleted {
+				t.Fatalf("message stored = %v after delete, want deleted %v", stored[tt.id], tt.deleted)
+			}
+		})
+	}
+	if !storedIDs(t, ts.db, conversationKey(alice, bob))[kept.ID] {
+		t.Fatal("an unrelated message was deleted")
+	}
+}
+
+func TestDeleteMessageNotifiesBothParticipants(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	sent := ts.send(t, alice, bob, "unsend me")
+	aliceConn, _ := ts.dial(t, alice)
+	bobConn, _ := ts.dial(t, bob)
+
+	path := "/messages/" + sent.ID + "?" + url.Values{"sender": {alice}, "recipient": {bob}}.Encode()
+	if status := ts.do(t, http.MethodDelete, path, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("status = %d", status)
+	}
+	for _, conn := range []*websocket.Conn{aliceConn, bobConn} {
+		if frame := readUntil(t, conn, EventDeleted); frame["messageId"] != sent.ID {
+			t.Fatalf("deleted event = %v, want %s", frame, sent.ID)
+		}
+	}
+}
+
+func TestEditMessage(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	sent := ts.send(t, alice, bob, "typo")
+	aliceConn, _ := ts.dial(t, alice)
+	bobConn, _ := ts.dial(t, bob)
+
+	tests := []struct {
+		name    string
+		caller  string
+		peer    string
+		id      string
+		status  int
+		content string
+	}{
+		{"peer's message", bob, alice, sent.ID, http.StatusForbidden, "typo"},
+		{"unknown ID", alice, bob, "unknown", http.StatusNotFound, "typo"},
+		{"own message", alice, bob, sent.ID, http.StatusOK, "fixed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var edited Message
+			status := ts.do(t, http.MethodPatch, "/messages/"+tt.id, map[string]any{"sender": tt.caller, "recipient": tt.peer, "content": "fixed"}, &edited)
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			history, err := ts.db.loadHistory(context.Background(), conversationKey(alice, bob))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != 1 || history[0].Content != tt.content {
+				t.Fatalf("history = %+v, want %q", history, tt.content)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			if edited.EditedAt == nil || history[0].EditedAt == nil {
+				t.Fatalf("edit not stamped: response %+v, stored %+v", edited, history[0])
+			}
+			for _, conn := range []*websocket.Conn{aliceConn, bobConn} {
+				if frame := readUntil(t, conn, EventEdited); frame["messageId"] != sent.ID {
+					t.Fatalf("edited event = %v, want %s", frame, sent.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteConversation(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+	}{
+		{"existing", true},
+		{"never written", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			alice, bob, carol := newTestUser("alice"), newTestUser("bob"), newTestUser("carol")
+			if tt.existing {
+				ts.send(t, alice, bob, "one")
+				ts.send(t, bob, alice, "two")
+			}
+			kept := ts.send(t, alice, carol, "kept")
+			aliceConn, _ := ts.dial(t, alice)
+			bobConn, _ := ts.dial(t, bob)
+
+			path := "/conversations?" + url.Values{"sender": {alice}, "recipient": {bob}}.Encode()
+			if status := ts.do(t, http.MethodDelete, path, nil, nil); status != http.StatusNoContent {
+				t.Fatalf("status = %d, want %d", status, http.StatusNoContent)
+			}
+			if ids := storedIDs(t, ts.db, conversationKey(alice, bob)); len(ids) != 0 {
+				t.Fatalf("stored after delete: %v", ids)
+			}
+			if !storedIDs(t, ts.db, conversationKey(alice, carol))[kept.ID] {
+				t.Fatal("another conversation was deleted")
+			}
+			for _, conn := range []*websocket.Conn{aliceConn, bobConn} {
+				readUntil(t, conn, EventConversationDeleted)
+			}
+		})
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	first := ts.send(t, alice, bob, "Lunch at noon?")
+	ts.send(t, bob, alice, "sure")
+	second := ts.send(t, bob, alice, "lunch was great")
+	third := ts.send(t, alice, bob, "LUNCH again tomorrow")
+
+	tests := []struct {
+		name  string
+		q     string
+		limit string
+		want  []string
+	}{
+		{"matches, newest first", "lunch", "", []string{third.ID, second.ID, first.ID}},
+		{"case-insensitive", "NOON", "", []string{first.ID}},
+		{"no match", "dinner", "", []string{}},
+		{"limit", "lunch", "2", []string{third.ID, second.ID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := url.Values{"sender": {bob}, "recipient": {alice}, "q": {tt.q}}
+			if tt.limit != "" {
+				query.Set("limit", tt.limit)
+			}
+			var found []Message
+			if status := ts.do(t, http.MethodGet, "/search?"+query.Encode(), nil, &found); status != http.StatusOK {
+				t.Fatalf("status = %d", status)
+			}
+			got := []string{}
+			for _, m := range found {
+				got = append(got, m.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("found %v, want %v", got, tt.want)
+			}
+		})
+	}
+	for _, limit := range []string{"0", "201", "many"} {
+		query := url.Values{"sender": {bob}, "recipient": {alice}, "q": {"lunch"}, "limit": {limit}}
+		if status := ts.do(t, http.MethodGet, "/search?"+query.Encode(), nil, nil); status != http.StatusBadRequest {
+			t.Fatalf("limit %s: status %d, want %d", limit, status, http.StatusBadRequest)
+		}
+	}
+}
+
+// storedIDs returns the IDs in the history stored under key.
+func storedIDs(t *testing.T, db *DBClient, key string) map[string]bool {
+	t.Helper()
+	history, err := db.loadHistory(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]bool, len(history))
+	for _, m := range history {
+		ids[m.ID] = true
+	}
+	return ids
+}
+
+// withHistoryPageSize sets historyPageSize for the test.
+func withHistoryPageSize(t testing.TB, n int) {
+	t.Helper()
+	old := historyPageSize
+	historyPageSize = n
+	t.Cleanup(func() { historyPageSize = old })
+}
+
+// withMaxStoredMessages sets maxStoredMessages for the test.
+func withMaxStoredMessages(t testing.TB, n int) {
+	t.Helper()
+	old := maxStoredMessages
+	maxStoredMessages = n
+	t.Cleanup(func() { maxStoredMessages = old })
+}
+
+func TestStoreTrimsPastTheCap(t *testing.T) {
+	const limit, total = 10, 25
+	tests := []struct {
+		name     string
+		pageSize int
+	}{
+		{"one message per page", 1},
+		{"pages of four", 4},
+		{"pages of the cap", limit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withHistoryPageSize(t, tt.pageSize)
+			withMaxStoredMessages(t, limit)
+			db := NewDBClientFromStore(storetest.NewMemStore())
+			ctx := context.Background()
+			var ids []string
+			for i := 0; i < total; i++ {
+				msg := Message{ID: "m" + strconv.Itoa(i), Sender: "alice", Recipient: "bob", Content: "hi"}
+				if err := db.StoreMessage(ctx, msg); err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, msg.ID)
+			}
+			history, err := db.loadHistory(ctx, conversationKey("alice", "bob"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Whole pages are dropped, so up to a page less one extra
+			// message is kept.
+			if len(history) < limit || len(history) > limit+tt.pageSize-1 {
+				t.Fatalf("kept %d messages, want %d to %d", len(history), limit, limit+tt.pageSize-1)
+			}
+			var got []string
+			for _, m := range history {
+				got = append(got, m.ID)
+			}
+			if want := ids[total-len(got):]; !reflect.DeepEqual(got, want) {
+				t.Fatalf("kept %v, want the most recent %v", got, want)
+			}
+			pages := 0
+			for key := range lineValues(t, db) {
+				if strings.HasPrefix(key, conversationKey("alice", "bob")+historyPageInfix) {
+					pages++
+				}
+			}
+			if want := (len(history) + tt.pageSize - 1) / tt.pageSize; pages != want {
+				t.Fatalf("%d history pages stored, want %d", pages, want)
+			}
+		})
+	}
+}
+
+func TestRetrieveStoredMessagesSince(t *testing.T) {
+	// Ten messages over pages of four, a second apart.
+	withHistoryPageSize(t, 4)
+	db := NewDBClientFromStore(storetest.NewMemStore())
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var ids []string
+	for i := 0; i < 10; i++ {
+		msg := Message{ID: "m" + strconv.Itoa(i), Sender: "alice", Recipient: "bob", Content: "hi", Timestamp: start.Add(time.Duration(i) * time.Second)}
+		if err := db.StoreMessage(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	tests := []struct {
+		name   string
+		cursor string
+		limit  int
+		want   []string
+	}{
+		{"ID in the first page", "m1", 50, ids[2:]},
+		{"ID at the end of a page", "m3", 50, ids[4:]},
+		{"latest ID", "m9", 50, []string{}},
+		{"time between messages", start.Add(4500 * time.Millisecond).Format(time.RFC3339Nano), 50, ids[5:]},
+		{"time of a message", start.Add(4 * time.Second).Format(time.RFC3339), 50, ids[5:]},
+		{"time before everything", start.Add(-time.Hour).Format(time.RFC3339), 50, ids},
+		{"time after everything", start.Add(time.Hour).Format(time.RFC3339), 50, []string{}},
+		{"limit keeps the latest after the cursor", "m1", 3, ids[7:]},
+		{"unknown ID", "m42", 3, ids[7:]},
+		{"malformed time", "yesterday", 3, ids[7:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The conversation is the same from either side.
+			for _, m := range []Message{{Sender: "alice", Recipient: "bob"}, {Sender: "bob", Recipient: "alice"}} {
+				messages, err := db.RetrieveStoredMessagesSince(ctx, m, tt.cursor, tt.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := []string{}
+				for _, m := range messages {
+					got = append(got, m.ID)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("after %q: got %v, want %v", tt.cursor, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestConnectReplaysSinceCursor(t *testing.T) {
+	withHistoryPageSize(t, 2)
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	// bob gets every message live, so none is queued for him.
+	live, _ := ts.dial(t, bob)
+	var sent []Message
+	for i := 0; i < 5; i++ {
+		sent = append(sent, ts.send(t, alice, bob, "m"+strconv.Itoa(i)))
+		readUntil(t, live, EventMessage)
+	}
+	live.Close()
+	waitFor(t, "bob to disconnect", func() bool { return len(connectionsFor(bob)) == 0 })
+
+	// A device that last saw the second message catches up on the rest,
+	// which span several history pages.
+	conn, _, err := ts.dialQuery(t, url.Values{"recipient": {bob}, "sender": {alice}, "since": {sent[1].ID}}, subprotocolChatV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for {
+		frame := readFrame(t, conn)
+		if frame["type"] == EventHistoryEnd {
+			break
+		}
+		if frame["type"] == EventMessage {
+			got = append(got, frame["id"].(string))
+		}
+	}
+	var want []string
+	for _, m := range sent[2:] {
+		want = append(want, m.ID)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed %v, want %v", got, want)
+	}
+}
+
+// BenchmarkAppendHistory stores one message in a conversation already at
+// a 10k message cap, either appending to the last page or rewriting the
+// whole history as a single blob did.
+func BenchmarkAppendHistory(b *testing.B) {
+	const size = 10000
+	withMaxStoredMessages(b, size)
+	existing := make([]Message, size)
+	for i := range existing {
+		existing[i] = Message{ID: "m" + strconv.Itoa(i), Sender: "alice", Recipient: "bob", Content: "a message of some typical length", Timestamp: time.Now()}
+	}
+	key := conversationKey("alice", "bob")
+	for _, bb := range []struct {
+		name   string
+		append func(db *DBClient, history []Message, msg Message) ([]Message, error)
+	}{
+		{"paged", func(db *DBClient, history []Message, msg Message) ([]Message, error) {
+			_, err := db.appendHistory(context.Background(), key, msg)
+			return history, err
+		}},
+		{"whole history", func(db *DBClient, history []Message, msg Message) ([]Message, error) {
+			history = trimHistory(append(history, msg))
+			return history, db.saveConversation(context.Background(), key, history)
+		}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			db := NewDBClientFromStore(storetest.NewMemStore())
+			if err := db.saveHistory(context.Background(), key, existing); err != nil {
+				b.Fatal(err)
+			}
+			history := slices.Clone(existing)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var err error
+				if history, err = bb.append(db, history, Message{ID: "new" + strconv.Itoa(i), Sender: "alice", Recipient: "bob", Content: "hi", Timestamp: time.Now()}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// lineValues returns every line of db by key.
+func lineValues(t *testing.T, db *DBClient) map[string]string {
+	t.Helper()
+	lines, err := db.getAllLines(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]string, len(lines))
+	for _, line := range lines {
+		values[line.Key] = line.Value
+	}
+	return values
+}
+
+func TestDeleteMessageRewritesOnlyItsPage(t *testing.T) {
+	withHistoryPageSize(t, 2)
+	tests := []struct {
+		name    string
+		index   int
+		changed []int
+		// last is the message the last-message cache points at after.
+		last int
+	}{
+		{"oldest page", 0, []int{0}, 4},
+		{"middle page", 3, []int{1}, 4},
+		{"newest message", 4, []int{2}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := NewDBClientFromStore(storetest.NewMemStore())
+			alice, bob := newTestUser("alice"), newTestUser("bob")
+			key := conversationKey(alice, bob)
+			var sent []Message
+			for i := 0; i < 5; i++ {
+				msg := Message{ID: newTestUser("msg"), Sender: alice, Recipient: bob, Content: strconv.Itoa(i)}
+				if err := db.StoreMessage(context.Background(), msg); err != nil {
+					t.Fatal(err)
+				}
+				sent = append(sent, msg)
+			}
+			before := lineValues(t, db)
+
+			if err := db.DeleteMessage(context.Background(), key, sent[tt.index].ID, alice); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]bool{}
+			for _, n := range tt.changed {
+				want[historyPageKey(key, n)] = true
+			}
+			if tt.last != 4 {
+				want[lastMessageKey(key)] = true
+			}
+			after := lineValues(t, db)
+			got := map[string]bool{}
+			for k, v := range after {
+				if before[k] != v {
+					got[k] = true
+				}
+			}
+			for k := range before {
+				if _, ok := after[k]; !ok {
+					got[k] = true
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("changed lines = %v, want %v", got, want)
+			}
+
+			history, err := db.loadHistory(context.Background(), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantHistory := append(append([]Message{}, sent[:tt.index]...), sent[tt.index+1:]...)
+			if len(history) != len(wantHistory) {
+				t.Fatalf("history has %d messages, want %d", len(history), len(wantHistory))
+			}
+			for i := range history {
+				if history[i].ID != wantHistory[i].ID {
+					t.Fatalf("history[%d] = %s, want %s", i, history[i].ID, wantHistory[i].ID)
+				}
+			}
+			last, ok, err := db.lastMessage(context.Background(), key)
+			if err != nil || !ok || last.ID != sent[tt.last].ID {
+				t.Fatalf("last message = %s, %v, %v, want %s", last.ID, ok, err, sent[tt.last].ID)
+			}
+		})
+	}
+}
+
+func TestGetMessagesPagination(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		msg := Message{ID: "m" + strconv.Itoa(i), Sender: alice, Recipient: bob, Content: strconv.Itoa(i), Timestamp: base.Add(time.Duration(i) * time.Minute)}
+		if err := ts.db.StoreMessage(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name      string
+		recipient string
+		query     string
+		status    int
+		want      []string
+	}{
+		{"empty conversation", newTestUser("nobody"), "", http.StatusOK, []string{}},
+		{"partial page", bob, "&limit=10", http.StatusOK, []string{"m4", "m3", "m2", "m1", "m0"}},
+		{"full page", bob, "&limit=3", http.StatusOK, []string{"m4", "m3", "m2"}},
+		{"next page", bob, "&limit=3&before=" + url.QueryEscape(base.Add(2*time.Minute).Format(time.RFC3339Nano)), http.StatusOK, []string{"m1", "m0"}},
+		{"default limit", bob, "", http.StatusOK, []string{"m4", "m3", "m2", "m1", "m0"}},
+		{"limit too large", bob, "&limit=201", http.StatusBadRequest, nil},
+		{"bad before", bob, "&before=yesterday", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var page []Message
+			var out any = &page
+			if tt.status != http.StatusOK {
+				out = nil
+			}
+			status := ts.do(t, http.MethodGet, "/messages?sender="+alice+"&recipient="+tt.recipient+tt.query, nil, out)
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			got := []string{}
+			for _, m := range page {
+				got = append(got, m.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("page = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	activeConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chat_active_connections",
+		Help: "Open WebSocket connections.",
+	})
+	messagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_messages_total",
+		Help: "Chat messages by outcome: sent, delivered, stored or dropped.",
+	}, []string{"status"})
+	dbErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_db_errors_total",
+		Help: "Failed creditdb operations, not counting not-found answers.",
+	}, []string{"operation"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "chat_broadcast_queue_depth",
+		Help: "Messages waiting in the broadcast buffer.",
+	}, func() float64 { return float64(len(broadcast)) })
+)
+
+// messageCounts mirrors messagesTotal for /stats, which should not need a
+// Prometheus scrape to read.
+var messageCounts = map[string]*atomic.Int64{
+	StatusSent:      {},
+	StatusDelivered: {},
+	StatusStored:    {},
+	StatusDropped:   {},
+}
+
+func countMessage(status string) {
+	messagesTotal.WithLabelValues(status).Inc()
+	if n, ok := messageCounts[status]; ok {
+		n.Add(1)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape returns the value of the sample named series, such as
+// `chat_messages_total{status="sent"}`, in the /metrics output.
+func (ts *testServer) scrape(t *testing.T, series string) float64 {
+	t.Helper()
+	resp, err := ts.http.Client().Get(ts.http.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/metrics: status %d", resp.StatusCode)
+	}
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		if value, ok := strings.CutPrefix(lines.Text(), series+" "); ok {
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+	}
+	return 0
+}
+
+func TestMetricsCountMessages(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	bobConn, _ := ts.dial(t, bob)
+	tests := []struct {
+		series string
+		delta  float64
+	}{
+		{`chat_messages_total{status="sent"}`, 1},
+		{`chat_messages_total{status="delivered"}`, 1},
+	}
+	before := make(map[string]float64)
+	for _, tt := range tests {
+		before[tt.series] = ts.scrape(t, tt.series)
+	}
+	ts.send(t, alice, bob, "counted")
+	readUntil(t, bobConn, EventMessage)
+	for _, tt := range tests {
+		waitFor(t, tt.series, func() bool { return ts.scrape(t, tt.series)-before[tt.series] == tt.delta })
+	}
+	if n := ts.scrape(t, "chat_active_connections"); n < 1 {
+		t.Fatalf("chat_active_connections = %v with bob connected", n)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/creditdb/go-creditdb"
+	"github.com/gin-gonic/gin"
+)
+
+// A user can mute a direct conversation or a room. Its messages still
+// arrive as usual, but the notification-style events around it do not:
+// typing indicators, read receipts, delivery acks and presence of a muted
+// peer, and webhook calls for messages queued while the user is offline.
+
+func muteKey(user string) string {
+	return "muted:" + keyPart(user)
+}
+
+// muteTarget names what a mute applies to: a peer's user ID, or a room as
+// "room:<id>".
+func muteTarget(peer, roomID string) string {
+	if roomID != "" {
+		return "room:" + roomID
+	}
+	return peer
+}
+
+// muteConversation mutes {"peer"} or {"roomId"} for {"user"}, the caller.
+func (r *Router) muteConversation(c *gin.Context) {
+	var req struct {
+		User   string `json:"user"`
+		Peer   string `json:"peer" binding:"required_without=RoomID"`
+		RoomID string `json:"roomId"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	r.updateMutes(c, authenticatedUser(c, req.User), req.Peer, req.RoomID, true)
+}
+
+// unmuteConversation unmutes ?peer= or ?roomId= for ?user=, the caller.
+func (r *Router) unmuteConversation(c *gin.Context) {
+	r.updateMutes(c, authenticatedUser(c, c.Query("user")), c.Query("peer"), c.Query("roomId"), false)
+}
+
+func (r *Router) updateMutes(c *gin.Context, user, peer, roomID string, mute bool) {
+	user, err := normalizeUserID(user)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "user: "+err.Error())
+		return
+	}
+	if roomID == "" {
+		if peer, err = normalizeUserID(peer); err != nil {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "peer: "+err.Error())
+			return
+		}
+		if peer == user {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "users cannot mute themselves")
+			return
+		}
+	}
+	target := muteTarget(peer, roomID)
+	if mute {
+		err = r.dbclient.Mute(c, user, target)
+	} else {
+		err = r.dbclient.Unmute(c, user, target)
+	}
+	if err != nil {
+		logger.Error("update mutes failed", "event", "mute", "user", user, "target", target, "mute", mute, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to update mutes")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Mutes returns the mute targets of user.
+func (db *DBClient) Mutes(ctx context.Context, user string) ([]string, error) {
+	line, err := db.getLine(ctx, muteKey(user))
+	if err == creditdb.ErrNotFound {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	muted := []string{}
+	if err := json.Unmarshal([]byte(line.Value), &muted); err != nil {
+		return nil, err
+	}
+	return muted, nil
+}
+
+// Mute adds target to user's mutes. Muting twice is a no-op.
+func (db *DBClient) Mute(ctx context.Context, user, target string) error {
+	key := muteKey(user)
+	defer keyLocks.lock(key)()
+	muted, err := db.Mutes(ctx, user)
+	if err != nil || contains(muted, target) {
+		return err
+	}
+	muted = append(muted, target)
+	if err := db.saveIDList(ctx, key, muted); err != nil {
+		return err
+	}
+	cacheMutes(user, muted)
+	return nil
+}
+
+// Unmute removes target from user's mutes.
+func (db *DBClient) Unmute(ctx context.Context, user, target string) error {
+	key := muteKey(user)
+	defer keyLocks.lock(key)()
+	muted, err := db.Mutes(ctx, user)
+	if err != nil {
+		return err
+	}
+	kept := []string{}
+	for _, m := range muted {
+		if m != target {
+			kept = append(kept, m)
+		}
+	}
+	switch {
+	case len(kept) == len(muted):
+		return nil
+	case len(kept) == 0:
+		err = db.deleteQuietly(ctx, key)
+	default:
+		err = db.saveIDList(ctx, key, kept)
+	}
+	if err != nil {
+		return err
+	}
+	cacheMutes(user, kept)
+	return nil
+}
+
+// muteCacheTTL bounds how long isMuted trusts the mutes it loaded. Every
+// typing frame, ack and presence change consults the mutes of its
+// recipient, so they are cached rather than read from creditdb each time.
+// Mute and Unmute update the cache of this instance at once; the TTL only
+// delays changes made through other instances.
+const muteCacheTTL = 5 * time.Second
+
+type cachedMutes struct {
+	targets []string
+	loaded  time.Time
+}
+
+var (
+	muteCache      = make(map[string]cachedMutes)
+	muteCacheMutex sync.Mutex
+)
+
+func cacheMutes(user string, targets []string) {
+	muteCacheMutex.Lock()
+	defer muteCacheMutex.Unlock()
+	now := time.Now()
+	// Expired entries are only dropped here, once there are many of them.
+	if len(muteCache) >= 10000 {
+		for u, cached := range muteCache {
+			if now.Sub(cached.loaded) > muteCacheTTL {
+				delete(muteCache, u)
+			}
+		}
+	}
+	muteCache[user] = cachedMutes{targets: targets, loaded: now}
+}
+
+// forgetMutes drops the cached mutes of user, whose mutes were deleted.
+func forgetMutes(user string) {
+	muteCacheMutex.Lock()
+	defer muteCacheMutex.Unlock()
+	delete(muteCache, user)
+}
+
+// isMuted reports whether user muted target. Notifications are best
+// effort, so a failed lookup counts as not muted.
+func isMuted(db *DBClient, user, target string) bool {
+	muteCacheMutex.Lock()
+	cached, ok := muteCache[user]
+	muteCacheMutex.Unlock()
+	if ok && time.Since(cached.loaded) <= muteCacheTTL {
+		return contains(cached.targets, target)
+	}
+	muted, err := db.Mutes(context.Background(), user)
+	if err != nil {
+		logger.Warn("load mutes failed", "event", "mute", "user", user, "error", err)
+		return false
+	}
+	cacheMutes(user, muted)
+	return contains(muted, target)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/ayo-ajayi/realtime-chat-creditdb-websocket/storetest"
+)
+
+func TestMutedConversationEmitsNoNotifications(t *testing.T) {
+	tests := []struct {
+		name  string
+		muted bool
+	}{
+		{"muted", true},
+		{"not muted", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			alice, bob := newTestUser("alice"), newTestUser("bob")
+			if tt.muted {
+				if status := ts.do(t, http.MethodPost, "/mute", map[string]any{"user": alice, "peer": bob}, nil); status != http.StatusNoContent {
+					t.Fatalf("mute: %d", status)
+				}
+			}
+			aliceConn, _ := ts.dial(t, alice)
+			aliceConn.WriteJSON(map[string]any{"type": EventSubscribe, "users": []string{bob}})
+			readUntil(t, aliceConn, EventPresence) // the snapshot answering the subscription
+
+			bobConn, _ := ts.dial(t, bob)
+			toBob := ts.send(t, alice, bob, "to bob")
+			readUntil(t, bobConn, EventMessage)
+			ts.do(t, http.MethodPost, "/read", map[string]any{"reader": bob, "sender": alice, "ids": []string{toBob.ID}}, nil)
+			bobConn.WriteJSON(map[string]any{"type": EventTyping, "recipient": alice})
+			fromBob := ts.send(t, bob, alice, "from bob")
+
+			notifications := map[string]bool{}
+			for {
+				frame := readFrame(t, aliceConn)
+				if frame["type"] == EventMessage && frame["id"] == fromBob.ID {
+					break
+				}
+				notifications[frame["type"].(string)] = true
+			}
+			if tt.muted {
+				for _, kind := range []string{EventPresence, EventAck, EventRead, EventTyping} {
+					if notifications[kind] {
+						t.Errorf("muted conversation emitted a %s event", kind)
+					}
+				}
+				return
+			}
+			// Unmuted, the same actions notify alice. Events that are
+			// still on their way arrive after bob's message.
+			for _, kind := range []string{EventPresence, EventAck, EventRead, EventTyping} {
+				if !notifications[kind] {
+					readUntil(t, aliceConn, kind)
+				}
+			}
+		})
+	}
+}
+
+func TestIsMutedCachesMutes(t *testing.T) {
+	store := storetest.NewMemStore()
+	db := NewDBClientFromStore(store)
+	alice, bob, carol := newTestUser("alice"), newTestUser("bob"), newTestUser("carol")
+	ctx := context.Background()
+	if err := db.Mute(ctx, alice, bob); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := store.Calls()
+	for i := 0; i < 10; i++ {
+		if !isMuted(db, alice, bob) || isMuted(db, alice, carol) {
+			t.Fatal("wrong mute state")
+		}
+	}
+	if got := store.Calls() - calls; got != 0 {
+		t.Fatalf("isMuted made %d store calls, want them served from the cache", got)
+	}
+
+	if err := db.Unmute(ctx, alice, bob); err != nil {
+		t.Fatal(err)
+	}
+	if isMuted(db, alice, bob) {
+		t.Fatal("unmute is not seen by isMuted")
+	}
+	if err := db.Mute(ctx, alice, carol); err != nil {
+		t.Fatal(err)
+	}
+	if !isMuted(db, alice, carol) {
+		t.Fatal("mute is not seen by isMuted")
+	}
+}
+
+func TestUnmuteRestoresNotifications(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	ts.do(t, http.MethodPost, "/mute", map[string]any{"user": alice, "peer": bob}, nil)
+	path := "/mute?" + url.Values{"user": {alice}, "peer": {bob}}.Encode()
+	if status := ts.do(t, http.MethodDelete, path, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("unmute: %d", status)
+	}
+	aliceConn, _ := ts.dial(t, alice)
+	bobConn, _ := ts.dial(t, bob)
+	bobConn.WriteJSON(map[string]any{"type": EventTyping, "recipient": alice})
+	if frame := readUntil(t, aliceConn, EventTyping); frame["sender"] != bob {
+		t.Fatalf("typing frame = %v", frame)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+
+	"github.com/creditdb/go-creditdb"
+)
+
+// The offline queue holds messages that could not be delivered live. It is
+// replayed and cleared when the recipient connects; the full history stays
+// in the conversation keys. It keeps the newest maxOfflineMessages; older
+// ones are only in history.
+var maxOfflineMessages = envInt("MAX_OFFLINE_MESSAGES", 500)
+
+func offlineQueueKey(user string) string {
+	return "undelivered:" + keyPart(user)
+}
+
+// EnqueueOffline appends msg to user's undelivered queue.
+func (db *DBClient) EnqueueOffline(ctx context.Context, user string, msg Message) error {
+	key := offlineQueueKey(user)
+	defer keyLocks.lock(key)()
+	queue, err := db.loadConversation(ctx, key)
+	if err != nil {
+		return err
+	}
+	return db.saveConversation(ctx, key, capOffline(user, append(queue, msg)))
+}
+
+// capOffline keeps the newest maxOfflineMessages of user's queue.
+func capOffline(user string, queue []Message) []Message {
+	if len(queue) <= maxOfflineMessages {
+		return queue
+	}
+	logger.Warn("offline queue full, dropping oldest", "event", "offline_queue", "recipient", user, "dropped", len(queue)-maxOfflineMessages)
+	return queue[len(queue)-maxOfflineMessages:]
+}
+
+// DrainOffline returns user's undelivered messages, oldest first, and clears
+// the queue.
+func (db *DBClient) DrainOffline(ctx context.Context, user string) ([]Message, error) {
+	key := offlineQueueKey(user)
+	defer keyLocks.lock(key)()
+	queue, err := db.loadConversation(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(queue) == 0 {
+		return queue, nil
+	}
+	if err := db.deleteLine(ctx, key); err != nil && err != creditdb.ErrNotFound {
+		return nil, err
+	}
+	return queue, nil
+}
+
+// requeueOffline puts messages that could not be replayed back in front of
+// anything queued since the drain.
+func (db *DBClient) requeueOffline(ctx context.Context, user string, messages []Message) error {
+	key := offlineQueueKey(user)
+	defer keyLocks.lock(key)()
+	queue, err := db.loadConversation(ctx, key)
+	if err != nil {
+		return err
+	}
+	return db.saveConversation(ctx, key, capOffline(user, append(messages, queue...)))
+}
+
+// queueForOffline stores msg for user after a failed live delivery and
+// calls their webhook, if they registered one.
+func queueForOffline(db *DBClient, user string, msg Message) {
+	if err := db.EnqueueOffline(context.Background(), user, msg); err != nil {
+		logger.Error("enqueue offline message failed", "event", "deliver", "recipient", user, "error", err)
+	}
+	fireWebhook(db, user, msg)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ayo-ajayi/realtime-chat-creditdb-websocket/storetest"
+)
+
+func TestReconnectReplaysOnlyUndelivered(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	conn, _ := ts.dial(t, bob)
+	live := ts.send(t, alice, bob, "while online")
+	if frame := readUntil(t, conn, EventMessage); frame["id"] != live.ID {
+		t.Fatalf("live message = %v, want %s", frame["id"], live.ID)
+	}
+	conn.Close()
+	waitFor(t, "disconnect", func() bool { return len(connectionsFor(bob)) == 0 })
+
+	want := []string{ts.send(t, alice, bob, "one").ID, ts.send(t, alice, bob, "two").ID}
+	_, replayed := ts.dial(t, bob)
+	var got []string
+	for _, frame := range replayed {
+		if frame["type"] == EventMessage {
+			got = append(got, frame["id"].(string))
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed %v, want %v", got, want)
+	}
+	queue, err := ts.db.DrainOffline(context.Background(), bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 0 {
+		t.Fatalf("queue after replay holds %d messages", len(queue))
+	}
+	if ids := storedIDs(t, ts.db, conversationKey(alice, bob)); len(ids) != 3 {
+		t.Fatalf("history holds %d messages, want 3", len(ids))
+	}
+}
+
+// withMaxOfflineMessages sets maxOfflineMessages for the test.
+func withMaxOfflineMessages(t *testing.T, n int) {
+	t.Helper()
+	old := maxOfflineMessages
+	maxOfflineMessages = n
+	t.Cleanup(func() { maxOfflineMessages = old })
+}
+
+func TestOfflineQueueKeepsNewest(t *testing.T) {
+	withMaxOfflineMessages(t, 3)
+	msg := func(i int) Message {
+		return Message{ID: "m" + strconv.Itoa(i), Sender: "alice", Recipient: "bob"}
+	}
+	tests := []struct {
+		name     string
+		queued   int
+		requeued []int
+		want     []string
+	}{
+		{"under the cap", 2, nil, []string{"m0", "m1"}},
+		{"at the cap", 3, nil, []string{"m0", "m1", "m2"}},
+		{"over the cap", 5, nil, []string{"m2", "m3", "m4"}},
+		{"requeue over the cap", 2, []int{8, 9}, []string{"m9", "m0", "m1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := NewDBClientFromStore(storetest.NewMemStore())
+			ctx := context.Background()
+			for i := 0; i < tt.queued; i++ {
+				if err := db.EnqueueOffline(ctx, "bob", msg(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.requeued != nil {
+				var front []Message
+				for _, i := range tt.requeued {
+					front = append(front, msg(i))
+				}
+				if err := db.requeueOffline(ctx, "bob", front); err != nil {
+					t.Fatal(err)
+				}
+			}
+			queue, err := db.DrainOffline(ctx, "bob")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, m := range queue {
+				got = append(got, m.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("queue = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// severingStore closes the server side of user's connections when their
+// offline queue is drained, so that the replay that follows fails to write.
+type severingStore struct {
+	*storetest.MemStore
+	user  string
+	armed *atomic.Bool
+}
+
+func (s severingStore) DeleteLine(ctx context.Context, key string) error {
+	if key == offlineQueueKey(s.user) && s.armed.CompareAndSwap(true, false) {
+		for _, client := range connectionsFor(s.user) {
+			client.conn.Close()
+		}
+	}
+	return s.MemStore.DeleteLine(ctx, key)
+}
+
+func TestFailedReplayKeepsQueueAndCleansUp(t *testing.T) {
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	armed := &atomic.Bool{}
+	ts := newTestServerOver(t, nil, func(mem *storetest.MemStore) Store {
+		return severingStore{MemStore: mem, user: bob, armed: armed}
+	})
+	want := []string{ts.send(t, alice, bob, "one").ID, ts.send(t, alice, bob, "two").ID}
+
+	armed.Store(true)
+	if _, _, err := ts.dialQuery(t, url.Values{"recipient": {bob}}, subprotocolChatV1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the severed connection to be cleaned up", func() bool {
+		online, err := ts.db.IsUserOnline(context.Background(), bob)
+		return !armed.Load() && len(connectionsFor(bob)) == 0 && err == nil && !online
+	})
+	queue, err := ts.db.loadConversation(context.Background(), offlineQueueKey(bob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range queue {
+		got = append(got, m.ID)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("queue after the failed replay = %v, want %v", got, want)
+	}
+
+	// The next connection gets the whole queue.
+	_, replayed := ts.dial(t, bob)
+	got = nil
+	for _, frame := range replayed {
+		if frame["type"] == EventMessage {
+			got = append(got, frame["id"].(string))
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed %v, want %v", got, want)
+	}
+}
+
+func TestCapConversations(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	msg := func(id, sender, room string, minute int) Message {
+		return Message{ID: id, Sender: sender, Recipient: "bob", RoomID: room, Timestamp: at.Add(time.Duration(minute) * time.Minute)}
+	}
+	// alice wrote first but also last, so her conversation is among the
+	// newest.
+	queue := []Message{
+		msg("a1", "alice", "", 0),
+		msg("c1", "carol", "", 1),
+		msg("r1", "alice", "room", 2),
+		msg("d1", "dave", "", 3),
+		msg("a2", "alice", "", 4),
+	}
+	tests := []struct {
+		n       int
+		want    []string
+		dropped int
+	}{
+		{5, []string{"a1", "c1", "r1", "d1", "a2"}, 0},
+		{4, []string{"a1", "c1", "r1", "d1", "a2"}, 0},
+		{3, []string{"a1", "r1", "d1", "a2"}, 1},
+		{2, []string{"a1", "d1", "a2"}, 2},
+		{1, []string{"a1", "a2"}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.n), func(t *testing.T) {
+			kept, dropped := capConversations(queue, tt.n)
+			var got []string
+			for _, m := range kept {
+				got = append(got, m.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) || dropped != tt.dropped {
+				t.Fatalf("capConversations(%d) = %v and %d dropped, want %v and %d", tt.n, got, dropped, tt.want, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestReplayIsLimitedToRecentConversations(t *testing.T) {
+	old := replayConversations
+	replayConversations = 2
+	t.Cleanup(func() { replayConversations = old })
+	ts := newTestServer(t)
+	bob := newTestUser("bob")
+	alice, carol, dave := newTestUser("alice"), newTestUser("carol"), newTestUser("dave")
+	ts.send(t, alice, bob, "oldest conversation")
+	want := []string{ts.send(t, carol, bob, "one").ID, ts.send(t, dave, bob, "two").ID, ts.send(t, carol, bob, "three").ID}
+
+	_, replayed := ts.dial(t, bob)
+	var got []string
+	for _, frame := range replayed {
+		if frame["type"] == EventMessage {
+			got = append(got, frame["id"].(string))
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed %v, want %v", got, want)
+	}
+	// The message left out is still in history.
+	if ids := storedIDs(t, ts.db, conversationKey(alice, bob)); len(ids) != 1 {
+		t.Fatalf("alice's conversation holds %d messages, want 1", len(ids))
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// allowedOrigins is read from ALLOWED_ORIGINS, a comma-separated list of
+// origins such as "https://chat.example.com". A "*" entry allows any origin
+// and is meant for development only.
+var allowedOrigins = parseOrigins(os.Getenv("ALLOWED_ORIGINS"))
+
+func parseOrigins(v string) []string {
+	origins := []string{}
+	for _, o := range strings.Split(v, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, strings.TrimSuffix(o, "/"))
+		}
+	}
+	return origins
+}
+
+// checkOrigin rejects cross-origin WebSocket handshakes that are not in the
+// allowlist. Without an allowlist only same-origin requests are accepted.
+// Requests without an Origin header come from non-browser clients and are
+// allowed.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(allowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseOrigins(t *testing.T) {
+	got := parseOrigins(" https://a.example.com/, ,https://b.example.com ")
+	if want := []string{"https://a.example.com", "https://b.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseOrigins = %v, want %v", got, want)
+	}
+}
+
+func TestHandshakeOriginCheck(t *testing.T) {
+	ts := newTestServer(t)
+	self := ts.http.URL
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		status  int
+	}{
+		{"no origin header", nil, "", http.StatusSwitchingProtocols},
+		{"same origin without allowlist", nil, self, http.StatusSwitchingProtocols},
+		{"cross origin without allowlist", nil, "https://evil.example.com", http.StatusForbidden},
+		{"listed origin", []string{"https://chat.example.com"}, "https://CHAT.example.com", http.StatusSwitchingProtocols},
+		{"unlisted origin", []string{"https://chat.example.com"}, "https://evil.example.com", http.StatusForbidden},
+		{"same origin not listed", []string{"https://chat.example.com"}, self, http.StatusForbidden},
+		{"wildcard", []string{"*"}, "https://evil.example.com", http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := allowedOrigins
+			allowedOrigins = tt.allowed
+			defer func() { allowedOrigins = old }()
+			header := http.Header{}
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+			dialer := websocket.Dialer{Subprotocols: []string{subprotocolChatV1}}
+			conn, resp, err := dialer.Dial(ts.wsURL("/ws", url.Values{"recipient": {newTestUser("user")}}), header)
+			if err == nil {
+				conn.Close()
+			}
+			if resp == nil {
+				t.Fatalf("handshake: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// outboxSize bounds the frames waiting to be written to one connection.
+// Live frames are queued rather than written by the goroutine that
+// produced them, so a slow socket holds up only its own connection. When
+// the queue is full the oldest frame is dropped and the client is sent a
+// gap marker, after which it should refetch history with /messages.
+var outboxSize = envInt("OUTBOUND_BUFFER", 64)
+
+// Gap tells a client that Dropped frames meant for it were discarded
+// because it was not reading fast enough. It is sent just before the first
+// frame written after them.
+type Gap struct {
+	Type    string `json:"type"`
+	Dropped int64  `json:"dropped"`
+}
+
+// delivery tracks whether a frame queued on several connections was
+// written to at least one of them. done runs exactly once: with true after
+// the first successful write, or with false once every connection has
+// dropped the frame, failed to write it or closed with it still queued.
+// It runs on the goroutine that settled the frame, with no lock held.
+type delivery struct {
+	pending atomic.Int32
+	fired   atomic.Bool
+	done    func(written bool)
+}
+
+func newDelivery(connections int, done func(written bool)) *delivery {
+	d := &delivery{done: done}
+	d.pending.Store(int32(connections))
+	return d
+}
+
+// settle records the outcome of the frame on one connection.
+func (d *delivery) settle(written bool) {
+	if d == nil {
+		return
+	}
+	if written && d.fired.CompareAndSwap(false, true) {
+		d.done(true)
+	}
+	if d.pending.Add(-1) == 0 && d.fired.CompareAndSwap(false, true) {
+		d.done(false)
+	}
+}
+
+// queuedFrame is a frame waiting in an outbox, with the delivery to settle
+// once it is written or discarded. delivery is nil for untracked frames.
+type queuedFrame struct {
+	frame    interface{}
+	delivery *delivery
+}
+
+// closeRequest asks a connection's writer to send an error frame and a
+// close frame, then close the socket.
+type closeRequest struct {
+	code    int
+	errCode string
+	reason  string
+}
+
+// outbox is the bounded queue behind Client.Send.
+type outbox struct {
+	// mu serializes producers, so a full queue gives up exactly one
+	// frame per frame added, and guards closed.
+	mu     sync.Mutex
+	frames chan queuedFrame
+	closed bool
+	// closing holds the close requested by requestClose. It is separate
+	// from frames so that a full queue cannot drop it.
+	closing chan closeRequest
+}
+
+func newOutbox() outbox {
+	return outbox{frames: make(chan queuedFrame, outboxSize), closing: make(chan closeRequest, 1)}
+}
+
+// Send queues frame for the connection's writer without blocking. Once the
+// connection is closed frames are discarded.
+func (c *Client) Send(frame interface{}) {
+	c.sendTracked(frame, nil)
+}
+
+// sendTracked is Send for a frame whose outcome d is waiting for. Frames
+// dropped to make room, and frame itself once the outbox is closed, are
+// settled as not written.
+func (c *Client) sendTracked(frame interface{}, d *delivery) {
+	var dropped []*delivery
+	// Deliveries are settled after the lock is released: their callbacks
+	// queue acks on other connections.
+	defer func() {
+		for _, d := range dropped {
+			d.settle(false)
+		}
+	}()
+	c.outbox.mu.Lock()
+	defer c.outbox.mu.Unlock()
+	if c.outbox.closed {
+		dropped = append(dropped, d)
+		return
+	}
+	for {
+		select {
+		case c.outbox.frames <- queuedFrame{frame, d}:
+			return
+		default:
+		}
+		// The writer may take a frame between the two selects, in which
+		// case nothing is dropped and the next attempt succeeds.
+		select {
+		case old := <-c.outbox.frames:
+			c.dropped.Add(1)
+			dropped = append(dropped, old.delivery)
+		default:
+		}
+	}
+}
+
+// requestClose has the connection's writer close it with code, errCode and
+// reason, so that the caller does not wait on a slow socket. Frames still
+// queued are not written. Only the first request counts.
+func (c *Client) requestClose(code int, errCode, reason string) {
+	select {
+	case c.outbox.closing <- closeRequest{code: code, errCode: errCode, reason: reason}:
+	default:
+	}
+}
+
+// closeOutbox stops the outbox from taking frames and settles those still
+// queued as not written. It is safe to call more than once.
+func (c *Client) closeOutbox() {
+	c.outbox.mu.Lock()
+	c.outbox.closed = true
+	var dropped []*delivery
+	for drained := false; !drained; {
+		select {
+		case old := <-c.outbox.frames:
+			dropped = append(dropped, old.delivery)
+		default:
+			drained = true
+		}
+	}
+	c.outbox.mu.Unlock()
+	for _, d := range dropped {
+		d.settle(false)
+	}
+}
+
+// writeQueued writes the frames queued by Send until done is closed, a
+// write fails or a close is requested. In the last two cases it closes the
+// connection so that the read loop in handleWS cleans up. Either way the
+// outbox is closed on return.
+func (c *Client) writeQueued(done <-chan struct{}) {
+	defer c.closeOutbox()
+	for {
+		var queued queuedFrame
+		select {
+		case <-done:
+			return
+		case req := <-c.outbox.closing:
+			c.closeWithError(req.code, req.errCode, req.reason)
+			c.conn.Close()
+			return
+		case queued = <-c.outbox.frames:
+		}
+		if n := c.dropped.Swap(0); n > 0 {
+			logger.Warn("slow consumer, dropped frames", "event", "deliver", "conn_id", c.id, "user", c.user, "dropped", n)
+			if err := c.writeFrame(Gap{Type: EventGap, Dropped: n}); err != nil {
+				queued.delivery.settle(false)
+				c.writeFailed(err)
+				return
+			}
+		}
+		if err := c.writeFrame(queued.frame); err != nil {
+			queued.delivery.settle(false)
+			c.writeFailed(err)
+			return
+		}
+		c.written.remember(c.user, queued.frame)
+		queued.delivery.settle(true)
+	}
+}
+
+func (c *Client) writeFailed(err error) {
+	logger.Warn("deliver failed", "event", "deliver", "conn_id", c.id, "recipient", c.user, "error", err)
+	c.conn.Close()
+}
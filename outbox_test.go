@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ayo-ajayi/realtime-chat-creditdb-websocket/storetest"
+)
+
+func TestSlowConsumerDropsOldestAndGetsGap(t *testing.T) {
+	tests := []struct {
+		name  string
+		flood int
+	}{
+		{"fits", outboxSize},
+		{"a few over", outboxSize + 5},
+		{"far over", 3 * outboxSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, conn := wsPair(t)
+			client := &Client{id: "slow", user: "slow", conn: server, format: formatJSON, outbox: newOutbox(), timing: currentTiming()}
+			var mu sync.Mutex
+			outcomes := make(map[int]bool)
+			var settled sync.WaitGroup
+			// Nothing is written while the flood arrives, as for a
+			// client that stopped reading.
+			for i := 0; i < tt.flood; i++ {
+				i := i
+				settled.Add(1)
+				client.sendTracked(Message{Type: EventMessage, ID: strconv.Itoa(i)}, newDelivery(1, func(written bool) {
+					mu.Lock()
+					outcomes[i] = written
+					mu.Unlock()
+					settled.Done()
+				}))
+			}
+			done := make(chan struct{})
+			defer close(done)
+			go client.writeQueued(done)
+
+			dropped := tt.flood - outboxSize
+			if dropped > 0 {
+				gap := readFrame(t, conn)
+				if gap["type"] != EventGap || gap["dropped"] != float64(dropped) {
+					t.Fatalf("first frame = %v, want a gap of %d", gap, dropped)
+				}
+			}
+			for i := dropped; i < tt.flood; i++ {
+				if frame := readFrame(t, conn); frame["id"] != strconv.Itoa(i) {
+					t.Fatalf("frame = %v, want message %d", frame, i)
+				}
+			}
+			settled.Wait()
+			for i := 0; i < tt.flood; i++ {
+				if want := i >= dropped; outcomes[i] != want {
+					t.Fatalf("message %d written = %v, want %v", i, outcomes[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestStalledPeerIsDroppedAfterWriteWait(t *testing.T) {
+	// The peer never reads, so once the socket buffers are full a write
+	// blocks until its deadline.
+	server, _ := wsPair(t)
+	client := &Client{id: "stalled", user: "stalled", conn: server, format: formatJSON, outbox: newOutbox(), timing: currentTiming()}
+	client.timing.writeWait = 50 * time.Millisecond
+	content := strings.Repeat("x", 512<<10)
+	var written, failed atomic.Int64
+	for i := 0; i < outboxSize; i++ {
+		client.sendTracked(Message{Type: EventMessage, ID: strconv.Itoa(i), Content: content}, newDelivery(1, func(ok bool) {
+			if ok {
+				written.Add(1)
+			} else {
+				failed.Add(1)
+			}
+		}))
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		client.writeQueued(make(chan struct{}))
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer still blocked on a peer that does not read")
+	}
+	if written.Load() == int64(outboxSize) {
+		t.Fatal("every frame was written, the peer never stalled")
+	}
+	// The frame that timed out and the ones still queued all failed.
+	if got := written.Load() + failed.Load(); got != int64(outboxSize) {
+		t.Fatalf("%d deliveries settled, want %d", got, outboxSize)
+	}
+	if err := client.writeFrame(Message{Type: EventMessage}); err == nil {
+		t.Fatal("connection still writable after the stalled write")
+	}
+}
+
+func TestDeliveryOutcomeDecidesAckAndOfflineQueue(t *testing.T) {
+	tests := []struct {
+		name    string
+		connect func(t *testing.T, client *Client)
+		status  string
+		queued  bool
+	}{
+		{"written", func(t *testing.T, client *Client) {
+			done := make(chan struct{})
+			t.Cleanup(func() { close(done) })
+			go client.writeQueued(done)
+		}, StatusDelivered, false},
+		{"write fails", func(t *testing.T, client *Client) {
+			client.conn.Close()
+			go client.writeQueued(make(chan struct{}))
+		}, StatusStored, true},
+		{"closed while queued", func(t *testing.T, client *Client) {
+			client.closeOutbox()
+		}, StatusStored, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := NewDBClientFromStore(storetest.NewMemStore())
+			alice, bob := newTestUser("alice"), newTestUser("bob")
+			sender, _ := newPairedClient(t, alice)
+			recipient, _ := newPairedClient(t, bob)
+			msg := newOutgoing(Message{Sender: alice, Recipient: bob, Content: "hi"})
+
+			deliver(db, msg)
+			if ack := findAck(queuedFrames(sender)); ack != nil {
+				t.Fatalf("acked %q before the frame was written", ack.Status)
+			}
+			tt.connect(t, recipient)
+
+			waitFor(t, "ack", func() bool { return findAck(queuedFrames(sender)) != nil })
+			if ack := findAck(queuedFrames(sender)); ack.Status != tt.status {
+				t.Fatalf("ack status = %q, want %q", ack.Status, tt.status)
+			}
+			queue, err := db.DrainOffline(context.Background(), bob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if queued := len(queue) == 1 && queue[0].ID == msg.ID; queued != tt.queued {
+				t.Fatalf("offline queue = %v, want queued %v", queue, tt.queued)
+			}
+		})
+	}
+}
+
+// findAck returns the first Ack among frames.
+func findAck(frames []interface{}) *Ack {
+	for _, frame := range frames {
+		if ack, ok := frame.(Ack); ok {
+			return &ack
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Presence statuses carried by PresenceEvent.
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+// PresenceEvent tells a watcher that a user went online or offline, and
+// when they were last seen if they ever were.
+type PresenceEvent struct {
+	Type     string     `json:"type"`
+	User     string     `json:"user"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// PresenceSubscription is sent by a client to start or stop watching the
+// presence of users.
+type PresenceSubscription struct {
+	Type  string   `json:"type"`
+	Users []string `json:"users"`
+}
+
+// presenceWatchers maps a watched user to the connections interested in
+// their presence.
+var presenceWatchers = make(map[string]map[*Client]bool)
+var presenceWatchersMutex = &sync.Mutex{}
+
+// subscribePresence registers client as a watcher of users and immediately
+// sends it their current status.
+func subscribePresence(db *DBClient, client *Client, users []string) {
+	presenceWatchersMutex.Lock()
+	for _, user := range users {
+		if presenceWatchers[user] == nil {
+			presenceWatchers[user] = make(map[*Client]bool)
+		}
+		presenceWatchers[user][client] = true
+	}
+	presenceWatchersMutex.Unlock()
+
+	for _, user := range users {
+		status := PresenceOffline
+		if len(connectionsFor(user)) > 0 {
+			status = PresenceOnline
+		}
+		client.writeFrame(PresenceEvent{Type: EventPresence, User: user, Status: status, LastSeen: lastSeenOf(db, user)})
+	}
+}
+
+func unsubscribePresence(client *Client, users []string) {
+	presenceWatchersMutex.Lock()
+	defer presenceWatchersMutex.Unlock()
+	for _, user := range users {
+		delete(presenceWatchers[user], client)
+		if len(presenceWatchers[user]) == 0 {
+			delete(presenceWatchers, user)
+		}
+	}
+}
+
+// unsubscribeAll drops every subscription held by client.
+func unsubscribeAll(client *Client) {
+	presenceWatchersMutex.Lock()
+	defer presenceWatchersMutex.Unlock()
+	for user, watchers := range presenceWatchers {
+		delete(watchers, client)
+		if len(watchers) == 0 {
+			delete(presenceWatchers, user)
+		}
+	}
+}
+
+// publishPresence sends a presence event for user, last seen at lastSeen,
+// to all of its watchers that have not muted user.
+func publishPresence(db *DBClient, user, status string, lastSeen *time.Time) {
+	presenceWatchersMutex.Lock()
+	watchers := make([]*Client, 0, len(presenceWatchers[user]))
+	for client := range presenceWatchers[user] {
+		watchers = append(watchers, client)
+	}
+	presenceWatchersMutex.Unlock()
+
+	event := PresenceEvent{Type: EventPresence, User: user, Status: status, LastSeen: lastSeen}
+	for _, client := range watchers {
+		if !isMuted(db, client.user, user) {
+			client.Send(event)
+		}
+	}
+}
+
+// setPresence lets a client without a WebSocket, such as a mobile app woken
+// by push notifications, report {"user","status"} directly. An online
+// status expires after PRESENCE_TTL unless it is posted again. Users with
+// open connections are online because of them and cannot go offline here.
+func (r *Router) setPresence(c *gin.Context) {
+	var req struct {
+		User   string `json:"user"`
+		Status string `json:"status" binding:"required,oneof=online offline"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	user, err := normalizeUserID(authenticatedUser(c, req.User))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "user: "+err.Error())
+		return
+	}
+
+	defer keyLocks.lock(presenceKey(user))()
+	live := len(connectionsFor(user)) > 0
+	if req.Status == PresenceOffline {
+		if live {
+			respondError(c, http.StatusConflict, ErrCodeConflict, "user has open connections")
+			return
+		}
+		err = r.dbclient.SetUserOffline(c, user)
+	} else {
+		err = r.dbclient.SetUserOnline(c, user)
+	}
+	now := time.Now()
+	if err == nil {
+		err = r.dbclient.UpdateLastSeen(c, user, now)
+	}
+	if err != nil {
+		logger.Error("set presence failed", "event", "presence", "user", user, "status", req.Status, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to set presence")
+		return
+	}
+	if !live {
+		publishPresence(r.dbclient, user, req.Status, &now)
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user, "status": req.Status, "ttl": presenceTTL.String()})
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ayo-ajayi/realtime-chat-creditdb-websocket/storetest"
+	"github.com/creditdb/go-creditdb"
+	"github.com/gorilla/websocket"
+)
+
+func TestSetUserOffline(t *testing.T) {
+	boom := errors.New("boom")
+	tests := []struct {
+		name    string
+		online  bool
+		fault   error
+		wantErr error
+	}{
+		{"online", true, nil, nil},
+		{"never online", false, nil, nil},
+		{"store answers not found", true, creditdb.ErrNotFound, nil},
+		{"store fails", true, boom, boom},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storetest.NewMemStore()
+			db := NewDBClientFromStore(store)
+			ctx := context.Background()
+			if tt.online {
+				if err := db.SetUserOnline(ctx, "alice"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.fault != nil {
+				store.FailCall(store.Calls()+1, tt.fault)
+			}
+			if err := db.SetUserOffline(ctx, "alice"); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SetUserOffline = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if online, err := db.IsUserOnline(ctx, "alice"); err != nil || online && tt.fault == nil {
+				t.Fatalf("IsUserOnline = %v, %v after going offline", online, err)
+			}
+		})
+	}
+}
+
+func TestOnlineEndpoint(t *testing.T) {
+	tests := []struct {
+		name      string
+		connected int
+	}{
+		{"never initialized", 0},
+		{"populated", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			var want []string
+			for i := 0; i < tt.connected; i++ {
+				user := newTestUser("user")
+				ts.dial(t, user)
+				want = append(want, user)
+			}
+			var users []string
+			if status := ts.do(t, http.MethodGet, "/online", nil, &users); status != http.StatusOK {
+				t.Fatalf("status = %d", status)
+			}
+			if users == nil {
+				t.Fatal("/online returned null, want an array")
+			}
+			sort.Strings(users)
+			sort.Strings(want)
+			if len(users) != len(want) || len(want) > 0 && !reflect.DeepEqual(users, want) {
+				t.Fatalf("online = %v, want %v", users, want)
+			}
+		})
+	}
+}
+
+func TestUserOnlineEndpoint(t *testing.T) {
+	ts := newTestServer(t)
+	online, offline := newTestUser("online"), newTestUser("offline")
+	ts.dial(t, online)
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		want   map[string]any
+	}{
+		{"online", "/online/" + online, http.StatusOK, map[string]any{"user": online, "online": true}},
+		{"offline", "/online/" + offline, http.StatusOK, map[string]any{"user": offline, "online": false}},
+		{"invalid user ID", "/online/" + url.PathEscape("not a user!"), http.StatusBadRequest, map[string]any{"code": ErrCodeInvalidRequest}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]any
+			if status := ts.do(t, http.MethodGet, tt.path, nil, &got); status != tt.status {
+				t.Fatalf("GET %s = %d, want %d", tt.path, status, tt.status)
+			}
+			for field, want := range tt.want {
+				if got[field] != want {
+					t.Fatalf("GET %s = %v, want %s %v", tt.path, got, field, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetUsersOnlineEmpty(t *testing.T) {
+	boom := errors.New("boom")
+	tests := []struct {
+		name    string
+		fault   error
+		wantErr error
+	}{
+		{"empty store", nil, nil},
+		{"store answers not found", creditdb.ErrNotFound, nil},
+		{"store fails", boom, boom},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storetest.NewMemStore()
+			if tt.fault != nil {
+				store.FailCall(1, tt.fault)
+			}
+			users, err := NewDBClientFromStore(store).GetUsersOnline(context.Background())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("GetUsersOnline = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && (users == nil || len(users) != 0) {
+				t.Fatalf("users = %#v, want an empty slice", users)
+			}
+		})
+	}
+}
+
+func TestPresenceWatcherSeesTransitions(t *testing.T) {
+	ts := newTestServer(t)
+	watcher, bob := newTestUser("watcher"), newTestUser("bob")
+	watcherConn, _ := ts.dial(t, watcher)
+	if err := watcherConn.WriteJSON(PresenceSubscription{Type: EventSubscribe, Users: []string{bob}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var bobConn *websocket.Conn
+	tests := []struct {
+		name   string
+		act    func()
+		status string
+	}{
+		{"current status on subscribe", func() {}, PresenceOffline},
+		{"connect", func() { bobConn, _ = ts.dial(t, bob) }, PresenceOnline},
+		{"disconnect", func() { bobConn.Close() }, PresenceOffline},
+	}
+	for _, tt := range tests {
+		tt.act()
+		frame := readUntil(t, watcherConn, EventPresence)
+		if frame["user"] != bob || frame["status"] != tt.status {
+			t.Fatalf("%s: presence event %v, want %s %s", tt.name, frame, bob, tt.status)
+		}
+	}
+}
+
+func TestConcurrentConnectDisconnectPresence(t *testing.T) {
+	ts := newTestServer(t)
+	const n = 15
+	var mu sync.Mutex
+	var want []string
+	var kept []*websocket.Conn
+	t.Cleanup(func() {
+		for _, conn := range kept {
+			conn.Close()
+		}
+	})
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocolChatV1}, HandshakeTimeout: 5 * time.Second}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		user := newTestUser("user")
+		stays := i%2 == 1
+		if stays {
+			want = append(want, user)
+		}
+		// Each user opens two connections at once. Users that stay
+		// online close one of them, the others close both.
+		for c := 0; c < 2; c++ {
+			wg.Add(1)
+			go func(keep bool) {
+				defer wg.Done()
+				conn, _, err := dialer.Dial(ts.wsURL("/ws", url.Values{"recipient": {user}}), nil)
+				if err != nil {
+					t.Errorf("dial %s: %v", user, err)
+					return
+				}
+				// The user is online once the replay is done.
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				for {
+					var frame map[string]any
+					if err := conn.ReadJSON(&frame); err != nil {
+						t.Errorf("%s replay: %v", user, err)
+						conn.Close()
+						return
+					}
+					if frame["type"] == EventHistoryEnd {
+						break
+					}
+				}
+				if keep {
+					mu.Lock()
+					kept = append(kept, conn)
+					mu.Unlock()
+					return
+				}
+				conn.Close()
+			}(stays && c == 0)
+		}
+	}
+	wg.Wait()
+	sort.Strings(want)
+	waitFor(t, "the online set to settle", func() bool {
+		users, err := ts.db.GetUsersOnline(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(users)
+		return reflect.DeepEqual(users, want)
+	})
+}
+
+func TestPresenceMarkersExpire(t *testing.T) {
+	start := time.Now()
+	clock := start
+	oldClock := presenceClock
+	presenceClock = func() time.Time { return clock }
+	t.Cleanup(func() { presenceClock = oldClock })
+
+	db := NewDBClientFromStore(storetest.NewMemStore())
+	ctx := context.Background()
+	for _, user := range []string{"alice", "bob", "carol:x"} {
+		if err := db.SetUserOnline(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Unrelated lines are not presence markers.
+	if err := db.setLine(ctx, "online_users", `["mallory"]`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		refresh string
+		want    []string
+	}{
+		{"just connected", 0, "", []string{"alice", "bob", "carol:x"}},
+		{"refreshed before the TTL", presenceTTL - time.Second, "bob", []string{"alice", "bob", "carol:x"}},
+		{"TTL elapsed without refresh", time.Second, "", []string{"bob"}},
+		{"refresh elapsed too", presenceTTL, "", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock = clock.Add(tt.advance)
+			if tt.refresh != "" {
+				if err := db.RefreshPresence(ctx, tt.refresh); err != nil {
+					t.Fatal(err)
+				}
+			}
+			users, err := db.GetUsersOnline(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(users)
+			if !reflect.DeepEqual(users, tt.want) {
+				t.Fatalf("online at +%v = %v, want %v", clock.Sub(start), users, tt.want)
+			}
+			for _, user := range []string{"alice", "bob"} {
+				online, err := db.IsUserOnline(ctx, user)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := slices.Contains(tt.want, user); online != want {
+					t.Fatalf("IsUserOnline(%s) = %v, want %v", user, online, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSetPresenceEndpoint(t *testing.T) {
+	ts := newTestServer(t)
+	watcher, bob, carol := newTestUser("watcher"), newTestUser("bob"), newTestUser("carol")
+	watcherConn, _ := ts.dial(t, watcher)
+	if err := watcherConn.WriteJSON(PresenceSubscription{Type: EventSubscribe, Users: []string{bob}}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, watcherConn, EventPresence)
+
+	var carolConn *websocket.Conn
+	tests := []struct {
+		name   string
+		user   string
+		status string
+		code   int
+		// event is the presence event the watcher gets, if any.
+		event string
+		// online is the user's state in /online and /online/:user after.
+		online bool
+	}{
+		{"online without a connection", bob, PresenceOnline, http.StatusOK, PresenceOnline, true},
+		{"offline again", bob, PresenceOffline, http.StatusOK, PresenceOffline, false},
+		{"unknown status", bob, "away", http.StatusBadRequest, "", false},
+		{"invalid user", "a:b", PresenceOnline, http.StatusBadRequest, "", false},
+		{"offline with an open connection", carol, PresenceOffline, http.StatusConflict, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.user == carol && carolConn == nil {
+				carolConn, _ = ts.dial(t, carol)
+			}
+			var resp struct{ Code string }
+			if status := ts.do(t, http.MethodPost, "/presence", map[string]any{"user": tt.user, "status": tt.status}, &resp); status != tt.code {
+				t.Fatalf("status = %d %q, want %d", status, resp.Code, tt.code)
+			}
+			if tt.event != "" {
+				if frame := readUntil(t, watcherConn, EventPresence); frame["user"] != tt.user || frame["status"] != tt.event {
+					t.Fatalf("presence event %v, want %s %s", frame, tt.user, tt.event)
+				}
+			}
+			if tt.code == http.StatusBadRequest {
+				return
+			}
+			var users []string
+			ts.do(t, http.MethodGet, "/online", nil, &users)
+			if listed := slices.Contains(users, tt.user); listed != tt.online {
+				t.Fatalf("/online = %v, want %s listed %v", users, tt.user, tt.online)
+			}
+			var one struct {
+				Online   bool       `json:"online"`
+				LastSeen *time.Time `json:"lastSeen"`
+			}
+			ts.do(t, http.MethodGet, "/online/"+tt.user, nil, &one)
+			if one.Online != tt.online {
+				t.Fatalf("/online/%s = %+v, want online %v", tt.user, one, tt.online)
+			}
+			// Setting presence also counts as being seen.
+			if tt.code == http.StatusOK && one.LastSeen == nil {
+				t.Fatalf("/online/%s has no last seen time", tt.user)
+			}
+		})
+	}
+	// The watcher got nothing for the refused requests: the next event is
+	// for this one.
+	ts.do(t, http.MethodPost, "/presence", map[string]any{"user": bob, "status": PresenceOnline}, nil)
+	if frame := readUntil(t, watcherConn, EventPresence); frame["user"] != bob || frame["status"] != PresenceOnline {
+		t.Fatalf("presence event %v, want %s online", frame, bob)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// Per-sender limits on /send.
+var (
+	sendRateLimit = envFloat("SEND_RATE_LIMIT", 10)
+	sendRateBurst = envInt("SEND_RATE_BURST", 20)
+)
+
+// limiterIdleTTL is how long an unused sender bucket is kept.
+const limiterIdleTTL = 10 * time.Minute
+
+type senderLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	senders   map[string]*senderLimiter
+	lastSweep time.Time
+}
+
+// NewRateLimitMiddleware limits each sender to limit requests per second
+// with the given burst. Senders are keyed by the authenticated user, or the
+// client IP when authentication is disabled. Rejected requests get 429 and a
+// Retry-After header.
+func NewRateLimitMiddleware(limit float64, burst int) gin.HandlerFunc {
+	rl := &rateLimiter{
+		limit:   rate.Limit(limit),
+		burst:   burst,
+		senders: make(map[string]*senderLimiter),
+	}
+	return func(c *gin.Context) {
+		key := authenticatedUser(c, c.ClientIP())
+		res := rl.reserve(key)
+		if delay := res.Delay(); !res.OK() || delay > 0 {
+			res.Cancel()
+			retry := int(math.Ceil(delay.Seconds()))
+			if retry < 1 {
+				retry = 1
+			}
+			c.Header("Retry-After", strconv.Itoa(retry))
+			respondError(c, http.StatusTooManyRequests, ErrCodeRateLimited, "rate limit exceeded")
+			return
+		}
+		c.Next()
+	}
+}
+
+func (rl *rateLimiter) reserve(key string) *rate.Reservation {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	if now.Sub(rl.lastSweep) > limiterIdleTTL {
+		for k, s := range rl.senders {
+			if now.Sub(s.lastSeen) > limiterIdleTTL {
+				delete(rl.senders, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+	s, ok := rl.senders[key]
+	if !ok {
+		s = &senderLimiter{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.senders[key] = s
+	}
+	s.lastSeen = now
+	return s.limiter.ReserveN(now, 1)
+}
+
+// globalLimiter caps the chat messages accepted per second by this
+// instance across all senders, so that aggregate load cannot overwhelm
+// creditdb and the delivery workers even when every sender is within its
+// own limit. Messages above the cap are shed with errOverloaded.
+var globalLimiter = rate.NewLimiter(
+	rate.Limit(envFloat("GLOBAL_RATE_LIMIT", 1000)),
+	envInt("GLOBAL_RATE_BURST", 2000),
+)
+
+var errOverloaded = errors.New("server is over its message rate, retry later")
+
+// rateMeter counts events per wall-clock second. Rate returns the count of
+// the last complete second.
+type rateMeter struct {
+	mu       sync.Mutex
+	second   int64
+	current  int64
+	previous int64
+}
+
+var acceptedRate = &rateMeter{}
+
+func (m *rateMeter) roll(now int64) {
+	switch {
+	case now == m.second:
+	case now == m.second+1:
+		m.previous, m.current = m.current, 0
+	default:
+		m.previous, m.current = 0, 0
+	}
+	m.second = now
+}
+
+func (m *rateMeter) Add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.roll(time.Now().Unix())
+	m.current += int64(n)
+}
+
+func (m *rateMeter) Rate() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.roll(time.Now().Unix())
+	return m.previous
+}
+
+// admitMessages takes n messages from the global budget and reports whether
+// they may proceed.
+func admitMessages(n int) bool {
+	if !globalLimiter.AllowN(time.Now(), n) {
+		return false
+	}
+	acceptedRate.Add(n)
+	return true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestSendRateLimitBurst(t *testing.T) {
+	oldLimit, oldBurst := sendRateLimit, sendRateBurst
+	sendRateLimit, sendRateBurst = 0.01, 3
+	defer func() { sendRateLimit, sendRateBurst = oldLimit, oldBurst }()
+	const secret = "hmac-secret"
+	ts := newTestServerWith(t, NewHMACAuthMiddleware(secret))
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	as := func(user string) http.Header {
+		return http.Header{"X-User-Id": {user}, "X-User-Signature": {SignUserID(secret, user)}}
+	}
+	body := map[string]any{"recipient": bob, "content": "burst"}
+
+	var statuses []int
+	for i := 0; i < 5; i++ {
+		statuses = append(statuses, ts.doWith(t, http.MethodPost, "/send", as(alice), body, nil))
+	}
+	for i, status := range statuses {
+		want := http.StatusOK
+		if i >= sendRateBurst {
+			want = http.StatusTooManyRequests
+		}
+		if status != want {
+			t.Fatalf("request %d: status %d, want %d (all: %v)", i, status, want, statuses)
+		}
+	}
+	// Each sender has a bucket of their own.
+	if status := ts.doWith(t, http.MethodPost, "/send", as(newTestUser("carol")), body, nil); status != http.StatusOK {
+		t.Fatalf("other sender: status %d, want 200", status)
+	}
+}
+
+func TestSendRateLimitRetryAfter(t *testing.T) {
+	oldLimit, oldBurst := sendRateLimit, sendRateBurst
+	sendRateLimit, sendRateBurst = 0.5, 1
+	defer func() { sendRateLimit, sendRateBurst = oldLimit, oldBurst }()
+	ts := newTestServer(t)
+	body := map[string]any{"sender": newTestUser("alice"), "recipient": newTestUser("bob"), "content": "hi"}
+	if status := ts.do(t, http.MethodPost, "/send", body, nil); status != http.StatusOK {
+		t.Fatalf("first request: %d", status)
+	}
+	req, err := http.NewRequest(http.MethodPost, ts.http.URL+"/send", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ts.http.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "2" {
+		t.Fatalf("status %d, Retry-After %q, want 429 and 2", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestGlobalRateLimitShedsLoad(t *testing.T) {
+	// Three messages a minute in total, whoever sends them.
+	old := globalLimiter
+	globalLimiter = rate.NewLimiter(rate.Every(20*time.Second), 3)
+	t.Cleanup(func() { globalLimiter = old })
+	ts := newTestServer(t)
+	bob := newTestUser("bob")
+	bobConn, _ := ts.dial(t, bob)
+
+	var accepted []string
+	for i := 0; i < 3; i++ {
+		accepted = append(accepted, ts.send(t, newTestUser("sender"), bob, "within the cap").ID)
+	}
+	// Every sender is within its own limit, but the total is not.
+	shed := newTestUser("sender")
+	body := `{"sender":"` + shed + `","recipient":"` + bob + `","content":"shed"}`
+	resp, err := http.Post(ts.http.URL+"/send", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answer struct{ Code string }
+	json.NewDecoder(resp.Body).Decode(&answer)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || answer.Code != ErrCodeBusy || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("/send = %d %q, Retry-After %q, want 503 %s with Retry-After", resp.StatusCode, answer.Code, resp.Header.Get("Retry-After"), ErrCodeBusy)
+	}
+	if ids := storedIDs(t, ts.db, conversationKey(shed, bob)); len(ids) != 0 {
+		t.Fatalf("shed message was stored: %v", ids)
+	}
+	// Frames are shed the same way.
+	aliceConn, _ := ts.dial(t, newTestUser("alice"))
+	if err := aliceConn.WriteJSON(map[string]any{"type": EventMessage, "recipient": bob, "content": "shed frame"}); err != nil {
+		t.Fatal(err)
+	}
+	if frame := readUntil(t, aliceConn, EventError); frame["code"] != ErrCodeBusy {
+		t.Fatalf("error = %v, want code %q", frame, ErrCodeBusy)
+	}
+
+	// Only the accepted messages were delivered.
+	for _, id := range accepted {
+		if got := readUntil(t, bobConn, EventMessage); got["id"] != id {
+			t.Fatalf("bob got %v, want %s", got["id"], id)
+		}
+	}
+	var stats Stats
+	ts.do(t, http.MethodGet, "/stats", nil, &stats)
+	if stats.MessageRateLimit != float64(rate.Every(20*time.Second)) {
+		t.Fatalf("stats rate limit = %v, want the configured cap", stats.MessageRateLimit)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/creditdb/go-creditdb"
+	"github.com/gin-gonic/gin"
+)
+
+// receiptSecret signs delivery receipts. When it is empty no receipts are
+// issued and /receipt/:id answers 404.
+var receiptSecret = os.Getenv("RECEIPT_SECRET")
+
+// Receipt proves that the recipient of a direct message acknowledged it:
+// with an ack frame on a connection the message was written to, or by
+// marking it read. DeliveredAt is when they did. Signature is the hex
+// HMAC-SHA256, under RECEIPT_SECRET, of the other fields as laid out by
+// receiptPayload.
+type Receipt struct {
+	MessageID   string    `json:"messageId"`
+	Sender      string    `json:"sender"`
+	Recipient   string    `json:"recipient"`
+	DeliveredAt time.Time `json:"deliveredAt"`
+	Signature   string    `json:"signature"`
+}
+
+func receiptKey(messageID string) string {
+	return "receipt:" + keyPart(messageID)
+}
+
+func receiptPayload(r Receipt) []byte {
+	return []byte(r.MessageID + "\n" + r.Sender + "\n" + r.Recipient + "\n" + r.DeliveredAt.UTC().Format(time.RFC3339Nano))
+}
+
+func signReceipt(secret string, r Receipt) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(receiptPayload(r))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// GenerateReceipt returns the signed receipt for msg delivered at at.
+func GenerateReceipt(secret string, msg Message, at time.Time) Receipt {
+	r := Receipt{MessageID: msg.ID, Sender: msg.Sender, Recipient: msg.Recipient, DeliveredAt: at.UTC()}
+	r.Signature = signReceipt(secret, r)
+	return r
+}
+
+// VerifyReceipt reports whether r is unmodified and was signed with secret.
+func VerifyReceipt(secret string, r Receipt) bool {
+	return hmac.Equal([]byte(r.Signature), []byte(signReceipt(secret, r)))
+}
+
+// recordReceipt stores a receipt for a direct message its recipient has
+// acknowledged. The first acknowledgement wins; later ones, from other
+// devices or by reading the message, keep it.
+func recordReceipt(db *DBClient, msg Message, at time.Time) {
+	if receiptSecret == "" || msg.RoomID != "" || msg.ID == "" {
+		return
+	}
+	ctx := context.Background()
+	key := receiptKey(msg.ID)
+	defer keyLocks.lock(key)()
+	if _, err := db.getLine(ctx, key); err != creditdb.ErrNotFound {
+		if err != nil {
+			logger.Error("load receipt failed", "event", "receipt", "message_id", msg.ID, "error", err)
+		}
+		return
+	}
+	data, err := json.Marshal(GenerateReceipt(receiptSecret, msg, at))
+	if err == nil {
+		err = db.setLine(ctx, key, string(data))
+	}
+	if err != nil {
+		logger.Error("store receipt failed", "event", "receipt", "message_id", msg.ID, "error", err)
+	}
+}
+
+// writtenLimit bounds the direct messages a connection remembers having
+// written, see writtenMessages.
+const writtenLimit = 256
+
+// writtenMessages remembers the latest direct messages written to one
+// connection, so that an ack frame can only acknowledge a message that
+// connection actually received. The zero value is ready to use.
+type writtenMessages struct {
+	mu    sync.Mutex
+	byID  map[string]Message
+	order []string
+}
+
+// remember records frame if it is a direct message to user. Nothing is
+// kept when receipts are disabled.
+func (w *writtenMessages) remember(user string, frame interface{}) {
+	msg, ok := frame.(Message)
+	if !ok || receiptSecret == "" || msg.ID == "" || msg.Type == EventTyping || msg.RoomID != "" || msg.Recipient != user {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.byID == nil {
+		w.byID = make(map[string]Message)
+	}
+	if _, ok := w.byID[msg.ID]; ok {
+		return
+	}
+	if len(w.order) == writtenLimit {
+		delete(w.byID, w.order[0])
+		w.order = w.order[1:]
+	}
+	w.byID[msg.ID] = msg
+	w.order = append(w.order, msg.ID)
+}
+
+func (w *writtenMessages) get(id string) (Message, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	msg, ok := w.byID[id]
+	return msg, ok
+}
+
+// acknowledge records the receipt of message id, acknowledged by the
+// client. It fails for a message that was not written to this connection.
+func (c *Client) acknowledge(db *DBClient, id string) error {
+	msg, ok := c.written.get(id)
+	if !ok {
+		return errNotWritten
+	}
+	recordReceipt(db, msg, time.Now())
+	return nil
+}
+
+var errNotWritten = errors.New("message was not delivered on this connection")
+
+// getReceipt returns the receipt of message :id to its sender, ?sender=.
+func (r *Router) getReceipt(c *gin.Context) {
+	if receiptSecret == "" {
+		respondError(c, http.StatusNotFound, ErrCodeNotFound, "receipts are disabled")
+		return
+	}
+	sender := authenticatedUser(c, c.Query("sender"))
+	line, err := r.dbclient.getLine(c, receiptKey(c.Param("id")))
+	if err == creditdb.ErrNotFound {
+		respondError(c, http.StatusNotFound, ErrCodeNotFound, "no receipt for this message")
+		return
+	}
+	if err != nil {
+		logger.Error("load receipt failed", "event", "receipt", "message_id", c.Param("id"), "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to load receipt")
+		return
+	}
+	var receipt Receipt
+	if err := json.Unmarshal([]byte(line.Value), &receipt); err != nil {
+		logger.Error("decode receipt failed", "event", "receipt", "message_id", c.Param("id"), "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to load receipt")
+		return
+	}
+	// Only the sender may see it; anyone else is told it does not exist.
+	if receipt.Sender != sender {
+		respondError(c, http.StatusNotFound, ErrCodeNotFound, "no receipt for this message")
+		return
+	}
+	c.JSON(http.StatusOK, receipt)
+}
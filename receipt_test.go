@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestReceiptSignature(t *testing.T) {
+	const secret = "receipt-secret"
+	msg := Message{ID: "m1", Sender: "alice", Recipient: "bob"}
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	receipt := GenerateReceipt(secret, msg, at)
+	if !VerifyReceipt(secret, receipt) {
+		t.Fatal("a generated receipt does not verify")
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		tamper func(r *Receipt)
+	}{
+		{"message ID", secret, func(r *Receipt) { r.MessageID = "m2" }},
+		{"sender", secret, func(r *Receipt) { r.Sender = "mallory" }},
+		{"recipient", secret, func(r *Receipt) { r.Recipient = "mallory" }},
+		{"delivered at", secret, func(r *Receipt) { r.DeliveredAt = r.DeliveredAt.Add(time.Second) }},
+		{"signature", secret, func(r *Receipt) { r.Signature = "00" + r.Signature[2:] }},
+		{"empty signature", secret, func(r *Receipt) { r.Signature = "" }},
+		{"other secret", "other-secret", func(r *Receipt) {}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := receipt
+			tt.tamper(&tampered)
+			if VerifyReceipt(tt.secret, tampered) {
+				t.Fatalf("tampered receipt %+v verifies", tampered)
+			}
+		})
+	}
+}
+
+func TestReceiptIsIssuedOnAcknowledgement(t *testing.T) {
+	previous := receiptSecret
+	receiptSecret = "receipt-secret"
+	t.Cleanup(func() { receiptSecret = previous })
+	ts := newTestServer(t)
+	alice, bob, carol := newTestUser("alice"), newTestUser("bob"), newTestUser("carol")
+	bobConn, _ := ts.dial(t, bob)
+	carolConn, _ := ts.dial(t, carol)
+
+	receiptOf := func(id, sender string) (Receipt, int) {
+		var receipt Receipt
+		status := ts.do(t, http.MethodGet, "/receipt/"+id+"?"+url.Values{"sender": {sender}}.Encode(), nil, &receipt)
+		return receipt, status
+	}
+
+	sent := ts.send(t, alice, bob, "sign me")
+	readUntil(t, bobConn, EventMessage)
+	if _, status := receiptOf(sent.ID, alice); status != http.StatusNotFound {
+		t.Fatalf("receipt before the recipient acknowledged: %d", status)
+	}
+
+	// Carol never received the message, so her ack is refused.
+	carolConn.WriteJSON(map[string]any{"type": EventAck, "messageId": sent.ID})
+	if frame := readUntil(t, carolConn, EventError); frame["code"] != ErrCodeInvalidMessage {
+		t.Fatalf("ack of a foreign message: %v", frame)
+	}
+	if _, status := receiptOf(sent.ID, alice); status != http.StatusNotFound {
+		t.Fatalf("receipt after a foreign ack: %d", status)
+	}
+
+	bobConn.WriteJSON(map[string]any{"type": EventAck, "messageId": sent.ID})
+	var receipt Receipt
+	waitFor(t, "receipt", func() bool {
+		var status int
+		receipt, status = receiptOf(sent.ID, alice)
+		return status == http.StatusOK
+	})
+	if receipt.MessageID != sent.ID || receipt.Sender != alice || receipt.Recipient != bob || !VerifyReceipt(receiptSecret, receipt) {
+		t.Fatalf("receipt = %+v", receipt)
+	}
+	if _, status := receiptOf(sent.ID, carol); status != http.StatusNotFound {
+		t.Fatalf("receipt shown to someone else than the sender: %d", status)
+	}
+}
+
+func TestReceiptIsIssuedOnRead(t *testing.T) {
+	previous := receiptSecret
+	receiptSecret = "receipt-secret"
+	t.Cleanup(func() { receiptSecret = previous })
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	sent := ts.send(t, alice, bob, "read me")
+
+	ts.do(t, http.MethodPost, "/read", map[string]any{"reader": bob, "sender": alice, "ids": []string{sent.ID}}, nil)
+	var receipt Receipt
+	if status := ts.do(t, http.MethodGet, "/receipt/"+sent.ID+"?sender="+alice, nil, &receipt); status != http.StatusOK {
+		t.Fatalf("status = %d", status)
+	}
+	if !VerifyReceipt(receiptSecret, receipt) || receipt.Recipient != bob {
+		t.Fatalf("receipt = %+v", receipt)
+	}
+}
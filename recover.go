@@ -0,0 +1,14 @@
+package main
+
+import "runtime/debug"
+
+// logPanic recovers a panic in the calling goroutine and logs it with its
+// stack, so one bad message or connection does not take the server down.
+// Gin's recovery only covers the HTTP handler goroutine. logPanic must be
+// deferred directly.
+func logPanic(event string, attrs ...any) {
+	if v := recover(); v != nil {
+		attrs = append([]any{"event", event, "panic", v, "stack", string(debug.Stack())}, attrs...)
+		logger.Error("recovered from panic", attrs...)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "request_id"
+)
+
+// requestIDMiddleware reuses the caller's X-Request-ID, or assigns a new one,
+// and echoes it in the response so that client and server logs can be
+// correlated.
+func requestIDMiddleware(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if id == "" || len(id) > 128 {
+		id = uuid.NewString()
+	}
+	c.Set(requestIDKey, id)
+	c.Header(requestIDHeader, id)
+	c.Next()
+}
+
+// requestLogger returns logger annotated with the request ID of c.
+func requestLogger(c *gin.Context) *slog.Logger {
+	return logger.With(requestIDKey, c.GetString(requestIDKey))
+}
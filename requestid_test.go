@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRequestIDIsEchoed(t *testing.T) {
+	ts := newTestServer(t)
+	tests := []struct {
+		name string
+		sent string
+		echo bool
+	}{
+		{"client ID", "trace-1234", true},
+		{"no ID", "", false},
+		{"oversized ID", strings.Repeat("x", 129), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"sender":"` + newTestUser("alice") + `","recipient":"` + newTestUser("bob") + `","content":"hi"}`
+			req, err := http.NewRequest(http.MethodPost, ts.http.URL+"/send", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if tt.sent != "" {
+				req.Header.Set(requestIDHeader, tt.sent)
+			}
+			resp, err := ts.http.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			got := resp.Header.Get(requestIDHeader)
+			if tt.echo {
+				if got != tt.sent {
+					t.Fatalf("%s = %q, want %q", requestIDHeader, got, tt.sent)
+				}
+				return
+			}
+			if _, err := uuid.Parse(got); err != nil {
+				t.Fatalf("%s = %q, want a generated UUID", requestIDHeader, got)
+			}
+		})
+	}
+}
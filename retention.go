@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Retention deletes messages older than RETENTION_PERIOD from conversations,
+// rooms and undelivered queues. It is off unless RETENTION_PERIOD is set.
+var (
+	retentionPeriod   = envDuration("RETENTION_PERIOD", 0)
+	retentionInterval = envDuration("RETENTION_INTERVAL", time.Hour)
+)
+
+// runRetention purges messages older than period every interval until ctx is
+// cancelled. now is the clock the cutoff is computed from.
+func runRetention(ctx context.Context, db *DBClient, period, interval time.Duration, now func() time.Time) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cutoff := now().Add(-period)
+			purged, err := db.PurgeExpired(ctx, cutoff)
+			if err != nil {
+				logger.Error("retention purge failed", "event", "retention", "purged", purged, "error", err)
+				continue
+			}
+			logger.Info("retention purge done", "event", "retention", "purged", purged, "cutoff", cutoff)
+		}
+	}
+}
+
+// PurgeExpired removes messages sent before cutoff and deletes the
+// histories and undelivered queues left empty, including queues whose user
+// never came back. It returns the number of messages removed. Every
+// history is read back in full, so a run costs about as much as loading
+// all history once.
+func (db *DBClient) PurgeExpired(ctx context.Context, cutoff time.Time) (int, error) {
+	lines, err := db.getAllLines(ctx)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, line := range lines {
+		var n int
+		if key, ok := historyKeyOf(line.Key); ok {
+			n, err = db.purgeHistory(ctx, key, cutoff)
+		} else if strings.HasPrefix(line.Key, "undelivered:") {
+			n, err = db.purgeQueue(ctx, line.Key, cutoff)
+		} else {
+			continue
+		}
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// unexpired returns the messages of list sent at or after cutoff.
+func unexpired(list []Message, cutoff time.Time) []Message {
+	kept := []Message{}
+	for _, m := range list {
+		if !m.Timestamp.Before(cutoff) {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+func (db *DBClient) purgeHistory(ctx context.Context, key string, cutoff time.Time) (int, error) {
+	defer keyLocks.lock(key)()
+	messages, err := db.loadHistory(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	kept := unexpired(messages, cutoff)
+	removed := len(messages) - len(kept)
+	switch {
+	case removed == 0:
+		return 0, nil
+	case len(kept) == 0:
+		err = db.deleteHistory(ctx, key)
+	default:
+		err = db.saveHistory(ctx, key, kept)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+func (db *DBClient) purgeQueue(ctx context.Context, key string, cutoff time.Time) (int, error) {
+	defer keyLocks.lock(key)()
+	queue, err := db.loadConversation(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	kept := unexpired(queue, cutoff)
+	removed := len(queue) - len(kept)
+	switch {
+	case removed == 0:
+		return 0, nil
+	case len(kept) == 0:
+		err = db.deleteQuietly(ctx, key)
+	default:
+		err = db.saveConversation(ctx, key, kept)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ayo-ajayi/realtime-chat-creditdb-websocket/storetest"
+	"github.com/creditdb/go-creditdb"
+)
+
+func TestRetentionPurgesOldMessages(t *testing.T) {
+	db := NewDBClientFromStore(storetest.NewMemStore())
+	ctx := context.Background()
+	const period = 30 * 24 * time.Hour
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return base.Add(period + time.Hour) }
+
+	old := Message{ID: "old", Sender: "alice", Recipient: "bob", Content: "old", Timestamp: base}
+	recent := Message{ID: "recent", Sender: "alice", Recipient: "bob", Content: "recent", Timestamp: base.Add(period + time.Minute)}
+	allOld := Message{ID: "all-old", Sender: "alice", Recipient: "carol", Content: "old", Timestamp: base}
+	for _, m := range []Message{old, recent, allOld} {
+		if err := db.StoreMessage(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// carol never came back for the message queued for her.
+	if err := db.EnqueueOffline(ctx, "carol", allOld); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		runRetention(jobs, db, period, 5*time.Millisecond, clock)
+	}()
+	waitFor(t, "the purge", func() bool {
+		_, err := db.getLine(ctx, offlineQueueKey("carol"))
+		return err == creditdb.ErrNotFound && !storedIDs(t, db, conversationKey("alice", "bob"))["old"] &&
+			len(storedIDs(t, db, conversationKey("alice", "carol"))) == 0
+	})
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("retention job did not stop on cancellation")
+	}
+
+	if ids := storedIDs(t, db, conversationKey("alice", "bob")); !ids["recent"] || len(ids) != 1 {
+		t.Fatalf("alice and bob keep %v, want only the recent message", ids)
+	}
+	if ids := storedIDs(t, db, conversationKey("alice", "carol")); len(ids) != 0 {
+		t.Fatalf("alice and carol keep %v, want nothing", ids)
+	}
+}
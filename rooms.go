@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/creditdb/go-creditdb"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var errNotRoomMember = errors.New("sender is not a member of the room")
+
+func roomMembersKey(id string) string {
+	return "room:" + keyPart(id) + ":members"
+}
+
+func roomMessagesKey(id string) string {
+	return "room:" + keyPart(id) + ":messages"
+}
+
+// createRoom creates a room with a fresh ID. The creator is always a member.
+func (r *Router) createRoom(c *gin.Context) {
+	var req struct {
+		Creator string   `json:"creator"`
+		Members []string `json:"members" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	// Members are normalized like every other user ID, so that " alice"
+	// and "alice" are one member.
+	members := make([]string, 0, len(req.Members)+1)
+	for i, m := range req.Members {
+		member, err := normalizeUserID(m)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("members[%d]: %v", i, err))
+			return
+		}
+		members = append(members, member)
+	}
+	if creator := authenticatedUser(c, req.Creator); creator != "" {
+		creator, err := normalizeUserID(creator)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "creator: "+err.Error())
+			return
+		}
+		members = append(members, creator)
+	}
+
+	id := uuid.NewString()
+	members, err := r.dbclient.CreateRoom(c, id, members)
+	if err != nil {
+		logger.Error("create room failed", "event", "create_room", "room_id", id, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"id": id, "members": members})
+}
+
+// CreateRoom stores the deduplicated member list of room id and returns it.
+func (db *DBClient) CreateRoom(ctx context.Context, id string, members []string) ([]string, error) {
+	seen := make(map[string]bool, len(members))
+	unique := []string{}
+	for _, m := range members {
+		if m == "" || seen[m] {
+			continue
+		}
+		seen[m] = true
+		unique = append(unique, m)
+	}
+	data, err := json.Marshal(unique)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.setLine(ctx, roomMembersKey(id), string(data)); err != nil {
+		return nil, err
+	}
+	return unique, nil
+}
+
+// RoomMembers returns the members of room id, or creditdb.ErrNotFound if
+// the room does not exist.
+func (db *DBClient) RoomMembers(ctx context.Context, id string) ([]string, error) {
+	line, err := db.getLine(ctx, roomMembersKey(id))
+	if err != nil {
+		return nil, err
+	}
+	members := []string{}
+	if err := json.Unmarshal([]byte(line.Value), &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// StoreRoomMessage appends message to its room's history after checking
+// that the sender belongs to the room.
+func (db *DBClient) StoreRoomMessage(ctx context.Context, message Message) error {
+	members, err := db.RoomMembers(ctx, message.RoomID)
+	if err != nil {
+		return err
+	}
+	if !contains(members, message.Sender) {
+		return errNotRoomMember
+	}
+	key := roomMessagesKey(message.RoomID)
+	defer keyLocks.lock(key)()
+	_, err = db.appendHistory(ctx, key, message)
+	return err
+}
+
+// deliverToRoom fans msg out to every online member except the sender.
+// Chat messages that no connection of a member wrote go to that member's
+// offline queue. done, unless nil, is called once with whether msg was
+// written for any member. Nothing is delivered for a sender who is no
+// longer a member.
+func deliverToRoom(db *DBClient, msg Message, done func(written bool)) {
+	if done == nil {
+		done = func(bool) {}
+	}
+	members, err := db.RoomMembers(context.Background(), msg.RoomID)
+	if err != nil {
+		if err != creditdb.ErrNotFound {
+			logger.Error("load room members failed", "event", "deliver", "room_id", msg.RoomID, "error", err)
+		}
+		done(false)
+		return
+	}
+	if !contains(members, msg.Sender) {
+		done(false)
+		return
+	}
+	recipients := make([]string, 0, len(members))
+	for _, member := range members {
+		if member == msg.Sender {
+			continue
+		}
+		if msg.Type == EventTyping && isMuted(db, member, muteTarget("", msg.RoomID)) {
+			continue
+		}
+		recipients = append(recipients, member)
+	}
+	if len(recipients) == 0 {
+		done(false)
+		return
+	}
+	room := newDelivery(len(recipients), done)
+	for _, member := range recipients {
+		member := member
+		deliverTracked(member, msg, func(written bool) {
+			if !written && msg.Type != EventTyping && !msg.Ephemeral {
+				queueForOffline(db, member, msg)
+			}
+			room.settle(written)
+		})
+	}
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
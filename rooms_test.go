@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+type roomResponse struct {
+	ID      string   `json:"id"`
+	Members []string `json:"members"`
+	Code    string   `json:"code"`
+}
+
+func TestCreateRoomNormalizesMembers(t *testing.T) {
+	tests := []struct {
+		name    string
+		creator string
+		members []string
+		status  int
+		want    []string
+	}{
+		{"plain", "carol", []string{"alice", "bob"}, http.StatusCreated, []string{"alice", "bob", "carol"}},
+		{"padded duplicates", " carol", []string{" alice", "alice\t", "bob", "carol"}, http.StatusCreated, []string{"alice", "bob", "carol"}},
+		{"no creator", "", []string{"alice", "bob"}, http.StatusCreated, []string{"alice", "bob"}},
+		{"invalid member", "carol", []string{"alice", "bob smith"}, http.StatusBadRequest, nil},
+		{"empty member", "carol", []string{"alice", " "}, http.StatusBadRequest, nil},
+		{"invalid creator", "carol!", []string{"alice"}, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			var got roomResponse
+			status := ts.do(t, http.MethodPost, "/rooms", map[string]any{"creator": tt.creator, "members": tt.members}, &got)
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d (%+v)", status, tt.status, got)
+			}
+			if tt.status != http.StatusCreated {
+				return
+			}
+			if !reflect.DeepEqual(got.Members, tt.want) {
+				t.Fatalf("members = %q, want %q", got.Members, tt.want)
+			}
+			stored, err := ts.db.RoomMembers(context.Background(), got.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(stored, tt.want) {
+				t.Fatalf("stored members = %q, want %q", stored, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoomMessageReachesEveryConnectedMember(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob, carol := newTestUser("alice"), newTestUser("bob"), newTestUser("carol")
+	var room roomResponse
+	if status := ts.do(t, http.MethodPost, "/rooms", map[string]any{"creator": alice, "members": []string{bob, carol}}, &room); status != http.StatusCreated {
+		t.Fatalf("create room: %d", status)
+	}
+	bobConn, _ := ts.dial(t, bob)
+	carolConn, _ := ts.dial(t, carol)
+
+	var sent Message
+	if status := ts.do(t, http.MethodPost, "/send", map[string]any{"sender": alice, "roomId": room.ID, "content": "hello room"}, &sent); status != http.StatusOK {
+		t.Fatalf("send: %d", status)
+	}
+	for user, conn := range map[string]*websocket.Conn{bob: bobConn, carol: carolConn} {
+		frame := readUntil(t, conn, EventMessage)
+		if frame["id"] != sent.ID || frame["roomId"] != room.ID || frame["content"] != "hello room" {
+			t.Fatalf("%s got %v, want message %s in room %s", user, frame, sent.ID, room.ID)
+		}
+	}
+}
+
+func TestRoomRejectsNonMembers(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob, mallory := newTestUser("alice"), newTestUser("bob"), newTestUser("mallory")
+	var room roomResponse
+	ts.do(t, http.MethodPost, "/rooms", map[string]any{"creator": alice, "members": []string{bob}}, &room)
+	var got roomResponse
+	if status := ts.do(t, http.MethodPost, "/send", map[string]any{"sender": mallory, "roomId": room.ID, "content": "hi"}, &got); status != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", status)
+	}
+	if got.Code != ErrCodeNotRoomMember {
+		t.Fatalf("code = %q, want %q", got.Code, ErrCodeNotRoomMember)
+	}
+}
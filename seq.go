@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/creditdb/go-creditdb"
+)
+
+func seqKey(conversationKey string) string {
+	return "seq:" + conversationKey
+}
+
+// NextSeq increments and returns the sequence counter of conversationKey,
+// starting at 1. creditdb has no atomic increment, so the read and write
+// are serialized with keyLocks; that makes the counter exact within one
+// server process only.
+func (db *DBClient) NextSeq(ctx context.Context, conversationKey string) (int64, error) {
+	key := seqKey(conversationKey)
+	defer keyLocks.lock(key)()
+	var seq int64
+	line, err := db.getLine(ctx, key)
+	switch {
+	case err == creditdb.ErrNotFound:
+	case err != nil:
+		return 0, err
+	default:
+		if seq, err = strconv.ParseInt(line.Value, 10, 64); err != nil {
+			return 0, err
+		}
+	}
+	seq++
+	if err := db.setLine(ctx, key, strconv.FormatInt(seq, 10)); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
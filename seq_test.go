@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/creditdb/go-creditdb"
+)
+
+func TestConcurrentSendsGetContiguousSeq(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sender, recipient := alice, bob
+			if i%2 == 1 {
+				sender, recipient = bob, alice
+			}
+			// Both directions share one conversation, so one counter.
+			msg := newOutgoing(Message{Sender: sender, Recipient: recipient, Content: fmt.Sprint(i)})
+			if err := ts.newRouter().storeOutgoing(context.Background(), &msg); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	history, err := ts.db.loadHistory(context.Background(), conversationKey(alice, bob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqs := make([]int, 0, len(history))
+	for _, m := range history {
+		seqs = append(seqs, int(m.Seq))
+	}
+	sort.Ints(seqs)
+	if len(seqs) != n {
+		t.Fatalf("stored %d messages, want %d", len(seqs), n)
+	}
+	for i, seq := range seqs {
+		if seq != i+1 {
+			t.Fatalf("sequence numbers %v are not 1..%d", seqs, n)
+		}
+	}
+}
+
+func TestRefusedMessagesAllocateNoSeq(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob, mallory := newTestUser("alice"), newTestUser("bob"), newTestUser("mallory")
+	var room roomResponse
+	ts.do(t, http.MethodPost, "/rooms", map[string]any{"creator": alice, "members": []string{bob}}, &room)
+	if status := ts.do(t, http.MethodPost, "/block", map[string]any{"user": bob, "blocked": mallory}, nil); status != http.StatusOK && status != http.StatusNoContent {
+		t.Fatalf("block: %d", status)
+	}
+
+	tests := []struct {
+		name   string
+		msg    Message
+		key    string
+		status int
+	}{
+		{"non-member", Message{Sender: mallory, RoomID: room.ID, Content: "hi"}, roomMessagesKey(room.ID), http.StatusForbidden},
+		{"unknown room", Message{Sender: alice, RoomID: "no-such-room", Content: "hi"}, roomMessagesKey("no-such-room"), http.StatusNotFound},
+		{"blocked", Message{Sender: mallory, Recipient: bob, Content: "hi"}, conversationKey(mallory, bob), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := map[string]any{"sender": tt.msg.Sender, "recipient": tt.msg.Recipient, "roomId": tt.msg.RoomID, "content": tt.msg.Content}
+			if status := ts.do(t, http.MethodPost, "/send", body, nil); status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			if _, err := ts.db.getLine(context.Background(), seqKey(tt.key)); err != creditdb.ErrNotFound {
+				t.Fatalf("sequence counter %s exists after a refused message (err %v)", seqKey(tt.key), err)
+			}
+		})
+	}
+
+	// The room's own sequence has no gap from the refused message.
+	var sent Message
+	ts.do(t, http.MethodPost, "/send", map[string]any{"sender": alice, "roomId": room.ID, "content": "first"}, &sent)
+	if sent.Seq != 1 {
+		t.Fatalf("first room message has seq %d, want 1", sent.Seq)
+	}
+}
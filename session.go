@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// A client that drops and reconnects within resumeGrace, presenting the
+// resume token of its previous connection, keeps its presence: watchers
+// see neither the offline nor the online transition. Zero disables the
+// grace window.
+var resumeGrace = envDuration("RESUME_GRACE", 10*time.Second)
+
+// Session is sent once on connect. ResumeToken is valid for resumeGrace
+// after this connection closes.
+type Session struct {
+	Type        string `json:"type"`
+	ResumeToken string `json:"resumeToken"`
+}
+
+type pendingOffline struct {
+	token     string
+	timer     *time.Timer
+	goOffline func()
+}
+
+var (
+	pendingOfflineMu sync.Mutex
+	pendingOfflines  = make(map[string]*pendingOffline)
+)
+
+// deferOffline runs goOffline for user after grace, unless resumeSession
+// claims it first.
+func deferOffline(user, token string, grace time.Duration, goOffline func()) {
+	pendingOfflineMu.Lock()
+	defer pendingOfflineMu.Unlock()
+	p := &pendingOffline{token: token, goOffline: goOffline}
+	p.timer = time.AfterFunc(grace, func() {
+		pendingOfflineMu.Lock()
+		if pendingOfflines[user] != p {
+			pendingOfflineMu.Unlock()
+			return
+		}
+		delete(pendingOfflines, user)
+		pendingOfflineMu.Unlock()
+		goOffline()
+	})
+	pendingOfflines[user] = p
+}
+
+// resumeSession cancels user's pending offline transition and reports
+// whether token resumes it. With a wrong or missing token the previous
+// session is over, so its offline transition runs now, before the caller
+// brings the user back online.
+func resumeSession(user, token string) bool {
+	pendingOfflineMu.Lock()
+	p := pendingOfflines[user]
+	if p == nil || !p.timer.Stop() {
+		pendingOfflineMu.Unlock()
+		return false
+	}
+	delete(pendingOfflines, user)
+	pendingOfflineMu.Unlock()
+	if token != "" && token == p.token {
+		return true
+	}
+	p.goOffline()
+	return false
+}
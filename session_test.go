@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withResumeGrace sets resumeGrace for the connections the test opens.
+func withResumeGrace(t *testing.T, grace time.Duration) {
+	t.Helper()
+	old := resumeGrace
+	resumeGrace = grace
+	t.Cleanup(func() { resumeGrace = old })
+}
+
+// dialResume connects as user presenting token, and returns the
+// connection with its new resume token.
+func (ts *testServer) dialResume(t *testing.T, user, token string) (*websocket.Conn, string) {
+	t.Helper()
+	conn, _, err := ts.dialQuery(t, url.Values{"recipient": {user}, "resume": {token}}, subprotocolChatV1)
+	if err != nil {
+		t.Fatalf("dial %s: %v", user, err)
+	}
+	var next string
+	for {
+		frame := readFrame(t, conn)
+		if frame["type"] == EventSession {
+			next = frame["resumeToken"].(string)
+		}
+		if frame["type"] == EventHistoryEnd {
+			return conn, next
+		}
+	}
+}
+
+// disconnect closes user's only connection and waits for its offline
+// transition to be deferred.
+func disconnect(t *testing.T, user string, conn *websocket.Conn) {
+	t.Helper()
+	conn.Close()
+	waitFor(t, user+"'s offline transition to be deferred", func() bool {
+		pendingOfflineMu.Lock()
+		defer pendingOfflineMu.Unlock()
+		return pendingOfflines[user] != nil
+	})
+}
+
+func TestResumeWithinGraceKeepsPresence(t *testing.T) {
+	const grace = time.Second
+	withResumeGrace(t, grace)
+	ts := newTestServer(t)
+	watcher, alice := newTestUser("watcher"), newTestUser("alice")
+	watcherConn, _ := ts.dial(t, watcher)
+	if err := watcherConn.WriteJSON(PresenceSubscription{Type: EventSubscribe, Users: []string{alice}}); err != nil {
+		t.Fatal(err)
+	}
+	expectPresence := func(step, status string) {
+		t.Helper()
+		if frame := readUntil(t, watcherConn, EventPresence); frame["user"] != alice || frame["status"] != status {
+			t.Fatalf("%s: presence event %v, want %s %s", step, frame, alice, status)
+		}
+	}
+	expectPresence("subscribe", PresenceOffline)
+	conn, token := ts.dialResume(t, alice, "")
+	expectPresence("connect", PresenceOnline)
+
+	// Resuming with the token shows no transition at all. The next
+	// event the watcher gets is from the reconnect below.
+	disconnect(t, alice, conn)
+	conn, token = ts.dialResume(t, alice, token)
+
+	// A wrong token ends the previous session at once.
+	disconnect(t, alice, conn)
+	conn, _ = ts.dialResume(t, alice, token+"-wrong")
+	expectPresence("reconnect with a wrong token", PresenceOffline)
+	expectPresence("reconnect with a wrong token", PresenceOnline)
+
+	// Without a reconnect the user goes offline once the grace is over.
+	disconnect(t, alice, conn)
+	start := time.Now()
+	expectPresence("grace over", PresenceOffline)
+	if elapsed := time.Since(start); elapsed < grace/2 {
+		t.Fatalf("offline after %s, want about %s", elapsed, grace)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Stats is a quick view of this process for debugging. The message counts
+// are since startup; /metrics has the full picture.
+type Stats struct {
+	ActiveConnections int   `json:"activeConnections"`
+	OnlineUsers       int   `json:"onlineUsers"`
+	MessagesSent      int64 `json:"messagesSent"`
+	MessagesDelivered int64 `json:"messagesDelivered"`
+	MessagesStored    int64 `json:"messagesStored"`
+	BroadcastQueue    int   `json:"broadcastQueue"`
+	// MessageRate is messages accepted in the last second, against the
+	// GLOBAL_RATE_LIMIT cap.
+	MessageRate      int64   `json:"messageRate"`
+	MessageRateLimit float64 `json:"messageRateLimit"`
+}
+
+func stats(c *gin.Context) {
+	userConnectionsMutex.Lock()
+	online, conns := len(userConnections), 0
+	for _, clients := range userConnections {
+		conns += len(clients)
+	}
+	userConnectionsMutex.Unlock()
+
+	c.JSON(http.StatusOK, Stats{
+		ActiveConnections: conns,
+		OnlineUsers:       online,
+		MessagesSent:      messageCounts[StatusSent].Load(),
+		MessagesDelivered: messageCounts[StatusDelivered].Load(),
+		MessagesStored:    messageCounts[StatusStored].Load(),
+		BroadcastQueue:    len(broadcast),
+		MessageRate:       acceptedRate.Rate(),
+		MessageRateLimit:  float64(globalLimiter.Limit()),
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestStatsCounters(t *testing.T) {
+	ts := newTestServer(t)
+	stats := func() Stats {
+		t.Helper()
+		var s Stats
+		if status := ts.do(t, http.MethodGet, "/stats", nil, &s); status != http.StatusOK {
+			t.Fatalf("/stats: status %d", status)
+		}
+		return s
+	}
+	before := stats()
+	alice, bob, carol := newTestUser("alice"), newTestUser("bob"), newTestUser("carol")
+	ts.dial(t, alice)
+	ts.dial(t, alice)
+	bobConn, _ := ts.dial(t, bob)
+
+	// One message is delivered live, the other is stored for carol, who
+	// is offline. Both count as sent.
+	ts.send(t, alice, bob, "live")
+	readUntil(t, bobConn, EventMessage)
+	ts.send(t, alice, carol, "queued")
+
+	want := Stats{
+		ActiveConnections: before.ActiveConnections + 3,
+		OnlineUsers:       before.OnlineUsers + 2,
+		MessagesSent:      before.MessagesSent + 2,
+		MessagesDelivered: before.MessagesDelivered + 1,
+		MessagesStored:    before.MessagesStored + 1,
+	}
+	waitFor(t, "stats to count the messages", func() bool {
+		got := stats()
+		return got.ActiveConnections == want.ActiveConnections &&
+			got.OnlineUsers == want.OnlineUsers &&
+			got.MessagesSent == want.MessagesSent &&
+			got.MessagesDelivered == want.MessagesDelivered &&
+			got.MessagesStored == want.MessagesStored &&
+			got.BroadcastQueue == 0
+	})
+}
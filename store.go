@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+
+	"github.com/creditdb/go-creditdb"
+)
+
+// Store is the key-value backend behind DBClient. *creditdb.CreditDB
+// implements it. Implementations must report a missing key with
+// creditdb.ErrNotFound, which DBClient relies on throughout.
+type Store interface {
+	GetLine(ctx context.Context, key string) (*creditdb.Line, error)
+	SetLine(ctx context.Context, key, value string) error
+	DeleteLine(ctx context.Context, key string) error
+	GetAllLines(ctx context.Context) ([]creditdb.Line, error)
+	Close(ctx context.Context) error
+}
+
+// NewDBClientFromStore wraps an already connected store.
+func NewDBClientFromStore(store Store) *DBClient {
+	return &DBClient{Store: store}
+}
@@ -0,0 +1,124 @@
+// Package storetest provides an in-memory Store for exercising DBClient
+// without a creditdb server.
+package storetest
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/creditdb/go-creditdb"
+)
+
+// MemStore is a thread-safe, map-backed Store. Like creditdb it reports a
+// missing key with creditdb.ErrNotFound and rejects empty values with
+// creditdb.ErrBadRequest. Faults can be injected with FailCall.
+type MemStore struct {
+	mu     sync.Mutex
+	lines  map[string]string
+	calls  int
+	faults map[int]error
+	down   error
+}
+
+// NewMemStore returns an empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{lines: make(map[string]string), faults: make(map[int]error)}
+}
+
+// FailCall makes the nth call, counting every method from 1, return err
+// instead of running. Use a retryable error such as
+// creditdb.ErrServiceUnavailable to drive DBClient's retry path.
+func (m *MemStore) FailCall(n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.faults[n] = err
+}
+
+// FailAll makes every call return err until FailAll(nil) is called, as
+// when the server is down. Calls that FailCall targets fail with their own
+// error.
+func (m *MemStore) FailAll(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.down = err
+}
+
+// Calls returns how many calls have been made, failed ones included.
+func (m *MemStore) Calls() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls
+}
+
+// call counts a call and returns its injected fault, if any. m.mu must be
+// held.
+func (m *MemStore) call() error {
+	m.calls++
+	err, ok := m.faults[m.calls]
+	delete(m.faults, m.calls)
+	if !ok {
+		err = m.down
+	}
+	return err
+}
+
+func (m *MemStore) GetLine(ctx context.Context, key string) (*creditdb.Line, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call(); err != nil {
+		return nil, err
+	}
+	value, ok := m.lines[key]
+	if !ok {
+		return nil, creditdb.ErrNotFound
+	}
+	return &creditdb.Line{Key: key, Value: value}, nil
+}
+
+func (m *MemStore) SetLine(ctx context.Context, key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call(); err != nil {
+		return err
+	}
+	if key == "" || value == "" {
+		return creditdb.ErrBadRequest
+	}
+	m.lines[key] = value
+	return nil
+}
+
+func (m *MemStore) DeleteLine(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call(); err != nil {
+		return err
+	}
+	if _, ok := m.lines[key]; !ok {
+		return creditdb.ErrNotFound
+	}
+	delete(m.lines, key)
+	return nil
+}
+
+// GetAllLines returns every line sorted by key.
+func (m *MemStore) GetAllLines(ctx context.Context) ([]creditdb.Line, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call(); err != nil {
+		return nil, err
+	}
+	lines := make([]creditdb.Line, 0, len(m.lines))
+	for k, v := range m.lines {
+		lines = append(lines, creditdb.Line{Key: k, Value: v})
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].Key < lines[j].Key })
+	return lines, nil
+}
+
+func (m *MemStore) Close(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.call()
+}
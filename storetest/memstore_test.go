@@ -0,0 +1,95 @@
+package storetest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/creditdb/go-creditdb"
+)
+
+func TestMemStoreSemantics(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+	if _, err := m.GetLine(ctx, "k"); err != creditdb.ErrNotFound {
+		t.Fatalf("get missing: %v, want ErrNotFound", err)
+	}
+	if err := m.DeleteLine(ctx, "k"); err != creditdb.ErrNotFound {
+		t.Fatalf("delete missing: %v, want ErrNotFound", err)
+	}
+	if err := m.SetLine(ctx, "k", ""); err != creditdb.ErrBadRequest {
+		t.Fatalf("set empty: %v, want ErrBadRequest", err)
+	}
+	if err := m.SetLine(ctx, "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := m.GetLine(ctx, "k"); err != nil || line.Value != "v" {
+		t.Fatalf("get = %+v, %v", line, err)
+	}
+	if err := m.DeleteLine(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetLine(ctx, "k"); err != creditdb.ErrNotFound {
+		t.Fatalf("get deleted: %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemStoreFailCall(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+	boom := errors.New("boom")
+	m.FailCall(2, boom)
+	if err := m.SetLine(ctx, "k", "v"); err != nil {
+		t.Fatalf("call 1: %v", err)
+	}
+	if _, err := m.GetLine(ctx, "k"); err != boom {
+		t.Fatalf("call 2: %v, want %v", err, boom)
+	}
+	if _, err := m.GetLine(ctx, "k"); err != nil {
+		t.Fatalf("call 3: %v", err)
+	}
+	if n := m.Calls(); n != 3 {
+		t.Fatalf("calls = %d, want 3", n)
+	}
+}
+
+func TestMemStoreFailAll(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+	down, boom := errors.New("down"), errors.New("boom")
+	m.FailAll(down)
+	m.FailCall(2, boom)
+	if err := m.SetLine(ctx, "k", "v"); err != down {
+		t.Fatalf("call 1: %v, want %v", err, down)
+	}
+	if _, err := m.GetLine(ctx, "k"); err != boom {
+		t.Fatalf("call 2: %v, want %v", err, boom)
+	}
+	m.FailAll(nil)
+	if _, err := m.GetLine(ctx, "k"); err != creditdb.ErrNotFound {
+		t.Fatalf("call 3: %v, want %v", err, creditdb.ErrNotFound)
+	}
+}
+
+func TestMemStoreConcurrentUse(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := strconv.Itoa(i)
+			m.SetLine(ctx, key, "v")
+			m.GetLine(ctx, key)
+			m.GetAllLines(ctx)
+		}(i)
+	}
+	wg.Wait()
+	lines, err := m.GetAllLines(ctx)
+	if err != nil || len(lines) != 20 {
+		t.Fatalf("lines = %d, %v, want 20", len(lines), err)
+	}
+}
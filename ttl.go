@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/creditdb/go-creditdb"
+)
+
+// A sender may give a message a TTL in seconds, after which it disappears:
+// it is deleted from history and participants get a deleted event, as if
+// the sender had deleted it. Stored messages with a TTL are listed in an
+// expiry index that a sweeper checks every ttlSweepInterval, so a message
+// lives up to that much longer than asked.
+var (
+	maxMessageTTL    = envDuration("MAX_MESSAGE_TTL", 7*24*time.Hour)
+	ttlSweepInterval = envDuration("TTL_SWEEP_INTERVAL", 10*time.Second)
+)
+
+var errInvalidTTL = fmt.Errorf("ttl must be between 0 and %d seconds", int64(maxMessageTTL.Seconds()))
+
+func validateTTL(ttl int64) error {
+	if ttl < 0 || time.Duration(ttl)*time.Second > maxMessageTTL {
+		return errInvalidTTL
+	}
+	return nil
+}
+
+// scheduleIfExpiring indexes msg, just stored under key, if it has a TTL.
+// The message is already stored, so a failure is logged rather than
+// failing the send; the message then stays until deleted by hand.
+func scheduleIfExpiring(ctx context.Context, db *DBClient, key string, msg Message) {
+	if msg.ExpiresAt == nil {
+		return
+	}
+	if err := db.scheduleExpiry(ctx, key, msg); err != nil {
+		logger.Error("schedule message expiry failed", "event", "ttl", "message_id", msg.ID, "error", err)
+	}
+}
+
+// withoutExpired drops the messages of list whose TTL ran out by now.
+// Copies in offline queues are not swept, so replays filter them here.
+func withoutExpired(list []Message, now time.Time) []Message {
+	kept := []Message{}
+	for _, m := range list {
+		if !m.expired(now) {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// expired reports whether m has a TTL that ran out by now.
+func (m Message) expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !m.ExpiresAt.After(now)
+}
+
+// The expiry index is split into buckets of expiryBucketWidth by expiry
+// time, so that scheduling a message rewrites only the bucket it expires
+// in and a sweep reads only the buckets that are due:
+//
+//	expiring:N      the entries expiring in bucket N
+//	expiring:swept  the newest bucket swept in full
+//
+// An index written before buckets is a single list under "expiring"; the
+// next sweep moves its entries into their buckets.
+const (
+	expiryBucketWidth    = time.Minute
+	expirySweptKey       = "expiring:swept"
+	legacyExpiryIndexKey = "expiring"
+)
+
+func expiryBucket(t time.Time) int64 {
+	return t.Unix() / int64(expiryBucketWidth/time.Second)
+}
+
+func expiryBucketKey(n int64) string {
+	return "expiring:" + strconv.FormatInt(n, 10)
+}
+
+// expiryBucketEnd is when the entries of bucket n have all expired.
+func expiryBucketEnd(n int64) time.Time {
+	return time.Unix((n+1)*int64(expiryBucketWidth/time.Second), 0)
+}
+
+// expiryEntry locates a stored message with a TTL.
+type expiryEntry struct {
+	Key       string    `json:"key"`
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Participants are notified of the deletion. For a room they are
+	// looked up when it happens.
+	Participants []string `json:"participants,omitempty"`
+	RoomID       string   `json:"roomId,omitempty"`
+}
+
+func (db *DBClient) loadExpiryIndex(ctx context.Context, key string) ([]expiryEntry, error) {
+	line, err := db.getLine(ctx, key)
+	if err == creditdb.ErrNotFound {
+		return []expiryEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []expiryEntry{}
+	if err := json.Unmarshal([]byte(line.Value), &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (db *DBClient) saveExpiryIndex(ctx context.Context, key string, entries []expiryEntry) error {
+	if len(entries) == 0 {
+		return db.deleteQuietly(ctx, key)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return db.setLine(ctx, key, string(data))
+}
+
+// scheduleExpiry adds msg, just stored under key, to the expiry index.
+func (db *DBClient) scheduleExpiry(ctx context.Context, key string, msg Message) error {
+	entry := expiryEntry{Key: key, ID: msg.ID, ExpiresAt: *msg.ExpiresAt, RoomID: msg.RoomID}
+	if msg.RoomID == "" {
+		entry.Participants = []string{msg.Sender, msg.Recipient}
+	}
+	return db.addExpiryEntry(ctx, entry)
+}
+
+func (db *DBClient) addExpiryEntry(ctx context.Context, entry expiryEntry) error {
+	key := expiryBucketKey(expiryBucket(entry.ExpiresAt))
+	defer keyLocks.lock(key)()
+	entries, err := db.loadExpiryIndex(ctx, key)
+	if err != nil {
+		return err
+	}
+	return db.saveExpiryIndex(ctx, key, append(entries, entry))
+}
+
+// SweepExpired deletes the indexed messages whose TTL ran out by now and
+// returns their entries. Messages already deleted some other way are
+// dropped from the index all the same.
+func (db *DBClient) SweepExpired(ctx context.Context, now time.Time) ([]expiryEntry, error) {
+	defer keyLocks.lock(expirySweptKey)()
+	swept, known, err := db.loadSweptBucket(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	from := swept
+	if swept, err = db.migrateExpiryIndex(ctx, swept); err != nil {
+		return nil, err
+	}
+	all := []expiryEntry{}
+	for n := swept + 1; n <= expiryBucket(now); n++ {
+		entries, err := db.sweepBucket(ctx, n, now)
+		all = append(all, entries...)
+		if err != nil {
+			// Keep this and every later bucket for the next sweep.
+			if serr := db.saveSweptBucket(ctx, swept); serr != nil {
+				logger.Error("save swept expiry bucket failed", "event", "ttl", "error", serr)
+			}
+			return all, err
+		}
+		// A bucket counts as swept a bucket width after it ends, so
+		// that entries scheduled late, by sends that raced the sweep,
+		// are still found.
+		if !expiryBucketEnd(n).Add(expiryBucketWidth).After(now) {
+			swept = n
+		}
+	}
+	if known && swept == from {
+		return all, nil
+	}
+	return all, db.saveSweptBucket(ctx, swept)
+}
+
+// loadSweptBucket returns the newest bucket swept in full. Before the first
+// sweep it is the bucket before the oldest this process could have
+// scheduled, and known is false.
+func (db *DBClient) loadSweptBucket(ctx context.Context, now time.Time) (n int64, known bool, err error) {
+	line, err := db.getLine(ctx, expirySweptKey)
+	if err == creditdb.ErrNotFound {
+		return expiryBucket(now.Add(-ttlSweepInterval)) - 1, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	n, err = strconv.ParseInt(line.Value, 10, 64)
+	return n, err == nil, err
+}
+
+func (db *DBClient) saveSweptBucket(ctx context.Context, n int64) error {
+	return db.setLine(ctx, expirySweptKey, strconv.FormatInt(n, 10))
+}
+
+// migrateExpiryIndex moves the entries of an index written before buckets
+// into their buckets and returns swept, lowered so that the sweep starts
+// no later than the oldest of them. If it fails half way, the entries
+// already moved are moved again next time, which only repeats a delete.
+func (db *DBClient) migrateExpiryIndex(ctx context.Context, swept int64) (int64, error) {
+	defer keyLocks.lock(legacyExpiryIndexKey)()
+	entries, err := db.loadExpiryIndex(ctx, legacyExpiryIndexKey)
+	if err != nil || len(entries) == 0 {
+		return swept, err
+	}
+	for _, e := range entries {
+		if err := db.addExpiryEntry(ctx, e); err != nil {
+			return swept, err
+		}
+		swept = min(swept, expiryBucket(e.ExpiresAt)-1)
+	}
+	if err := db.saveSweptBucket(ctx, swept); err != nil {
+		return swept, err
+	}
+	return swept, db.deleteQuietly(ctx, legacyExpiryIndexKey)
+}
+
+// sweepBucket deletes the messages of bucket n whose TTL ran out by now and
+// removes their entries from it. The bucket is not locked while messages
+// are deleted, so sends can keep scheduling into it.
+func (db *DBClient) sweepBucket(ctx context.Context, n int64, now time.Time) ([]expiryEntry, error) {
+	key := expiryBucketKey(n)
+	unlock := keyLocks.lock(key)
+	entries, err := db.loadExpiryIndex(ctx, key)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	swept := []expiryEntry{}
+	var sweepErr error
+	for _, e := range entries {
+		if e.ExpiresAt.After(now) {
+			continue
+		}
+		err := db.DeleteMessage(ctx, e.Key, e.ID, "")
+		if err != nil && !errors.Is(err, errMessageNotFound) {
+			sweepErr = err
+			break
+		}
+		swept = append(swept, e)
+	}
+	if len(swept) == 0 {
+		return swept, sweepErr
+	}
+	if err := db.unscheduleExpiry(ctx, key, swept); err != nil && sweepErr == nil {
+		sweepErr = err
+	}
+	return swept, sweepErr
+}
+
+// unscheduleExpiry removes the entries of done from the bucket under key.
+func (db *DBClient) unscheduleExpiry(ctx context.Context, key string, done []expiryEntry) error {
+	ids := make(map[string]bool, len(done))
+	for _, e := range done {
+		ids[e.ID] = true
+	}
+	defer keyLocks.lock(key)()
+	entries, err := db.loadExpiryIndex(ctx, key)
+	if err != nil {
+		return err
+	}
+	kept := []expiryEntry{}
+	for _, e := range entries {
+		if !ids[e.ID] {
+			kept = append(kept, e)
+		}
+	}
+	return db.saveExpiryIndex(ctx, key, kept)
+}
+
+// runExpirySweeper sweeps expired messages every interval until ctx is
+// cancelled, and tells their participants. now is the sweeper's clock.
+func runExpirySweeper(ctx context.Context, db *DBClient, interval time.Duration, now func() time.Time) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			swept, err := db.SweepExpired(ctx, now())
+			if err != nil {
+				logger.Error("ttl sweep failed", "event", "ttl", "swept", len(swept), "error", err)
+			}
+			for _, e := range swept {
+				notifyExpired(db, e)
+			}
+		}
+	}
+}
+
+func notifyExpired(db *DBClient, e expiryEntry) {
+	participants := e.Participants
+	if e.RoomID != "" {
+		members, err := db.RoomMembers(context.Background(), e.RoomID)
+		if err != nil {
+			logger.Warn("load room members failed", "event", "ttl", "room_id", e.RoomID, "error", err)
+			return
+		}
+		participants = members
+	}
+	event := MessageChange{Type: EventDeleted, MessageID: e.ID}
+	for _, user := range participants {
+		notifyUser(user, event)
+	}
+}
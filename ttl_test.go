@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ayo-ajayi/realtime-chat-creditdb-websocket/storetest"
+)
+
+func TestExpiredMessageDisappears(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	bobConn, _ := ts.dial(t, bob)
+	var sent Message
+	if status := ts.do(t, http.MethodPost, "/send", map[string]any{"sender": alice, "recipient": bob, "content": "gone soon", "ttl": 1}, &sent); status != http.StatusOK {
+		t.Fatalf("send: %d", status)
+	}
+	readUntil(t, bobConn, EventMessage)
+	key := conversationKey(alice, bob)
+	kept := ts.send(t, alice, bob, "kept")
+
+	// The mock clock is past the TTL from the first sweep on.
+	clock := func() time.Time { return sent.ExpiresAt.Add(time.Second) }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runExpirySweeper(ctx, ts.db, 5*time.Millisecond, clock)
+
+	if frame := readUntil(t, bobConn, EventDeleted); frame["messageId"] != sent.ID {
+		t.Fatalf("deleted event for %v, want %s", frame["messageId"], sent.ID)
+	}
+	if ids := storedIDs(t, ts.db, key); ids[sent.ID] || !ids[kept.ID] {
+		t.Fatalf("stored after expiry: %v", ids)
+	}
+}
+
+// scheduleAt stores a message from alice to bob expiring at expiresAt and
+// indexes it.
+func scheduleAt(t *testing.T, db *DBClient, alice, bob string, expiresAt time.Time) Message {
+	t.Helper()
+	msg := Message{ID: newTestUser("msg"), Sender: alice, Recipient: bob, Content: "ttl", ExpiresAt: &expiresAt}
+	if err := db.StoreMessage(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.scheduleExpiry(context.Background(), conversationKey(alice, bob), msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestSweepExpiredReadsDueBuckets(t *testing.T) {
+	db := NewDBClientFromStore(storetest.NewMemStore())
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	key := conversationKey(alice, bob)
+	start := time.Unix(expiryBucket(time.Now())*60, 0)
+	soon := scheduleAt(t, db, alice, bob, start.Add(10*time.Second))
+	later := scheduleAt(t, db, alice, bob, start.Add(3*time.Minute))
+	laterBucket := expiryBucketKey(expiryBucket(*later.ExpiresAt))
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		swept    []string
+		stored   []string
+		keys     []string
+		sweptKey string
+	}{
+		// The bucket of soon is swept, but only counts as swept in full
+		// a bucket width after it ends.
+		{"first due", soon.ExpiresAt.Add(time.Second), []string{soon.ID}, []string{later.ID},
+			[]string{laterBucket, expirySweptKey}, strconv.FormatInt(expiryBucket(start)-1, 10)},
+		{"none due", later.ExpiresAt.Add(-time.Second), nil, []string{later.ID},
+			[]string{laterBucket, expirySweptKey}, strconv.FormatInt(expiryBucket(start), 10)},
+		{"second due", later.ExpiresAt.Add(2 * time.Minute), []string{later.ID}, nil,
+			[]string{expirySweptKey}, strconv.FormatInt(expiryBucket(*later.ExpiresAt), 10)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			swept, err := db.SweepExpired(context.Background(), tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range swept {
+				got = append(got, e.ID)
+			}
+			if !reflect.DeepEqual(got, tt.swept) {
+				t.Fatalf("swept = %v, want %v", got, tt.swept)
+			}
+			var stored []string
+			for id := range storedIDs(t, db, key) {
+				stored = append(stored, id)
+			}
+			if !reflect.DeepEqual(stored, tt.stored) {
+				t.Fatalf("stored = %v, want %v", stored, tt.stored)
+			}
+			if keys := expiryKeys(t, db); !reflect.DeepEqual(keys, tt.keys) {
+				t.Fatalf("expiry keys = %v, want %v", keys, tt.keys)
+			}
+			line, err := db.getLine(context.Background(), expirySweptKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line.Value != tt.sweptKey {
+				t.Fatalf("swept bucket = %s, want %s", line.Value, tt.sweptKey)
+			}
+		})
+	}
+}
+
+func TestSweepExpiredMigratesLegacyIndex(t *testing.T) {
+	db := NewDBClientFromStore(storetest.NewMemStore())
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	now := time.Now()
+	// Expired long before the first sweep, which by itself would only
+	// look back one sweep interval.
+	old := scheduleAt(t, db, alice, bob, now.Add(-time.Hour))
+	bucket := expiryBucketKey(expiryBucket(*old.ExpiresAt))
+	entries, err := db.loadExpiryIndex(context.Background(), bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.deleteQuietly(context.Background(), bucket)
+	if err := db.saveExpiryIndex(context.Background(), legacyExpiryIndexKey, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	swept, err := db.SweepExpired(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(swept) != 1 || swept[0].ID != old.ID {
+		t.Fatalf("swept = %+v, want %s", swept, old.ID)
+	}
+	if ids := storedIDs(t, db, conversationKey(alice, bob)); len(ids) != 0 {
+		t.Fatalf("stored after sweep: %v", ids)
+	}
+	if keys := expiryKeys(t, db); !reflect.DeepEqual(keys, []string{expirySweptKey}) {
+		t.Fatalf("expiry keys = %v", keys)
+	}
+}
+
+// expiryKeys returns the sorted keys of the expiry index.
+func expiryKeys(t *testing.T, db *DBClient) []string {
+	t.Helper()
+	lines, err := db.getAllLines(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, line := range lines {
+		if strings.HasPrefix(line.Key, legacyExpiryIndexKey) {
+			keys = append(keys, line.Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
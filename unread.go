@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const conversationPrefix = "user:messages:"
+
+// unreadCounts returns, per peer, how many messages ?user= has received but
+// not marked read. Peers with nothing unread are omitted.
+func (r *Router) unreadCounts(c *gin.Context) {
+	user, err := normalizeUserID(authenticatedUser(c, c.Query("user")))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "user: "+err.Error())
+		return
+	}
+	counts, err := r.dbclient.UnreadCounts(c, user)
+	if err != nil {
+		logger.Error("count unread messages failed", "event", "unread", "user", user, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to count unread messages")
+		return
+	}
+	c.JSON(http.StatusOK, counts)
+}
+
+// UnreadCounts maps each conversation partner of user to the number of
+// messages from them that have no ReadAt.
+func (db *DBClient) UnreadCounts(ctx context.Context, user string) (map[string]int, error) {
+	partners, err := db.ConversationPartners(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for _, peer := range partners {
+		messages, err := db.loadHistory(ctx, conversationKey(user, peer))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range messages {
+			if m.Recipient == user && m.ReadAt == nil {
+				counts[peer]++
+			}
+		}
+	}
+	return counts, nil
+}
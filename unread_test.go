@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestUnreadCounts(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob, carol, dave := newTestUser("alice"), newTestUser("bob"), newTestUser("carol"), newTestUser("dave")
+	fromBob := ts.send(t, bob, alice, "one")
+	ts.send(t, bob, alice, "two")
+	ts.send(t, carol, alice, "three")
+	ts.send(t, alice, bob, "alice's own")
+	ts.send(t, bob, dave, "not alice's")
+	if status := ts.do(t, http.MethodPost, "/read", map[string]any{"reader": alice, "sender": bob, "ids": []string{fromBob.ID}}, nil); status != http.StatusOK {
+		t.Fatalf("read: %d", status)
+	}
+
+	tests := []struct {
+		name string
+		user string
+		want map[string]int
+	}{
+		{"unread across conversations", alice, map[string]int{bob: 1, carol: 1}},
+		{"no conversations", newTestUser("nobody"), map[string]int{}},
+		{"only sent messages", carol, map[string]int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var counts map[string]int
+			if status := ts.do(t, http.MethodGet, "/unread?user="+tt.user, nil, &counts); status != http.StatusOK {
+				t.Fatalf("status = %d", status)
+			}
+			if !reflect.DeepEqual(counts, tt.want) {
+				t.Fatalf("unread = %v, want %v", counts, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxContentLength bounds Content in bytes. maxFrameSize bounds a whole
+// WebSocket frame and must leave room for the JSON envelope.
+var (
+	maxContentLength = envInt("MAX_CONTENT_LENGTH", 4096)
+	maxFrameSize     = envInt("MAX_FRAME_SIZE", 16384)
+)
+
+var (
+	errEmptyContent   = errors.New("content is empty")
+	errContentTooLong = fmt.Errorf("content exceeds %d bytes", maxContentLength)
+)
+
+// userIDPattern is the allowed shape of a user ID. It excludes ':' since DB
+// keys use it as a delimiter.
+var userIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.@-]{1,64}$`)
+
+var (
+	errEmptyUserID   = errors.New("user id is empty")
+	errInvalidUserID = errors.New("user id may only contain letters, digits and _ . @ - (max 64)")
+	errSelfMessage   = errors.New("sender and recipient must differ")
+)
+
+// normalizeUserID trims id and checks it against userIDPattern.
+func normalizeUserID(id string) (string, error) {
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return "", errEmptyUserID
+	}
+	if !userIDPattern.MatchString(id) {
+		return "", errInvalidUserID
+	}
+	return id, nil
+}
+
+// Content is normalized before it is validated and stored, so that the
+// same text always has the same bytes for display, search and length
+// limits. CONTENT_NORMALIZATION is nfc (the default) or none.
+// CONTROL_CHARS sets what happens to C0 and C1 control characters other
+// than tab, newline and carriage return: keep them (the default), strip
+// them, or reject the message. Format characters such as the zero-width
+// joiner used by emoji sequences are never touched.
+var (
+	contentNormalization = envChoice("CONTENT_NORMALIZATION", "nfc", "nfc", "none")
+	controlCharPolicy    = envChoice("CONTROL_CHARS", "keep", "keep", "strip", "reject")
+)
+
+var errControlChars = errors.New("content contains control characters")
+
+func disallowedControl(r rune) bool {
+	return unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r'
+}
+
+// normalizeText applies CONTENT_NORMALIZATION to s. Search queries go
+// through it too, so that they match stored content.
+func normalizeText(s string) string {
+	if contentNormalization == "nfc" {
+		return norm.NFC.String(s)
+	}
+	return s
+}
+
+// normalizeContent normalizes message content per CONTENT_NORMALIZATION
+// and CONTROL_CHARS.
+func normalizeContent(content string) (string, error) {
+	if strings.IndexFunc(content, disallowedControl) >= 0 {
+		switch controlCharPolicy {
+		case "reject":
+			return "", errControlChars
+		case "strip":
+			content = strings.Map(func(r rune) rune {
+				if disallowedControl(r) {
+					return -1
+				}
+				return r
+			}, content)
+		}
+	}
+	return normalizeText(content), nil
+}
+
+func validateContent(content string) error {
+	if content == "" {
+		return errEmptyContent
+	}
+	if len(content) > maxContentLength {
+		return errContentTooLong
+	}
+	return nil
+}
+
+// validateFrame checks a chat message read from a WebSocket the way /send
+// checks its request, normalizing msg.Recipient and msg.Content in place.
+func validateFrame(msg *Message) error {
+	if msg.RoomID == "" {
+		recipient, err := normalizeUserID(msg.Recipient)
+		if err != nil {
+			return fmt.Errorf("recipient: %w", err)
+		}
+		if recipient == msg.Sender {
+			return errSelfMessage
+		}
+		msg.Recipient = recipient
+	}
+	content, err := normalizeContent(msg.Content)
+	if err != nil {
+		return err
+	}
+	msg.Content = content
+	if err := validateTTL(msg.TTL); err != nil {
+		return err
+	}
+	return validateBody(msg.Content, msg.Attachments)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestContentLengthLimit(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	aliceConn, _ := ts.dial(t, alice)
+	bobConn, _ := ts.dial(t, bob)
+
+	tests := []struct {
+		name    string
+		content string
+		ok      bool
+	}{
+		{"at the limit", strings.Repeat("a", maxContentLength), true},
+		{"over the limit", strings.Repeat("a", maxContentLength+1), false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp struct{ Code string }
+			status := ts.do(t, http.MethodPost, "/send", map[string]any{"sender": alice, "recipient": bob, "content": tt.content}, &resp)
+			if tt.ok != (status == http.StatusOK) {
+				t.Fatalf("/send status = %d", status)
+			}
+			if !tt.ok && resp.Code != ErrCodeInvalidRequest {
+				t.Fatalf("/send code = %q, want %q", resp.Code, ErrCodeInvalidRequest)
+			}
+			if tt.ok {
+				readUntil(t, bobConn, EventMessage)
+			}
+
+			if err := aliceConn.WriteJSON(map[string]any{"type": EventMessage, "recipient": bob, "content": tt.content}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.ok {
+				if frame := readUntil(t, bobConn, EventMessage); frame["content"] != tt.content {
+					t.Fatalf("bob got %d bytes, want %d", len(frame["content"].(string)), len(tt.content))
+				}
+				return
+			}
+			if frame := readUntil(t, aliceConn, EventError); frame["code"] != ErrCodeInvalidMessage {
+				t.Fatalf("error = %v, want code %q", frame, ErrCodeInvalidMessage)
+			}
+		})
+	}
+}
+
+func TestOversizedFrameClosesConnection(t *testing.T) {
+	ts := newTestServer(t)
+	alice := newTestUser("alice")
+	conn, _ := ts.dial(t, alice)
+	frame := `{"type":"message","recipient":"bob","content":"` + strings.Repeat("a", maxFrameSize) + `"}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			return
+		}
+		if err != nil {
+			t.Fatalf("read: %v, want close %d", err, websocket.CloseMessageTooBig)
+		}
+	}
+}
+
+func TestNormalizeUserID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+		err  error
+	}{
+		{"alice", "alice", nil},
+		{"  alice\t", "alice", nil},
+		{"a.b_c-d@example.com", "a.b_c-d@example.com", nil},
+		{"", "", errEmptyUserID},
+		{"   ", "", errEmptyUserID},
+		{"a:b", "", errInvalidUserID},
+		{"a b", "", errInvalidUserID},
+		{strings.Repeat("a", 65), "", errInvalidUserID},
+	}
+	for _, tt := range tests {
+		got, err := normalizeUserID(tt.id)
+		if got != tt.want || err != tt.err {
+			t.Errorf("normalizeUserID(%q) = %q, %v, want %q, %v", tt.id, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// withContentPolicy sets contentNormalization and controlCharPolicy for
+// the test.
+func withContentPolicy(t *testing.T, normalization, control string) {
+	t.Helper()
+	oldNormalization, oldControl := contentNormalization, controlCharPolicy
+	contentNormalization, controlCharPolicy = normalization, control
+	t.Cleanup(func() { contentNormalization, controlCharPolicy = oldNormalization, oldControl })
+}
+
+func TestNormalizeContent(t *testing.T) {
+	const composed, decomposed = "caf\u00e9", "cafe\u0301"
+	tests := []struct {
+		name          string
+		normalization string
+		control       string
+		content       string
+		want          string
+		err           error
+	}{
+		{"composed stays composed", "nfc", "keep", composed, composed, nil},
+		{"decomposed is composed", "nfc", "keep", decomposed, composed, nil},
+		{"decomposed kept without normalization", "none", "keep", decomposed, decomposed, nil},
+		{"tab and newlines kept", "nfc", "reject", "a\tb\nc\r\nd", "a\tb\nc\r\nd", nil},
+		{"zero-width joiner kept", "nfc", "strip", "\U0001F469\u200d\U0001F4BB", "\U0001F469\u200d\U0001F4BB", nil},
+		{"control characters kept", "nfc", "keep", "a\x00b\x1bc\u0085d", "a\x00b\x1bc\u0085d", nil},
+		{"control characters stripped", "nfc", "strip", "a\x00b\x1bc\u0085d\te", "abcd\te", nil},
+		{"control characters rejected", "nfc", "reject", "a\x07b", "", errControlChars},
+		{"stripped and composed", "nfc", "strip", "cafe\x00\u0301", composed, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withContentPolicy(t, tt.normalization, tt.control)
+			got, err := normalizeContent(tt.content)
+			if got != tt.want || err != tt.err {
+				t.Fatalf("normalizeContent(%q) = %q, %v, want %q, %v", tt.content, got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestSendStoresNormalizedContent(t *testing.T) {
+	withContentPolicy(t, "nfc", "reject")
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	if got := ts.send(t, alice, bob, "cafe\u0301").Content; got != "caf\u00e9" {
+		t.Fatalf("/send answered content %q, want it composed", got)
+	}
+	if history := ts.history(t, alice, bob); len(history) != 1 || history[0].Content != "caf\u00e9" {
+		t.Fatalf("stored %+v, want the composed content", history)
+	}
+	body := map[string]any{"sender": alice, "recipient": bob, "content": "bell\x07"}
+	var answer struct {
+		Code string `json:"code"`
+	}
+	if status := ts.do(t, http.MethodPost, "/send", body, &answer); status != http.StatusBadRequest || answer.Code != ErrCodeInvalidRequest {
+		t.Fatalf("/send with a control character = %d %q, want 400 %s", status, answer.Code, ErrCodeInvalidRequest)
+	}
+}
+
+func TestSendValidatesUserIDs(t *testing.T) {
+	ts := newTestServer(t)
+	alice := newTestUser("alice")
+	tests := []struct {
+		name      string
+		sender    string
+		recipient string
+		status    int
+	}{
+		{"self-send", alice, alice, http.StatusBadRequest},
+		{"self-send after trim", alice, " " + alice + " ", http.StatusBadRequest},
+		{"empty sender after trim", "  ", "bob", http.StatusBadRequest},
+		{"empty recipient after trim", alice, " \t", http.StatusBadRequest},
+		{"colon in sender", "a:b", "bob", http.StatusBadRequest},
+		{"colon in recipient", alice, "messages:bob", http.StatusBadRequest},
+		{"valid", " " + alice, newTestUser("bob"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp struct{ Code, Error string }
+			status := ts.do(t, http.MethodPost, "/send", map[string]any{"sender": tt.sender, "recipient": tt.recipient, "content": "hi"}, &resp)
+			if status != tt.status {
+				t.Fatalf("status = %d %+v, want %d", status, resp, tt.status)
+			}
+			if status != http.StatusOK && (resp.Code != ErrCodeInvalidRequest || resp.Error == "") {
+				t.Fatalf("response = %+v, want a descriptive %s", resp, ErrCodeInvalidRequest)
+			}
+		})
+	}
+}
+
+func TestMarkReadValidatesUserIDs(t *testing.T) {
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	sent := ts.send(t, alice, bob, "hi")
+	tests := []struct {
+		name   string
+		reader string
+		sender string
+		status int
+		read   int
+	}{
+		{"empty reader", " ", alice, http.StatusBadRequest, 0},
+		{"colon in reader", "a:b", alice, http.StatusBadRequest, 0},
+		{"empty sender after trim", bob, " \t", http.StatusBadRequest, 0},
+		{"colon in sender", bob, "messages:" + alice, http.StatusBadRequest, 0},
+		{"padded IDs", " " + bob, alice + " ", http.StatusOK, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp struct {
+				Code, Error string
+				Read        []string
+			}
+			status := ts.do(t, http.MethodPost, "/read", map[string]any{"reader": tt.reader, "sender": tt.sender, "ids": []string{sent.ID}}, &resp)
+			if status != tt.status {
+				t.Fatalf("status = %d %+v, want %d", status, resp, tt.status)
+			}
+			if status != http.StatusOK && (resp.Code != ErrCodeInvalidRequest || resp.Error == "") {
+				t.Fatalf("response = %+v, want a descriptive %s", resp, ErrCodeInvalidRequest)
+			}
+			if len(resp.Read) != tt.read {
+				t.Fatalf("read = %v, want %d messages", resp.Read, tt.read)
+			}
+		})
+	}
+}
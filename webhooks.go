@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/creditdb/go-creditdb"
+	"github.com/gin-gonic/gin"
+)
+
+// A user may register a webhook URL. Every message queued for them while
+// they are offline is also POSTed there as JSON, for example to trigger a
+// push notification. Calls are made in the background, each attempt limited
+// to webhookTimeout, and retried up to webhookRetries times on network
+// errors, 429 and 5xx answers.
+var (
+	webhookTimeout = envDuration("WEBHOOK_TIMEOUT", 5*time.Second)
+	webhookRetries = envInt("WEBHOOK_RETRIES", 3)
+	webhookBackoff = time.Second
+)
+
+// webhookAllowPrivate lets webhooks reach loopback, private and link-local
+// addresses, which are refused by default so that a registered URL cannot
+// be used to probe the server's own network.
+var webhookAllowPrivate = envChoice("WEBHOOK_ALLOW_PRIVATE", "false", "true", "false") == "true"
+
+var errPrivateWebhook = errors.New("webhook address is not public")
+
+// webhookClient checks the address of every connection it opens, after
+// DNS resolution and on redirects too, and ignores proxy settings, which
+// would hide the real target.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: checkWebhookDial,
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+		MaxIdleConnsPerHost: 4,
+	},
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, RFC 6598, which
+// netip does not count as private.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddr reports whether addr may be the target of a webhook.
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() && addr.IsGlobalUnicast() && !addr.IsPrivate() &&
+		!sharedAddressSpace.Contains(addr)
+}
+
+func checkWebhookDial(network, address string, _ syscall.RawConn) error {
+	if webhookAllowPrivate {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", errPrivateWebhook, addrPort.Addr())
+	}
+	return nil
+}
+
+// webhookSlots bounds the webhook calls in flight. Calls beyond it are
+// skipped rather than queued, since the message is in the offline queue
+// anyway.
+var webhookSlots = make(chan struct{}, envInt("WEBHOOK_CONCURRENCY", 32))
+
+func webhookKey(user string) string {
+	return "webhook:" + keyPart(user)
+}
+
+// registerWebhook stores {"url"} as the webhook of {"user"}, the caller,
+// replacing any previous one.
+func (r *Router) registerWebhook(c *gin.Context) {
+	var req struct {
+		User string `json:"user"`
+		URL  string `json:"url" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	user, err := normalizeUserID(authenticatedUser(c, req.User))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "user: "+err.Error())
+		return
+	}
+	if err := validateWebhookURL(req.URL); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := r.dbclient.setLine(c, webhookKey(user), req.URL); err != nil {
+		logger.Error("register webhook failed", "event", "webhook", "user", user, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to register webhook")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user, "url": req.URL})
+}
+
+// deleteWebhook removes the webhook of ?user=, the caller. It answers 204
+// whether or not one was registered.
+func (r *Router) deleteWebhook(c *gin.Context) {
+	user, err := normalizeUserID(authenticatedUser(c, c.Query("user")))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "user: "+err.Error())
+		return
+	}
+	if err := r.dbclient.deleteQuietly(c, webhookKey(user)); err != nil {
+		logger.Error("delete webhook failed", "event", "webhook", "user", user, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "failed to delete webhook")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// validateWebhookURL refuses URLs that are not absolute http(s) ones and,
+// unless webhookAllowPrivate is set, those naming localhost or a
+// non-public IP address. Host names are only checked when dialing, since
+// they may resolve differently by then.
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	if webhookAllowPrivate {
+		return nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("url must point to a public address")
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && !publicAddr(addr) {
+		return fmt.Errorf("url must point to a public address")
+	}
+	return nil
+}
+
+// Webhook returns the webhook URL of user, or "" if none is registered.
+func (db *DBClient) Webhook(ctx context.Context, user string) (string, error) {
+	line, err := db.getLine(ctx, webhookKey(user))
+	if err == creditdb.ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return line.Value, nil
+}
+
+// fireWebhook POSTs msg to user's webhook, if any and unless user muted
+// its conversation, in the background.
+func fireWebhook(db *DBClient, user string, msg Message) {
+	if isMuted(db, user, muteTarget(msg.Sender, msg.RoomID)) {
+		return
+	}
+	hook, err := db.Webhook(context.Background(), user)
+	if err != nil {
+		logger.Error("load webhook failed", "event", "webhook", "recipient", user, "error", err)
+		return
+	}
+	if hook == "" {
+		return
+	}
+	select {
+	case webhookSlots <- struct{}{}:
+	default:
+		logger.Warn("too many webhook calls in flight, skipping", "event", "webhook", "recipient", user, "message_id", msg.ID)
+		return
+	}
+	go func() {
+		defer func() { <-webhookSlots }()
+		defer logPanic("webhook", "recipient", user, "message_id", msg.ID)
+		if err := postWebhook(hook, msg); err != nil {
+			logger.Warn("webhook failed", "event", "webhook", "recipient", user, "message_id", msg.ID, "error", err)
+		}
+	}()
+}
+
+// postWebhook delivers msg to hook, retrying transient failures with a
+// linear backoff.
+func postWebhook(hook string, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		retry, err := postWebhookOnce(hook, body)
+		if err == nil || !retry || attempt >= webhookRetries {
+			return err
+		}
+		time.Sleep(time.Duration(attempt+1) * webhookBackoff)
+	}
+}
+
+// postWebhookOnce makes one attempt and reports whether a failure is worth
+// retrying.
+func postWebhookOnce(hook string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, hook, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return false, fmt.Errorf("webhook answered %s", resp.Status)
+}
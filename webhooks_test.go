@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+// withWebhookAllowPrivate sets webhookAllowPrivate for the test.
+func withWebhookAllowPrivate(t *testing.T, allow bool) {
+	t.Helper()
+	old := webhookAllowPrivate
+	webhookAllowPrivate = allow
+	t.Cleanup(func() { webhookAllowPrivate = old })
+}
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::248", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := publicAddr(netip.MustParseAddr(tt.addr)); got != tt.public {
+				t.Fatalf("publicAddr(%s) = %v, want %v", tt.addr, got, tt.public)
+			}
+		})
+	}
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	withWebhookAllowPrivate(t, false)
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://push.example.com/hook", true},
+		{"http://93.184.216.34:8080/hook", true},
+		{"ftp://push.example.com/hook", false},
+		{"/relative", false},
+		{"http://localhost:8080/hook", false},
+		{"http://api.localhost/hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://10.0.0.5/hook", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if err := validateWebhookURL(tt.url); (err == nil) != tt.ok {
+				t.Fatalf("validateWebhookURL(%q) = %v, want ok %v", tt.url, err, tt.ok)
+			}
+		})
+	}
+}
+
+// webhookStub records the messages POSTed to it.
+type webhookStub struct {
+	*httptest.Server
+	mu       sync.Mutex
+	received []Message
+}
+
+func newWebhookStub(t *testing.T) *webhookStub {
+	t.Helper()
+	stub := &webhookStub{}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("webhook body: %v", err)
+		}
+		stub.mu.Lock()
+		stub.received = append(stub.received, msg)
+		stub.mu.Unlock()
+	}))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+func (s *webhookStub) messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.received...)
+}
+
+func TestWebhookIsCalledForOfflineRecipient(t *testing.T) {
+	// The stub listens on loopback.
+	withWebhookAllowPrivate(t, true)
+	stub := newWebhookStub(t)
+	ts := newTestServer(t)
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	if status := ts.do(t, http.MethodPost, "/webhooks", map[string]any{"user": bob, "url": stub.URL}, nil); status != http.StatusOK {
+		t.Fatalf("register webhook: %d", status)
+	}
+	sent := ts.send(t, alice, bob, "are you there?")
+	waitFor(t, "webhook call", func() bool { return len(stub.messages()) > 0 })
+	if got := stub.messages(); len(got) != 1 || got[0].ID != sent.ID || got[0].Content != "are you there?" {
+		t.Fatalf("webhook received %+v, want %s", got, sent.ID)
+	}
+
+	// An online recipient gets the message live instead.
+	bobConn, _ := ts.dial(t, bob)
+	live := ts.send(t, alice, bob, "hello again")
+	if frame := readUntil(t, bobConn, EventMessage); frame["id"] != live.ID {
+		t.Fatalf("live message = %v, want %s", frame["id"], live.ID)
+	}
+	if status := ts.do(t, http.MethodDelete, "/webhooks?user="+bob, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("delete webhook: %d", status)
+	}
+	if got := stub.messages(); len(got) != 1 {
+		t.Fatalf("webhook called for an online recipient: %+v", got)
+	}
+}
+
+func TestWebhookRefusesPrivateAddresses(t *testing.T) {
+	withWebhookAllowPrivate(t, false)
+	stub := newWebhookStub(t)
+	ts := newTestServer(t)
+	if status := ts.do(t, http.MethodPost, "/webhooks", map[string]any{"user": newTestUser("bob"), "url": stub.URL}, nil); status != http.StatusBadRequest {
+		t.Fatalf("register loopback webhook: %d, want 400", status)
+	}
+	// A URL stored before, or a host name resolving to loopback, is
+	// refused when dialing.
+	if _, err := postWebhookOnce(stub.URL, []byte("{}")); !errors.Is(err, errPrivateWebhook) {
+		t.Fatalf("post to loopback: %v, want %v", err, errPrivateWebhook)
+	}
+	if got := stub.messages(); len(got) != 0 {
+		t.Fatalf("stub reached: %+v", got)
+	}
+}